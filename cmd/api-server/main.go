@@ -2,80 +2,179 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/dylan-dinh/esl-test/internal/config"
 	"github.com/dylan-dinh/esl-test/internal/domain/user"
 	"github.com/dylan-dinh/esl-test/internal/infrastructure/persistence/db"
 	"github.com/dylan-dinh/esl-test/internal/infrastructure/persistence/repository"
 	pb "github.com/dylan-dinh/esl-test/internal/interfaces/grpc/user"
+	"github.com/dylan-dinh/esl-test/internal/interfaces/metrics"
 	"github.com/dylan-dinh/esl-test/internal/interfaces/notifier"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
+// rabbitHealthService is the health check service reporting the broker connection
+const rabbitHealthService = "rabbitmq"
+
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	conf, err := config.GetConfig()
+	conf, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(2)
+	}
+	if conf.PrintConfig {
+		if err := config.Print(os.Stdout, conf); err != nil {
+			panic(err)
+		}
+		return
 	}
 
-	rabbitConn, err := notifier.NewRabbitMQConn(conf)
+	// the manager reconnects when the broker is lost, the relay keeps the events in the outbox meanwhile
+	rabbit := notifier.NewConnectionManager(conf)
+	rabbitConn, err := rabbit.Connect()
 	if err != nil {
 		panic(err)
 	}
-	defer func() {
-		if err := rabbitConn.Close(); err != nil {
-			logger.Error("error disconnecting from rabbit", "error", err)
-		}
-	}()
 
-	mq, err := user.NewRabbitMQ(rabbitConn)
+	mq, err := user.NewRabbitMQ(rabbitConn, notifier.RabbitMQOptions(conf))
 	if err != nil {
 		panic(err)
 	}
+	rabbit.OnConnect(mq.Setup)
 
 	newDb, err := db.NewDb(conf)
 	if err != nil {
 		panic(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	defer func() {
-		if err := newDb.DB.Disconnect(ctx); err != nil {
-			logger.Error("error disconnecting from DB", "error", err)
-		}
-	}()
-
 	userRepo, err := repository.NewUserRepository(newDb.DB, conf.DbName)
 	if err != nil {
 		panic(err)
 	}
-	userService := user.NewUserService(userRepo, mq)
+	outboxRepo, err := repository.NewOutboxRepository(newDb.DB, conf.DbName)
+	if err != nil {
+		panic(err)
+	}
+	refreshTokenRepo, err := repository.NewRefreshTokenRepository(newDb.DB, conf.DbName)
+	if err != nil {
+		panic(err)
+	}
+	userService := user.NewUserService(userRepo, outboxRepo, refreshTokenRepo, repository.NewTransactor(newDb.DB))
 	userServer := pb.NewUserServer(userService)
 
+	tokenManager, err := newTokenManager(conf)
+	if err != nil {
+		panic(err)
+	}
+	authService := user.NewAuthService(userRepo, refreshTokenRepo, tokenManager, conf.RefreshTokenTTL)
+	authServer := pb.NewAuthServer(authService)
+
+	subscriptionRepo, err := repository.NewSubscriptionRepository(newDb.DB, conf.DbName)
+	if err != nil {
+		panic(err)
+	}
+	deliveryRepo, err := repository.NewDeliveryRepository(newDb.DB, conf.DbName)
+	if err != nil {
+		panic(err)
+	}
+	webhookServer := pb.NewWebhookServer(user.NewWebhookService(subscriptionRepo, deliveryRepo))
+	dispatcher := user.NewWebhookDispatcher(subscriptionRepo, deliveryRepo, user.WebhookDispatcherOptions{
+		Timeout:      conf.WebhookTimeout,
+		MaxAttempts:  conf.WebhookMaxAttempts,
+		DisableAfter: conf.WebhookDisableAfter,
+	})
+
+	// the outbox is relayed to every configured sink
+	eventNotifier := newEventNotifier(conf, map[string]user.Notifier{
+		"rabbitmq": mq,
+		"webhook":  user.NewWebhookNotifier(subscriptionRepo, deliveryRepo, conf.CloudEventsSource),
+		"log":      newAuditBus(logger),
+	})
+
+	// the relay publishes the events committed in the outbox
+	// the dispatcher sends the webhook deliveries
+	// and the purge job removes the users deleted for longer than the retention
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	relay := user.NewRelay(outboxRepo, eventNotifier)
+	go relay.Run(jobsCtx)
+	go dispatcher.Run(jobsCtx)
+	go user.NewPurgeJob(userService, conf.UserRetention, conf.PurgeInterval).Run(jobsCtx)
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", conf.GrpcPort))
 	if err != nil {
 		panic("failed to listen")
 	}
 
-	grpcServer := grpc.NewServer()
+	authorizer := pb.NewAuthorizer(tokenManager, pb.DefaultPolicy)
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(pb.MetricsUnaryInterceptor(), authorizer.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(pb.MetricsStreamInterceptor(), authorizer.StreamInterceptor()),
+	}
+	if conf.GrpcTLS.Enabled() {
+		// the certificate and the client CA are reloaded when they change on disk
+		reloader, err := pb.NewCertReloader(pb.ServerTLSOptions{
+			CertFile:           conf.GrpcTLS.CertFile,
+			KeyFile:            conf.GrpcTLS.KeyFile,
+			ClientCAFile:       conf.GrpcTLS.ClientCAFile,
+			OptionalClientCert: conf.GrpcTLS.ClientAuth == "optional",
+			ReloadInterval:     conf.GrpcTLS.ReloadInterval,
+		})
+		if err != nil {
+			log.Fatalf("failed to load the gRPC TLS files: %v", err)
+		}
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(reloader.TLSConfig())))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
 	// health check endpoint
+	// the service stays SERVING without the broker, the rabbitmq status shows it is degraded
 	healthServer := health.NewServer()
+	healthServer.SetServingStatus(rabbitHealthService, healthpb.HealthCheckResponse_SERVING)
+	rabbit.OnStatusChange(func(connected bool) {
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if connected {
+			status = healthpb.HealthCheckResponse_SERVING
+		}
+		healthServer.SetServingStatus(rabbitHealthService, status)
+	})
+	go rabbit.Run(jobsCtx)
 	healthpb.RegisterHealthServer(grpcServer, healthServer)
 	reflection.Register(grpcServer)
 
 	pb.RegisterUserServiceServer(grpcServer, userServer)
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+	pb.RegisterWebhookServiceServer(grpcServer, webhookServer)
+
+	// the metrics are served on an admin port, apart from the API
+	registry := metrics.NewRegistry(pb.Collectors(), user.Collectors(), db.Collectors(),
+		[]prometheus.Collector{metrics.NewCountGauge("users_total", "Users not deleted", userRepo.Count)})
+	metricsServer := metrics.NewServer(conf.MetricsPort, registry)
+	go func() {
+		log.Printf("metrics are served on port %s...", conf.MetricsPort)
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to serve metrics: %v", err)
+		}
+	}()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -89,5 +188,85 @@ func main() {
 
 	<-quit
 	logger.Info("Received shutdown signal, gracefully shutting down...")
-	grpcServer.GracefulStop()
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	// the RPCs finish, then the writes of the jobs, then the relay publishes their events
+	// the broker is closed once the events are confirmed and the DB as the relay marks them sent
+	// the metrics are scraped until the end
+	stopGrpcServer(ctx, grpcServer)
+	if err := userService.Shutdown(ctx); err != nil {
+		logger.Error("error draining the user writes", "error", err)
+	}
+	if err := relay.Shutdown(ctx); err != nil {
+		logger.Error("error draining the outbox", "error", err)
+	}
+	stopJobs()
+	if err := mq.Close(ctx); err != nil {
+		logger.Error("error closing rabbit channels", "error", err)
+	}
+	if err := rabbit.Close(); err != nil {
+		logger.Error("error disconnecting from rabbit", "error", err)
+	}
+	if err := newDb.DB.Disconnect(ctx); err != nil {
+		logger.Error("error disconnecting from DB", "error", err)
+	}
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		logger.Error("error stopping the metrics server", "error", err)
+	}
+}
+
+// stopGrpcServer waits for the RPCs in progress and cancels them when ctx is done
+func stopGrpcServer(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// newEventNotifier fans the events out to the sinks of the config
+func newEventNotifier(conf config.Config, notifiers map[string]user.Notifier) user.Notifier {
+	sinks := make([]user.Sink, 0, len(conf.Notifiers))
+	for _, n := range conf.Notifiers {
+		sinks = append(sinks, user.Sink{Name: n.Name, Notifier: notifiers[n.Name], Policy: user.SinkPolicy(n.Policy)})
+	}
+	return user.NewFanOut(sinks...)
+}
+
+// newAuditBus is the in-process bus logging one line per event
+func newAuditBus(logger *slog.Logger) *user.Bus {
+	bus := user.NewBus()
+	bus.Subscribe(user.AllEvents, func(_ context.Context, e *user.Event) error {
+		logger.Info("user event", "event_id", e.ID, "type", e.Type, "user_id", e.User.ID)
+		return nil
+	})
+	return bus
+}
+
+// newTokenManager signs access tokens with EdDSA when a private key file is
+// configured and with the HS256 secret otherwise
+func newTokenManager(conf config.Config) (*user.TokenManager, error) {
+	if conf.JwtPrivateKeyFile == "" {
+		return user.NewHS256TokenManager([]byte(conf.JwtSecret), conf.AccessTokenTTL), nil
+	}
+
+	pemKey, err := os.ReadFile(conf.JwtPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading jwt private key: %w", err)
+	}
+	key, err := jwt.ParseEdPrivateKeyFromPEM(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jwt private key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("jwt private key is not an ed25519 key")
+	}
+	return user.NewEdDSATokenManager(edKey, conf.AccessTokenTTL), nil
 }
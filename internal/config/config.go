@@ -2,9 +2,12 @@ package config
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/joho/godotenv"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -14,6 +17,70 @@ const (
 	keyDbName     = "DB_NAME"
 	keyRabbitHost = "RABBIT_HOST"
 	keyRabbitPort = "RABBIT_PORT"
+
+	keyGrpcTLSCertFile       = "GRPC_TLS_CERT_FILE"
+	keyGrpcTLSKeyFile        = "GRPC_TLS_KEY_FILE"
+	keyGrpcTLSClientCAFile   = "GRPC_TLS_CLIENT_CA_FILE"
+	keyGrpcTLSClientAuth     = "GRPC_TLS_CLIENT_AUTH"
+	keyGrpcTLSReloadInterval = "GRPC_TLS_RELOAD_INTERVAL"
+
+	keyMongoURI        = "MONGO_URI"
+	keyDbUsername      = "DB_USERNAME"
+	keyDbPassword      = "DB_PASSWORD"
+	keyDbAuthSource    = "DB_AUTH_SOURCE"
+	keyDbReplicaSet    = "DB_REPLICA_SET"
+	keyDbTLS           = "DB_TLS"
+	keyDbTLSCAFile     = "DB_TLS_CA_FILE"
+	keyDbTLSCertFile   = "DB_TLS_CERT_FILE"
+	keyDbTLSKeyFile    = "DB_TLS_KEY_FILE"
+	keyAmqpURL         = "AMQP_URL"
+	keyRabbitUsername  = "RABBIT_USERNAME"
+	keyRabbitPassword  = "RABBIT_PASSWORD"
+	keyRabbitVhost     = "RABBIT_VHOST"
+	keyRabbitTLS       = "RABBIT_TLS"
+	keyRabbitTLSCAFile = "RABBIT_TLS_CA_FILE"
+	keyRabbitCertFile  = "RABBIT_TLS_CERT_FILE"
+	keyRabbitKeyFile   = "RABBIT_TLS_KEY_FILE"
+
+	keyJwtSecret         = "JWT_SECRET"
+	keyJwtPrivateKeyFile = "JWT_PRIVATE_KEY_FILE"
+	keyAccessTokenTTL    = "ACCESS_TOKEN_TTL"
+	keyRefreshTokenTTL   = "REFRESH_TOKEN_TTL"
+
+	keyUserRetention = "USER_RETENTION"
+	keyPurgeInterval = "PURGE_INTERVAL"
+
+	keyShutdownTimeout = "SHUTDOWN_TIMEOUT"
+
+	keyMetricsPort = "METRICS_PORT"
+
+	keyCloudEventsMode   = "CLOUDEVENTS_MODE"
+	keyCloudEventsSource = "CLOUDEVENTS_SOURCE"
+	keyEventsContentType = "EVENTS_CONTENT_TYPE"
+
+	keyRabbitPublishChannels = "RABBIT_PUBLISH_CHANNELS"
+	keyRabbitMaxInFlight     = "RABBIT_MAX_IN_FLIGHT"
+
+	keyRabbitQueues             = "RABBIT_QUEUES"
+	keyRabbitQueueType          = "RABBIT_QUEUE_TYPE"
+	keyRabbitQueueDurable       = "RABBIT_QUEUE_DURABLE"
+	keyRabbitPersistent         = "RABBIT_PERSISTENT"
+	keyRabbitDeadLetterExchange = "RABBIT_DEAD_LETTER_EXCHANGE"
+	keyRabbitDeadLetterQueue    = "RABBIT_DEAD_LETTER_QUEUE"
+	keyRabbitMessageTTL         = "RABBIT_MESSAGE_TTL"
+	keyRabbitQueueMaxLength     = "RABBIT_QUEUE_MAX_LENGTH"
+
+	keyNotifiers           = "NOTIFIERS"
+	keyWebhookTimeout      = "WEBHOOK_TIMEOUT"
+	keyWebhookMaxAttempts  = "WEBHOOK_MAX_ATTEMPTS"
+	keyWebhookDisableAfter = "WEBHOOK_DISABLE_AFTER"
+
+	// keyConfigFile is the config file when the --config flag is not given
+	keyConfigFile = "CONFIG_FILE"
+	// secretFileSuffix reads a secret from a file, like DB_PASSWORD_FILE or password_file in the config file
+	secretFileSuffix = "_FILE"
+	// minJwtSecretLength is the size of a SHA-256 block, shorter HS256 secrets can be guessed
+	minJwtSecretLength = 32
 )
 
 type Config struct {
@@ -23,10 +90,248 @@ type Config struct {
 	DbName     string
 	RabbitHost string
 	RabbitPort string
+
+	// GrpcTLS serves the gRPC API over TLS, plaintext without certificate
+	GrpcTLS ServerTLS
+
+	// MongoURI is the complete connection string, exclusive with DbHost, DbPort and the credentials
+	// Without it the client connects directly to DbHost, or to the DbReplicaSet members it discovers
+	MongoURI     string
+	DbUsername   string
+	DbPassword   string
+	DbAuthSource string
+	DbReplicaSet string
+	DbTLS        TLS
+
+	// AmqpURL is the complete broker URL, exclusive with RabbitHost, RabbitPort and the credentials
+	// Without it guest:guest connects to the default vhost
+	AmqpURL        string
+	RabbitUsername string
+	RabbitPassword string
+	RabbitVhost    string
+	RabbitTLS      TLS
+
+	// JwtSecret signs access tokens with HS256
+	// JwtPrivateKeyFile is a PEM ed25519 key signing them with EdDSA instead
+	JwtSecret         string
+	JwtPrivateKeyFile string
+	AccessTokenTTL    time.Duration
+	RefreshTokenTTL   time.Duration
+
+	// UserRetention is how long a deleted user can be restored before being purged
+	UserRetention time.Duration
+	PurgeInterval time.Duration
+
+	// ShutdownTimeout bounds the drain of the RPCs, writes and events in progress on SIGTERM
+	ShutdownTimeout time.Duration
+
+	// MetricsPort is the admin port serving the Prometheus metrics on /metrics
+	MetricsPort string
+
+	// CloudEventsMode is binary (ce- headers) or structured (JSON envelope)
+	CloudEventsMode   string
+	CloudEventsSource string
+	// EventsContentType is application/json or application/protobuf
+	EventsContentType string
+
+	// RabbitPublishChannels is the size of the channel pool publishing events
+	// RabbitMaxInFlight bounds the events waiting for their broker confirmation
+	RabbitPublishChannels int
+	RabbitMaxInFlight     int
+
+	// RabbitQueues are the queues bound to the events exchange, one per consuming team
+	RabbitQueues []RabbitQueue
+	// RabbitQueueType is classic or quorum, quorum queues must be durable
+	RabbitQueueType    string
+	RabbitQueueDurable bool
+	// RabbitPersistent publishes the events with the persistent delivery mode
+	RabbitPersistent bool
+	// RabbitDeadLetterExchange receives the rejected and expired messages, routed to RabbitDeadLetterQueue
+	RabbitDeadLetterExchange string
+	RabbitDeadLetterQueue    string
+	// RabbitMessageTTL and RabbitQueueMaxLength limit the queues, zero is unlimited
+	RabbitMessageTTL     time.Duration
+	RabbitQueueMaxLength int
+
+	// Notifiers are the sinks the outbox is relayed to: rabbitmq, webhook or log
+	Notifiers []NotifierSink
+	// WebhookTimeout bounds one webhook request, a delivery fails for good after WebhookMaxAttempts
+	// and a subscription is disabled after WebhookDisableAfter failures in a row
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookDisableAfter int
+
+	// File is the config file loaded, empty when there is none
+	File string
+	// PrintConfig asks to print the effective config and exit, it is only a flag
+	PrintConfig bool
+}
+
+// RabbitQueue is a queue and the routing keys it is bound with
+type RabbitQueue struct {
+	Name        string
+	BindingKeys []string
+}
+
+// NotifierSink is a sink of the events and what its failures do
+// A required sink failing makes the relay retry the event, a best-effort one is only logged
+type NotifierSink struct {
+	Name   string
+	Policy string
+}
+
+// setting is one key of the config, read from the file, the env and the flags
+type setting struct {
+	// path is the key in the config file, the flag is the path with dashes like --rabbit-queue-type
+	path string
+	env  string
+	// def is the default value, empty for none
+	def string
+	// secret values are redacted when printed and can be read from a file with the _FILE suffix
+	secret bool
+	usage  string
+	field  func(c *Config) value
+}
+
+// flagName is the command line flag of the setting
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.path)
+}
+
+// settings is every key of the config, in the order they are printed
+var settings = []setting{
+	{path: "grpc.port", env: keyGrpcPort, usage: "port of the gRPC server",
+		field: func(c *Config) value { return portValue{&c.GrpcPort} }},
+
+	{path: "grpc.tls_cert_file", env: keyGrpcTLSCertFile, usage: "PEM certificate of the gRPC server, plaintext without it",
+		field: func(c *Config) value { return fileValue{&c.GrpcTLS.CertFile} }},
+	{path: "grpc.tls_key_file", env: keyGrpcTLSKeyFile, usage: "PEM key of the gRPC server certificate",
+		field: func(c *Config) value { return fileValue{&c.GrpcTLS.KeyFile} }},
+	{path: "grpc.tls_client_ca_file", env: keyGrpcTLSClientCAFile, usage: "PEM CA verifying the client certificates (mutual TLS)",
+		field: func(c *Config) value { return fileValue{&c.GrpcTLS.ClientCAFile} }},
+	{path: "grpc.tls_client_auth", env: keyGrpcTLSClientAuth, def: "require", usage: "require or optional client certificates with a client CA",
+		field: func(c *Config) value { return enumValue{&c.GrpcTLS.ClientAuth, []string{"require", "optional"}} }},
+	{path: "grpc.tls_reload_interval", env: keyGrpcTLSReloadInterval, def: "10s", usage: "how often the TLS files are checked for changes",
+		field: func(c *Config) value { return durationValue{&c.GrpcTLS.ReloadInterval, 0} }},
+
+	{path: "db.host", env: keyDbHost, usage: "MongoDB host",
+		field: func(c *Config) value { return hostValue{&c.DbHost} }},
+	{path: "db.port", env: keyDbPort, usage: "MongoDB port",
+		field: func(c *Config) value { return portValue{&c.DbPort} }},
+	{path: "db.name", env: keyDbName, usage: "MongoDB database",
+		field: func(c *Config) value { return stringValue{&c.DbName} }},
+
+	{path: "db.uri", env: keyMongoURI, secret: true, usage: "MongoDB connection string, instead of the host, port and credentials",
+		field: func(c *Config) value { return uriValue{&c.MongoURI, []string{"mongodb", "mongodb+srv"}} }},
+	{path: "db.username", env: keyDbUsername, usage: "MongoDB user",
+		field: func(c *Config) value { return stringValue{&c.DbUsername} }},
+	{path: "db.password", env: keyDbPassword, secret: true, usage: "MongoDB password",
+		field: func(c *Config) value { return stringValue{&c.DbPassword} }},
+	{path: "db.auth_source", env: keyDbAuthSource, usage: "database of the MongoDB user, admin by default",
+		field: func(c *Config) value { return stringValue{&c.DbAuthSource} }},
+	{path: "db.replica_set", env: keyDbReplicaSet, usage: "MongoDB replica set, the host is then a seed",
+		field: func(c *Config) value { return stringValue{&c.DbReplicaSet} }},
+	{path: "db.tls", env: keyDbTLS, def: "false", usage: "connect to MongoDB with TLS",
+		field: func(c *Config) value { return boolValue{&c.DbTLS.Enabled} }},
+	{path: "db.tls_ca_file", env: keyDbTLSCAFile, usage: "PEM CA verifying MongoDB, the system pool by default",
+		field: func(c *Config) value { return fileValue{&c.DbTLS.CAFile} }},
+	{path: "db.tls_cert_file", env: keyDbTLSCertFile, usage: "PEM client certificate for MongoDB",
+		field: func(c *Config) value { return fileValue{&c.DbTLS.CertFile} }},
+	{path: "db.tls_key_file", env: keyDbTLSKeyFile, usage: "PEM key of the client certificate for MongoDB",
+		field: func(c *Config) value { return fileValue{&c.DbTLS.KeyFile} }},
+
+	{path: "rabbit.host", env: keyRabbitHost, usage: "RabbitMQ host",
+		field: func(c *Config) value { return hostValue{&c.RabbitHost} }},
+	{path: "rabbit.port", env: keyRabbitPort, usage: "RabbitMQ port",
+		field: func(c *Config) value { return portValue{&c.RabbitPort} }},
+	{path: "rabbit.url", env: keyAmqpURL, secret: true, usage: "RabbitMQ URL, instead of the host, port and credentials",
+		field: func(c *Config) value { return uriValue{&c.AmqpURL, []string{"amqp", "amqps"}} }},
+	{path: "rabbit.username", env: keyRabbitUsername, usage: "RabbitMQ user, guest by default",
+		field: func(c *Config) value { return stringValue{&c.RabbitUsername} }},
+	{path: "rabbit.password", env: keyRabbitPassword, secret: true, usage: "RabbitMQ password",
+		field: func(c *Config) value { return stringValue{&c.RabbitPassword} }},
+	{path: "rabbit.vhost", env: keyRabbitVhost, usage: "RabbitMQ virtual host, / by default",
+		field: func(c *Config) value { return stringValue{&c.RabbitVhost} }},
+	{path: "rabbit.tls", env: keyRabbitTLS, def: "false", usage: "connect to RabbitMQ with TLS (amqps)",
+		field: func(c *Config) value { return boolValue{&c.RabbitTLS.Enabled} }},
+	{path: "rabbit.tls_ca_file", env: keyRabbitTLSCAFile, usage: "PEM CA verifying RabbitMQ, the system pool by default",
+		field: func(c *Config) value { return fileValue{&c.RabbitTLS.CAFile} }},
+	{path: "rabbit.tls_cert_file", env: keyRabbitCertFile, usage: "PEM client certificate for RabbitMQ",
+		field: func(c *Config) value { return fileValue{&c.RabbitTLS.CertFile} }},
+	{path: "rabbit.tls_key_file", env: keyRabbitKeyFile, usage: "PEM key of the client certificate for RabbitMQ",
+		field: func(c *Config) value { return fileValue{&c.RabbitTLS.KeyFile} }},
+	{path: "rabbit.publish_channels", env: keyRabbitPublishChannels, def: "4", usage: "channels publishing the events",
+		field: func(c *Config) value { return intValue{&c.RabbitPublishChannels, 1} }},
+	{path: "rabbit.max_in_flight", env: keyRabbitMaxInFlight, def: "256", usage: "events waiting for their confirmation at most",
+		field: func(c *Config) value { return intValue{&c.RabbitMaxInFlight, 1} }},
+	{path: "rabbit.queues", env: keyRabbitQueues, def: "user:user.*", usage: "queues like billing:user.created|user.deleted,audit:user.*",
+		field: func(c *Config) value { return queuesValue{&c.RabbitQueues} }},
+	{path: "rabbit.queue_type", env: keyRabbitQueueType, def: "classic", usage: "classic or quorum",
+		field: func(c *Config) value { return enumValue{&c.RabbitQueueType, []string{"classic", "quorum"}} }},
+	{path: "rabbit.queue_durable", env: keyRabbitQueueDurable, def: "false", usage: "declare durable queues",
+		field: func(c *Config) value { return boolValue{&c.RabbitQueueDurable} }},
+	{path: "rabbit.persistent", env: keyRabbitPersistent, def: "true", usage: "publish persistent messages",
+		field: func(c *Config) value { return boolValue{&c.RabbitPersistent} }},
+	{path: "rabbit.dead_letter_exchange", env: keyRabbitDeadLetterExchange, usage: "exchange of the rejected and expired messages",
+		field: func(c *Config) value { return stringValue{&c.RabbitDeadLetterExchange} }},
+	{path: "rabbit.dead_letter_queue", env: keyRabbitDeadLetterQueue, usage: "queue of the dead letter exchange",
+		field: func(c *Config) value { return stringValue{&c.RabbitDeadLetterQueue} }},
+	{path: "rabbit.message_ttl", env: keyRabbitMessageTTL, def: "0s", usage: "expiration of the queued messages, 0 is unlimited",
+		field: func(c *Config) value { return durationValue{&c.RabbitMessageTTL, 0} }},
+	{path: "rabbit.queue_max_length", env: keyRabbitQueueMaxLength, def: "0", usage: "messages per queue at most, 0 is unlimited",
+		field: func(c *Config) value { return intValue{&c.RabbitQueueMaxLength, 0} }},
+
+	{path: "jwt.secret", env: keyJwtSecret, secret: true, usage: "secret signing the access tokens with HS256",
+		field: func(c *Config) value { return stringValue{&c.JwtSecret} }},
+	{path: "jwt.private_key_file", env: keyJwtPrivateKeyFile, usage: "PEM ed25519 key signing the access tokens with EdDSA",
+		field: func(c *Config) value { return stringValue{&c.JwtPrivateKeyFile} }},
+	{path: "jwt.access_token_ttl", env: keyAccessTokenTTL, def: "15m", usage: "lifetime of the access tokens",
+		field: func(c *Config) value { return durationValue{&c.AccessTokenTTL, time.Second} }},
+	{path: "jwt.refresh_token_ttl", env: keyRefreshTokenTTL, def: "720h", usage: "lifetime of the refresh tokens",
+		field: func(c *Config) value { return durationValue{&c.RefreshTokenTTL, time.Second} }},
+
+	{path: "users.retention", env: keyUserRetention, def: "720h", usage: "how long a deleted user can be restored",
+		field: func(c *Config) value { return durationValue{&c.UserRetention, 0} }},
+	{path: "users.purge_interval", env: keyPurgeInterval, def: "1h", usage: "interval of the purge of the deleted users",
+		field: func(c *Config) value { return durationValue{&c.PurgeInterval, time.Second} }},
+
+	{path: "events.cloudevents_mode", env: keyCloudEventsMode, def: "binary", usage: "binary or structured",
+		field: func(c *Config) value {
+			return enumValue{&c.CloudEventsMode, []string{"binary", "structured"}}
+		}},
+	{path: "events.cloudevents_source", env: keyCloudEventsSource, def: "/esl/user-service", usage: "source of the events",
+		field: func(c *Config) value { return stringValue{&c.CloudEventsSource} }},
+	{path: "events.content_type", env: keyEventsContentType, def: "application/json", usage: "application/json or application/protobuf",
+		field: func(c *Config) value {
+			return enumValue{&c.EventsContentType, []string{"application/json", "application/protobuf"}}
+		}},
+	{path: "events.notifiers", env: keyNotifiers, def: "rabbitmq", usage: "sinks like rabbitmq,webhook:best-effort,log:best-effort",
+		field: func(c *Config) value { return notifiersValue{&c.Notifiers} }},
+
+	{path: "webhook.timeout", env: keyWebhookTimeout, def: "10s", usage: "timeout of a webhook request",
+		field: func(c *Config) value { return durationValue{&c.WebhookTimeout, time.Millisecond} }},
+	{path: "webhook.max_attempts", env: keyWebhookMaxAttempts, def: "10", usage: "attempts of a delivery at most",
+		field: func(c *Config) value { return intValue{&c.WebhookMaxAttempts, 1} }},
+	{path: "webhook.disable_after", env: keyWebhookDisableAfter, def: "20", usage: "failures in a row disabling a subscription",
+		field: func(c *Config) value { return intValue{&c.WebhookDisableAfter, 1} }},
+
+	{path: "shutdown_timeout", env: keyShutdownTimeout, def: "30s", usage: "drain of the work in progress on SIGTERM",
+		field: func(c *Config) value { return durationValue{&c.ShutdownTimeout, 0} }},
+
+	{path: "metrics.port", env: keyMetricsPort, def: "9090", usage: "admin port serving the Prometheus metrics on /metrics",
+		field: func(c *Config) value { return portValue{&c.MetricsPort} }},
 }
 
-// GetConfig load either by .env file or in env directly
+// GetConfig load the config without command line flags, see Load
 func GetConfig() (Config, error) {
+	return Load(nil)
+}
+
+// Load builds the config from, by increasing precedence:
+// the defaults, the config file, the env (and the .env file) and the command line flags of args
+// The config file is given by --config or CONFIG_FILE, YAML or TOML depending on its extension
+// Every invalid or missing value is reported at once in the returned error
+func Load(args []string) (Config, error) {
 	// I did this because in docker-compose for test I couldn't load env file
 	// So I passed environment value
 	// But testing locally I provide env file with my IDE
@@ -34,37 +339,167 @@ func GetConfig() (Config, error) {
 		return Config{}, fmt.Errorf("loading .env: %w", err)
 	}
 
-	var grpcPort, dbHost, dbPort, dbName, rabbitHost, rabbitPort string
-	if grpcPort = os.Getenv(keyGrpcPort); grpcPort == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyGrpcPort))
+	var conf Config
+	flags, err := parseFlags(args, &conf)
+	if err != nil {
+		return Config{}, err
+	}
+	if conf.File == "" {
+		conf.File = os.Getenv(keyConfigFile)
+	}
+	var errs []error
+	invalid := make(map[string]bool)
+	var file map[string]string
+	if conf.File != "" {
+		if file, err = readFile(conf.File); file == nil {
+			return Config{}, err
+		} else if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	if dbHost = os.Getenv(keyDbHost); dbHost == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyDbHost))
+	for _, s := range settings {
+		raw, source, err := s.resolve(file, conf.File, flags)
+		if err == nil && raw != "" {
+			err = s.field(&conf).Set(raw)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", s.env, source, err))
+			invalid[s.env] = true
+		}
 	}
+	errs = append(errs, conf.validate(invalid)...)
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	return conf, nil
+}
 
-	if dbPort = os.Getenv(keyDbPort); dbPort == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyDbPort))
+// resolve returns the value of the setting with the highest precedence and where it comes from
+// A secret is also read from the file named by its _FILE env var or its _file key in the config file
+func (s setting) resolve(file map[string]string, fileName string, flags map[string]string) (raw, source string, err error) {
+	raw, source = s.def, "default"
+	if v, ok := file[s.path]; ok {
+		raw, source = v, fmt.Sprintf("%s in %s", s.path, fileName)
+	}
+	if path, ok := file[s.path+strings.ToLower(secretFileSuffix)]; ok && s.secret {
+		source = fmt.Sprintf("%s%s in %s", s.path, strings.ToLower(secretFileSuffix), fileName)
+		if _, both := file[s.path]; both {
+			return "", source, fmt.Errorf("%s is also set", s.path)
+		}
+		if raw, err = readSecret(path); err != nil {
+			return "", source, err
+		}
+	}
+	if v := os.Getenv(s.env); v != "" {
+		raw, source = v, "env var "+s.env
+	}
+	if path := os.Getenv(s.env + secretFileSuffix); path != "" && s.secret {
+		source = "env var " + s.env + secretFileSuffix
+		if os.Getenv(s.env) != "" {
+			return "", source, fmt.Errorf("%s is also set", s.env)
+		}
+		if raw, err = readSecret(path); err != nil {
+			return "", source, err
+		}
+	}
+	if v, ok := flags[s.path]; ok {
+		raw, source = v, "flag --"+s.flagName()
 	}
+	return raw, source, nil
+}
 
-	if dbName = os.Getenv(keyDbName); dbName == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyDbName))
+// readSecret reads a secret file, like a docker or kubernetes secret, without its trailing new line
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
 
-	if rabbitHost = os.Getenv(keyRabbitHost); rabbitHost == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyRabbitHost))
+// parseFlags parses the command line and returns the settings it gives
+func parseFlags(args []string, conf *Config) (map[string]string, error) {
+	fs := flag.NewFlagSet("api-server", flag.ContinueOnError)
+	fs.StringVar(&conf.File, "config", "", "YAML or TOML config file, "+keyConfigFile+" by default")
+	fs.BoolVar(&conf.PrintConfig, "print-config", false, "print the effective config, secrets redacted, and exit")
+	values := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		values[s.path] = fs.String(s.flagName(), "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
 	}
 
-	if rabbitPort = os.Getenv(keyRabbitPort); rabbitPort == "" {
-		return Config{}, errors.New(fmt.Sprintf("env var %s not set", keyRabbitPort))
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == f.Name {
+				set[s.path] = *values[s.path]
+			}
+		}
+	})
+	return set, nil
+}
+
+// validate checks the required keys, but the invalid ones already reported, and the rules involving several keys
+func (c *Config) validate(invalid map[string]bool) []error {
+	var errs []error
+	required := map[string]string{keyGrpcPort: c.GrpcPort, keyDbName: c.DbName}
+	if c.MongoURI == "" {
+		required[keyDbHost], required[keyDbPort] = c.DbHost, c.DbPort
+	} else {
+		errs = append(errs, exclusive(keyMongoURI, map[string]string{
+			keyDbHost: c.DbHost, keyDbPort: c.DbPort, keyDbUsername: c.DbUsername, keyDbPassword: c.DbPassword,
+			keyDbAuthSource: c.DbAuthSource, keyDbReplicaSet: c.DbReplicaSet,
+		})...)
+	}
+	if c.AmqpURL == "" {
+		required[keyRabbitHost], required[keyRabbitPort] = c.RabbitHost, c.RabbitPort
+	} else {
+		errs = append(errs, exclusive(keyAmqpURL, map[string]string{
+			keyRabbitHost: c.RabbitHost, keyRabbitPort: c.RabbitPort, keyRabbitUsername: c.RabbitUsername,
+			keyRabbitPassword: c.RabbitPassword, keyRabbitVhost: c.RabbitVhost,
+		})...)
+	}
+	for _, s := range settings {
+		if value, ok := required[s.env]; ok && value == "" && !invalid[s.env] {
+			errs = append(errs, fmt.Errorf("%s not set (env var, %s in the config file or --%s)", s.env, s.path, s.flagName()))
+		}
 	}
 
-	return Config{
-		GrpcPort:   grpcPort,
-		DbHost:     dbHost,
-		DbPort:     dbPort,
-		DbName:     dbName,
-		RabbitHost: rabbitHost,
-		RabbitPort: rabbitPort,
-	}, nil
+	if c.DbPassword != "" && c.DbUsername == "" {
+		errs = append(errs, fmt.Errorf("%s is set without %s", keyDbPassword, keyDbUsername))
+	}
+	if c.RabbitPassword != "" && c.RabbitUsername == "" {
+		errs = append(errs, fmt.Errorf("%s is set without %s", keyRabbitPassword, keyRabbitUsername))
+	}
+	errs = append(errs, c.GrpcTLS.validate()...)
+	errs = append(errs, c.DbTLS.validate(keyDbTLS, c.DbTLS.Enabled)...)
+	errs = append(errs, c.RabbitTLS.validate(keyRabbitTLS, c.RabbitTLS.Enabled || strings.HasPrefix(c.AmqpURL, "amqps:"))...)
+
+	if c.JwtSecret == "" && c.JwtPrivateKeyFile == "" {
+		errs = append(errs, fmt.Errorf("%s or %s not set", keyJwtSecret, keyJwtPrivateKeyFile))
+	}
+	if c.JwtSecret != "" && len(c.JwtSecret) < minJwtSecretLength {
+		errs = append(errs, fmt.Errorf("%s must be at least %d bytes", keyJwtSecret, minJwtSecretLength))
+	}
+	if c.RabbitQueueType == "quorum" && !c.RabbitQueueDurable {
+		errs = append(errs, fmt.Errorf("%s: quorum queues must be durable", keyRabbitQueueDurable))
+	}
+	return errs
+}
+
+// exclusive reports the keys set along with the complete URI key
+func exclusive(uriKey string, keys map[string]string) []error {
+	var errs []error
+	for _, s := range settings {
+		if value, ok := keys[s.env]; ok && value != "" {
+			errs = append(errs, fmt.Errorf("%s can't be set with %s", s.env, uriKey))
+		}
+	}
+	return errs
 }
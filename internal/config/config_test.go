@@ -1,9 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -24,15 +28,250 @@ DB_PORT=27017
 DB_NAME=testdb
 RABBIT_HOST=rabbitmq
 RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
 `,
 			shouldSucceed: true,
 			expected: Config{
-				GrpcPort: "50051",
-				DbHost:   "localhost",
-				DbPort:   "27017",
-				DbName:   "testdb",
+				GrpcPort:          "50051",
+				DbHost:            "localhost",
+				DbPort:            "27017",
+				DbName:            "testdb",
+				AccessTokenTTL:    15 * time.Minute,
+				RefreshTokenTTL:   30 * 24 * time.Hour,
+				UserRetention:     30 * 24 * time.Hour,
+				PurgeInterval:     time.Hour,
+				ShutdownTimeout:   30 * time.Second,
+				MetricsPort:       "9090",
+				CloudEventsMode:   "binary",
+				CloudEventsSource: "/esl/user-service",
+				EventsContentType: "application/json",
+
+				RabbitPublishChannels: 4,
+				RabbitMaxInFlight:     256,
+
+				RabbitQueues:       []RabbitQueue{{Name: "user", BindingKeys: []string{"user.*"}}},
+				RabbitQueueType:    "classic",
+				RabbitQueueDurable: false,
+				RabbitPersistent:   true,
+
+				Notifiers:           []NotifierSink{{Name: "rabbitmq", Policy: "required"}},
+				WebhookTimeout:      10 * time.Second,
+				WebhookMaxAttempts:  10,
+				WebhookDisableAfter: 20,
+			},
+		},
+		{
+			name: "Success - token TTLs provided",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_PRIVATE_KEY_FILE=/run/secrets/jwt.pem
+ACCESS_TOKEN_TTL=5m
+REFRESH_TOKEN_TTL=24h
+USER_RETENTION=168h
+PURGE_INTERVAL=10m
+SHUTDOWN_TIMEOUT=1m
+METRICS_PORT=9100
+CLOUDEVENTS_MODE=structured
+CLOUDEVENTS_SOURCE=/esl/users
+EVENTS_CONTENT_TYPE=application/protobuf
+RABBIT_PUBLISH_CHANNELS=8
+RABBIT_MAX_IN_FLIGHT=32
+RABBIT_QUEUES=billing:user.created|user.deleted,audit:user.*
+RABBIT_QUEUE_TYPE=quorum
+RABBIT_QUEUE_DURABLE=true
+RABBIT_PERSISTENT=false
+RABBIT_DEAD_LETTER_EXCHANGE=user.events.dlx
+RABBIT_DEAD_LETTER_QUEUE=user.dead
+RABBIT_MESSAGE_TTL=24h
+RABBIT_QUEUE_MAX_LENGTH=10000
+NOTIFIERS=webhook, rabbitmq:best-effort,log:best-effort
+WEBHOOK_TIMEOUT=3s
+WEBHOOK_MAX_ATTEMPTS=5
+WEBHOOK_DISABLE_AFTER=8
+`,
+			shouldSucceed: true,
+			expected: Config{
+				GrpcPort:          "50051",
+				DbHost:            "localhost",
+				DbPort:            "27017",
+				DbName:            "testdb",
+				AccessTokenTTL:    5 * time.Minute,
+				RefreshTokenTTL:   24 * time.Hour,
+				UserRetention:     7 * 24 * time.Hour,
+				PurgeInterval:     10 * time.Minute,
+				ShutdownTimeout:   time.Minute,
+				MetricsPort:       "9100",
+				CloudEventsMode:   "structured",
+				CloudEventsSource: "/esl/users",
+				EventsContentType: "application/protobuf",
+
+				RabbitPublishChannels: 8,
+				RabbitMaxInFlight:     32,
+
+				RabbitQueues: []RabbitQueue{
+					{Name: "billing", BindingKeys: []string{"user.created", "user.deleted"}},
+					{Name: "audit", BindingKeys: []string{"user.*"}},
+				},
+				RabbitQueueType:          "quorum",
+				RabbitQueueDurable:       true,
+				RabbitPersistent:         false,
+				RabbitDeadLetterExchange: "user.events.dlx",
+				RabbitDeadLetterQueue:    "user.dead",
+				RabbitMessageTTL:         24 * time.Hour,
+				RabbitQueueMaxLength:     10000,
+
+				Notifiers: []NotifierSink{
+					{Name: "webhook", Policy: "required"},
+					{Name: "rabbitmq", Policy: "best-effort"},
+					{Name: "log", Policy: "best-effort"},
+				},
+				WebhookTimeout:      3 * time.Second,
+				WebhookMaxAttempts:  5,
+				WebhookDisableAfter: 8,
 			},
 		},
+		{
+			name: "Failure - missing JWT_SECRET",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+`,
+			shouldSucceed: false,
+			missingKey:    "JWT_SECRET",
+		},
+		{
+			name: "Failure - short JWT_SECRET",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=change-me-in-production
+`,
+			shouldSucceed: false,
+			missingKey:    "JWT_SECRET must be at least 32 bytes",
+		},
+		{
+			name: "Failure - invalid ACCESS_TOKEN_TTL",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+ACCESS_TOKEN_TTL=forever
+`,
+			shouldSucceed: false,
+			missingKey:    "ACCESS_TOKEN_TTL",
+		},
+		{
+			name: "Failure - invalid CLOUDEVENTS_MODE",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+CLOUDEVENTS_MODE=batched
+`,
+			shouldSucceed: false,
+			missingKey:    "CLOUDEVENTS_MODE",
+		},
+		{
+			name: "Failure - invalid EVENTS_CONTENT_TYPE",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+EVENTS_CONTENT_TYPE=application/xml
+`,
+			shouldSucceed: false,
+			missingKey:    "EVENTS_CONTENT_TYPE",
+		},
+		{
+			name: "Failure - invalid RABBIT_MAX_IN_FLIGHT",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+RABBIT_MAX_IN_FLIGHT=0
+`,
+			shouldSucceed: false,
+			missingKey:    "RABBIT_MAX_IN_FLIGHT",
+		},
+		{
+			name: "Failure - invalid RABBIT_QUEUES",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+RABBIT_QUEUES=billing
+`,
+			shouldSucceed: false,
+			missingKey:    "RABBIT_QUEUES",
+		},
+		{
+			name: "Failure - non durable quorum queue",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+RABBIT_QUEUE_TYPE=quorum
+RABBIT_QUEUE_DURABLE=false
+`,
+			shouldSucceed: false,
+			missingKey:    "RABBIT_QUEUE_DURABLE",
+		},
+		{
+			name: "Failure - unknown sink in NOTIFIERS",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+NOTIFIERS=rabbitmq,smtp
+`,
+			shouldSucceed: false,
+			missingKey:    "NOTIFIERS",
+		},
+		{
+			name: "Failure - invalid policy in NOTIFIERS",
+			envContent: `GRPC_PORT=50051
+DB_HOST=localhost
+DB_PORT=27017
+DB_NAME=testdb
+RABBIT_HOST=rabbitmq
+RABBIT_PORT=5672
+JWT_SECRET=0123456789abcdef0123456789abcdef
+NOTIFIERS=rabbitmq:optional
+`,
+			shouldSucceed: false,
+			missingKey:    "NOTIFIERS",
+		},
 		{
 			name: "Failure - missing GRPC_PORT",
 			envContent: `DB_HOST=localhost
@@ -89,6 +328,29 @@ DB_PORT=27017
 				assert.Equal(t, tc.expected.DbHost, conf.DbHost, "expected DB_HOST to match")
 				assert.Equal(t, tc.expected.DbPort, conf.DbPort, "expected DB_PORT to match")
 				assert.Equal(t, tc.expected.DbName, conf.DbName, "expected DB_NAME to match")
+				assert.Equal(t, tc.expected.AccessTokenTTL, conf.AccessTokenTTL, "expected ACCESS_TOKEN_TTL to match")
+				assert.Equal(t, tc.expected.RefreshTokenTTL, conf.RefreshTokenTTL, "expected REFRESH_TOKEN_TTL to match")
+				assert.Equal(t, tc.expected.UserRetention, conf.UserRetention, "expected USER_RETENTION to match")
+				assert.Equal(t, tc.expected.PurgeInterval, conf.PurgeInterval, "expected PURGE_INTERVAL to match")
+				assert.Equal(t, tc.expected.ShutdownTimeout, conf.ShutdownTimeout, "expected SHUTDOWN_TIMEOUT to match")
+				assert.Equal(t, tc.expected.MetricsPort, conf.MetricsPort, "expected METRICS_PORT to match")
+				assert.Equal(t, tc.expected.CloudEventsMode, conf.CloudEventsMode, "expected CLOUDEVENTS_MODE to match")
+				assert.Equal(t, tc.expected.CloudEventsSource, conf.CloudEventsSource, "expected CLOUDEVENTS_SOURCE to match")
+				assert.Equal(t, tc.expected.EventsContentType, conf.EventsContentType, "expected EVENTS_CONTENT_TYPE to match")
+				assert.Equal(t, tc.expected.RabbitPublishChannels, conf.RabbitPublishChannels, "expected RABBIT_PUBLISH_CHANNELS to match")
+				assert.Equal(t, tc.expected.RabbitMaxInFlight, conf.RabbitMaxInFlight, "expected RABBIT_MAX_IN_FLIGHT to match")
+				assert.Equal(t, tc.expected.RabbitQueues, conf.RabbitQueues, "expected RABBIT_QUEUES to match")
+				assert.Equal(t, tc.expected.RabbitQueueType, conf.RabbitQueueType, "expected RABBIT_QUEUE_TYPE to match")
+				assert.Equal(t, tc.expected.RabbitQueueDurable, conf.RabbitQueueDurable, "expected RABBIT_QUEUE_DURABLE to match")
+				assert.Equal(t, tc.expected.RabbitPersistent, conf.RabbitPersistent, "expected RABBIT_PERSISTENT to match")
+				assert.Equal(t, tc.expected.RabbitDeadLetterExchange, conf.RabbitDeadLetterExchange, "expected RABBIT_DEAD_LETTER_EXCHANGE to match")
+				assert.Equal(t, tc.expected.RabbitDeadLetterQueue, conf.RabbitDeadLetterQueue, "expected RABBIT_DEAD_LETTER_QUEUE to match")
+				assert.Equal(t, tc.expected.RabbitMessageTTL, conf.RabbitMessageTTL, "expected RABBIT_MESSAGE_TTL to match")
+				assert.Equal(t, tc.expected.RabbitQueueMaxLength, conf.RabbitQueueMaxLength, "expected RABBIT_QUEUE_MAX_LENGTH to match")
+				assert.Equal(t, tc.expected.Notifiers, conf.Notifiers, "expected NOTIFIERS to match")
+				assert.Equal(t, tc.expected.WebhookTimeout, conf.WebhookTimeout, "expected WEBHOOK_TIMEOUT to match")
+				assert.Equal(t, tc.expected.WebhookMaxAttempts, conf.WebhookMaxAttempts, "expected WEBHOOK_MAX_ATTEMPTS to match")
+				assert.Equal(t, tc.expected.WebhookDisableAfter, conf.WebhookDisableAfter, "expected WEBHOOK_DISABLE_AFTER to match")
 			} else {
 				assert.Error(t, err, "expected error due to missing %s", tc.missingKey)
 				assert.Contains(t, err.Error(), tc.missingKey, "error message should contain missing key")
@@ -96,3 +358,155 @@ DB_PORT=27017
 		})
 	}
 }
+
+const yamlConfig = `grpc:
+  port: 50051
+db:
+  host: mongo
+  port: 27017
+  name: filedb
+rabbit:
+  host: rabbitmq
+  port: 5672
+  queue_type: quorum
+  queue_durable: true
+  queues:
+    - billing:user.created|user.deleted
+    - audit:user.*
+jwt:
+  secret: file-secret-of-at-least-32-bytes
+events:
+  notifiers: [rabbitmq, log:best-effort]
+shutdown_timeout: 10s
+`
+
+const tomlConfig = `shutdown_timeout = "10s"
+
+[grpc]
+port = 50051
+
+[db]
+host = "mongo"
+port = 27017
+name = "filedb"
+
+[rabbit]
+host = "rabbitmq"
+port = 5672
+queue_type = "quorum"
+queue_durable = true
+queues = ["billing:user.created|user.deleted", "audit:user.*"]
+
+[jwt]
+secret = "file-secret-of-at-least-32-bytes"
+
+[events]
+notifiers = "rabbitmq,log:best-effort"
+`
+
+// TestLoadFile test that the YAML and TOML files give the same config
+func TestLoadFile(t *testing.T) {
+	for name, content := range map[string]string{"config.yaml": yamlConfig, "config.toml": tomlConfig} {
+		t.Run(name, func(t *testing.T) {
+			os.Clearenv()
+			path := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+			conf, err := Load([]string{"--config", path})
+			require.NoError(t, err)
+			assert.Equal(t, path, conf.File)
+			assert.Equal(t, "50051", conf.GrpcPort)
+			assert.Equal(t, "mongo", conf.DbHost)
+			assert.Equal(t, "27017", conf.DbPort)
+			assert.Equal(t, "filedb", conf.DbName)
+			assert.Equal(t, "quorum", conf.RabbitQueueType)
+			assert.Equal(t, []RabbitQueue{
+				{Name: "billing", BindingKeys: []string{"user.created", "user.deleted"}},
+				{Name: "audit", BindingKeys: []string{"user.*"}},
+			}, conf.RabbitQueues)
+			assert.Equal(t, "file-secret-of-at-least-32-bytes", conf.JwtSecret)
+			assert.Equal(t, []NotifierSink{{Name: "rabbitmq", Policy: "required"}, {Name: "log", Policy: "best-effort"}}, conf.Notifiers)
+			assert.Equal(t, 10*time.Second, conf.ShutdownTimeout)
+			// the keys missing from the file keep their default
+			assert.Equal(t, 15*time.Minute, conf.AccessTokenTTL)
+			assert.True(t, conf.RabbitPersistent)
+		})
+	}
+}
+
+// TestLoadPrecedence test that the flags override the env which overrides the file which overrides the defaults
+func TestLoadPrecedence(t *testing.T) {
+	os.Clearenv()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(yamlConfig), 0644))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("DB_NAME", "envdb")
+	t.Setenv("GRPC_PORT", "6000")
+
+	conf, err := Load([]string{"--grpc-port", "7000", "--webhook-max-attempts=3"})
+	require.NoError(t, err)
+	assert.Equal(t, "7000", conf.GrpcPort, "flag over env")
+	assert.Equal(t, "envdb", conf.DbName, "env over file")
+	assert.Equal(t, "mongo", conf.DbHost, "file over default")
+	assert.Equal(t, 3, conf.WebhookMaxAttempts, "flag over default")
+	assert.Equal(t, 20, conf.WebhookDisableAfter, "default")
+}
+
+// TestLoadReportsEveryError test that all the invalid values are reported at once with their source
+func TestLoadReportsEveryError(t *testing.T) {
+	os.Clearenv()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`grpc:
+  port: 70000
+db:
+  host: "mongo db"
+  colour: blue
+rabbit:
+  queue_type: quorum
+  queue_durable: false
+`), 0644))
+	t.Setenv("RABBIT_PORT", "amqp")
+
+	_, err := Load([]string{"--config", path, "--webhook-timeout", "soon"})
+	require.Error(t, err)
+	for _, want := range []string{
+		"unknown key db.colour",
+		"GRPC_PORT (grpc.port in " + path + "): must be a port between 1 and 65535",
+		`DB_HOST (db.host in ` + path + `): "mongo db" is not a valid host name or IP`,
+		"RABBIT_PORT (env var RABBIT_PORT): must be a port",
+		"WEBHOOK_TIMEOUT (flag --webhook-timeout)",
+		"DB_NAME not set",
+		"JWT_SECRET or JWT_PRIVATE_KEY_FILE not set",
+		"RABBIT_QUEUE_DURABLE: quorum queues must be durable",
+	} {
+		assert.ErrorContains(t, err, want)
+	}
+}
+
+// TestPrint test that the effective config is printed as a loadable file with the secrets redacted
+func TestPrint(t *testing.T) {
+	os.Clearenv()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(yamlConfig), 0644))
+	conf, err := Load([]string{"--config", path, "--print-config"})
+	require.NoError(t, err)
+	assert.True(t, conf.PrintConfig)
+
+	var out bytes.Buffer
+	require.NoError(t, Print(&out, conf))
+	assert.NotContains(t, out.String(), "file-secret-of-at-least-32-bytes")
+	assert.Contains(t, out.String(), "secret: REDACTED")
+	assert.Contains(t, out.String(), "queue_type: quorum")
+
+	// the printed config loads back to the same config, but the redacted secret
+	printed := filepath.Join(t.TempDir(), "printed.yaml")
+	require.NoError(t, os.WriteFile(printed, out.Bytes(), 0644))
+	_, err = Load([]string{"--config", printed})
+	assert.ErrorContains(t, err, "JWT_SECRET must be at least 32 bytes", "the redacted secret can't sign tokens")
+	t.Setenv("JWT_SECRET", "env-secret-of-at-least-32-bytes!")
+	reloaded, err := Load([]string{"--config", printed})
+	require.NoError(t, err)
+	assert.Equal(t, "env-secret-of-at-least-32-bytes!", reloaded.JwtSecret)
+	reloaded.JwtSecret, reloaded.File, conf.JwtSecret, conf.File, conf.PrintConfig = "", "", "", "", false
+	assert.Equal(t, conf, reloaded)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// redacted replaces the secrets in the printed config
+const redacted = "REDACTED"
+
+// readFile reads a YAML or TOML config file into its settings by path like "rabbit.queue_type"
+// The unknown keys are returned in the error along with the values
+// Lists are joined with commas, so both queues: [a:x, b:y] and queues: "a:x,b:y" are accepted
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	tree := make(map[string]any)
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("config file %s: extension %q must be .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", tree, values)
+
+	var errs []error
+	for key := range values {
+		known := func(s setting) bool {
+			return s.path == key || s.secret && s.path+strings.ToLower(secretFileSuffix) == key
+		}
+		if !slices.ContainsFunc(settings, known) {
+			errs = append(errs, fmt.Errorf("config file %s: unknown key %s", path, key))
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return values, errors.Join(errs...)
+}
+
+// flatten stores the leaves of tree under their dotted path
+func flatten(prefix string, tree map[string]any, values map[string]string) {
+	for key, v := range tree {
+		path := prefix + key
+		switch v := v.(type) {
+		case nil:
+		case map[string]any:
+			flatten(path+".", v, values)
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[path] = strings.Join(items, ",")
+		default:
+			values[path] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Print writes the effective config as YAML, in the format of the config file
+// The secrets are redacted
+func Print(w io.Writer, c Config) error {
+	tree := make(map[string]any)
+	for _, s := range settings {
+		field := s.field(&c)
+		v := field.Get()
+		if r, ok := field.(interface{ Redacted() any }); ok {
+			v = r.Redacted()
+		} else if s.secret && v != "" {
+			v = redacted
+		}
+
+		node := tree
+		keys := strings.Split(s.path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := node[key].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[key] = child
+			}
+			node = child
+		}
+		node[keys[len(keys)-1]] = v
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(tree); err != nil {
+		return err
+	}
+	return enc.Close()
+}
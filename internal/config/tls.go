@@ -0,0 +1,94 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ServerTLS is the TLS of a server, mutual when ClientCAFile is set
+type ServerTLS struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies the client certificates
+	ClientCAFile string
+	// ClientAuth is require, or optional to let clients without certificate in
+	ClientAuth string
+	// ReloadInterval is how often the files are checked for changes, 0 checks on every handshake
+	ReloadInterval time.Duration
+}
+
+// Enabled tells if the server is configured for TLS
+func (t ServerTLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// validate checks the certificate comes with its key and the client CA with them
+func (t ServerTLS) validate() []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s and %s go together", keyGrpcTLSCertFile, keyGrpcTLSKeyFile))
+	}
+	if t.ClientCAFile != "" && t.CertFile == "" {
+		errs = append(errs, fmt.Errorf("%s requires %s", keyGrpcTLSClientCAFile, keyGrpcTLSCertFile))
+	}
+	return errs
+}
+
+// TLS is the client side TLS of a connection to a server
+type TLS struct {
+	Enabled bool
+	// CAFile verifies the server, the system pool is used without it
+	CAFile string
+	// CertFile and KeyFile are the client certificate, for servers requiring mutual TLS
+	CertFile string
+	KeyFile  string
+}
+
+// validate checks the files are only set with TLS on and the certificate comes with its key
+func (t TLS) validate(key string, enabled bool) []error {
+	var errs []error
+	if !enabled && (t.CAFile != "" || t.CertFile != "" || t.KeyFile != "") {
+		errs = append(errs, fmt.Errorf("%s: the TLS files are set but TLS is off", key))
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: the client certificate and its key go together", key))
+	}
+	return errs
+}
+
+// ClientConfig loads the CA and the client certificate
+func (t TLS) ClientConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pool, err := loadCertPool(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// loadCertPool reads the PEM certificates of a CA file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("CA file has no PEM certificate")
+	}
+	return pool, nil
+}
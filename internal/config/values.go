@@ -0,0 +1,245 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// value parses a setting into its Config field
+type value interface {
+	Set(raw string) error
+	// Get returns the field as printed by Print
+	Get() any
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) Set(raw string) error { *v.p = raw; return nil }
+func (v stringValue) Get() any             { return *v.p }
+
+// enumValue is one of the allowed values
+type enumValue struct {
+	p       *string
+	allowed []string
+}
+
+func (v enumValue) Set(raw string) error {
+	if !slices.Contains(v.allowed, raw) {
+		return fmt.Errorf("must be %s", strings.Join(v.allowed, " or "))
+	}
+	*v.p = raw
+	return nil
+}
+func (v enumValue) Get() any { return *v.p }
+
+// intValue is an integer of at least min
+type intValue struct {
+	p   *int
+	min int
+}
+
+func (v intValue) Set(raw string) error {
+	i, err := strconv.Atoi(raw)
+	if err != nil || i < v.min {
+		if v.min == 1 {
+			return errors.New("must be a positive integer")
+		}
+		return fmt.Errorf("must be an integer of at least %d", v.min)
+	}
+	*v.p = i
+	return nil
+}
+func (v intValue) Get() any { return *v.p }
+
+// durationValue is a duration like "15m" of at least min
+type durationValue struct {
+	p   *time.Duration
+	min time.Duration
+}
+
+func (v durationValue) Set(raw string) error {
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	if d < v.min {
+		if v.min == 0 {
+			return errors.New("can't be negative")
+		}
+		return fmt.Errorf("must be at least %s", v.min)
+	}
+	*v.p = d
+	return nil
+}
+func (v durationValue) Get() any { return v.p.String() }
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) Set(raw string) error {
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return errors.New("must be a boolean")
+	}
+	*v.p = b
+	return nil
+}
+func (v boolValue) Get() any { return *v.p }
+
+// portValue is a TCP port between 1 and 65535
+type portValue struct{ p *string }
+
+func (v portValue) Set(raw string) error {
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("must be a port between 1 and 65535")
+	}
+	*v.p = raw
+	return nil
+}
+func (v portValue) Get() any { return *v.p }
+
+// uriValue is a URL with one of the schemes, its password is redacted when printed
+type uriValue struct {
+	p       *string
+	schemes []string
+}
+
+func (v uriValue) Set(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// the parse error quotes the URI and its password
+		return errors.New("invalid URI")
+	}
+	if !slices.Contains(v.schemes, u.Scheme) || u.Host == "" {
+		return fmt.Errorf("must be a URI with a host and the scheme %s", strings.Join(v.schemes, " or "))
+	}
+	*v.p = raw
+	return nil
+}
+func (v uriValue) Get() any { return *v.p }
+
+// Redacted returns the URI without its password
+func (v uriValue) Redacted() any {
+	u, err := url.Parse(*v.p)
+	if err != nil || *v.p == "" {
+		return *v.p
+	}
+	return u.Redacted()
+}
+
+// fileValue is the path of an existing file
+type fileValue struct{ p *string }
+
+func (v fileValue) Set(raw string) error {
+	if _, err := os.Stat(raw); err != nil {
+		return err
+	}
+	*v.p = raw
+	return nil
+}
+func (v fileValue) Get() any { return *v.p }
+
+// hostValue is an IP or a host name made of letters, digits, hyphens and underscores
+// Underscores are not valid DNS names but are common for docker compose services
+type hostValue struct{ p *string }
+
+func (v hostValue) Set(raw string) error {
+	if !validHost(raw) {
+		return fmt.Errorf("%q is not a valid host name or IP", raw)
+	}
+	*v.p = raw
+	return nil
+}
+func (v hostValue) Get() any { return *v.p }
+
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queuesValue reads queues like "billing:user.created|user.deleted,audit:user.*"
+type queuesValue struct{ p *[]RabbitQueue }
+
+func (v queuesValue) Set(raw string) error {
+	var queues []RabbitQueue
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		name, keys, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || keys == "" {
+			return fmt.Errorf("%q must be name:key1|key2", entry)
+		}
+		if seen[name] {
+			return fmt.Errorf("queue %q declared twice", name)
+		}
+		seen[name] = true
+		queues = append(queues, RabbitQueue{Name: name, BindingKeys: strings.Split(keys, "|")})
+	}
+	*v.p = queues
+	return nil
+}
+
+func (v queuesValue) Get() any {
+	queues := make([]string, 0, len(*v.p))
+	for _, q := range *v.p {
+		queues = append(queues, q.Name+":"+strings.Join(q.BindingKeys, "|"))
+	}
+	return queues
+}
+
+// notifiersValue reads sinks like "rabbitmq,webhook:best-effort", the policy defaults to required
+type notifiersValue struct{ p *[]NotifierSink }
+
+func (v notifiersValue) Set(raw string) error {
+	var sinks []NotifierSink
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		name, policy, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if name != "rabbitmq" && name != "webhook" && name != "log" {
+			return fmt.Errorf("sink %q must be rabbitmq, webhook or log", name)
+		}
+		if policy == "" {
+			policy = "required"
+		}
+		if policy != "required" && policy != "best-effort" {
+			return fmt.Errorf("policy %q must be required or best-effort", policy)
+		}
+		if seen[name] {
+			return fmt.Errorf("sink %q declared twice", name)
+		}
+		seen[name] = true
+		sinks = append(sinks, NotifierSink{Name: name, Policy: policy})
+	}
+	*v.p = sinks
+	return nil
+}
+
+func (v notifiersValue) Get() any {
+	sinks := make([]string, 0, len(*v.p))
+	for _, s := range *v.p {
+		sinks = append(sinks, s.Name+":"+s.Policy)
+	}
+	return sinks
+}
@@ -0,0 +1,178 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// RefreshToken is the stored side of a refresh token
+// Only the hash of the token is kept, the token itself is given to the client once
+type RefreshToken struct {
+	ID        string     // hash of the token
+	UserID    string     `bson:"user_id"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty"`
+}
+
+// RefreshTokenRepository define the interface to store refresh tokens
+type RefreshTokenRepository interface {
+	Create(context.Context, *RefreshToken) error
+	// Revoke marks an active token as revoked and returns it
+	// ErrNotFound is returned when the token is unknown, expired or already revoked
+	Revoke(context.Context, string) (RefreshToken, error)
+	// RevokeAll revokes every active token of the user
+	RevokeAll(ctx context.Context, userID string) error
+}
+
+// Tokens is the pair of tokens given to a logged in user
+type Tokens struct {
+	AccessToken           string
+	AccessTokenExpiresAt  time.Time
+	RefreshToken          string
+	RefreshTokenExpiresAt time.Time
+}
+
+// AuthService define the interface to authenticate users
+type AuthService interface {
+	VerifyCredentials(ctx context.Context, email, password string) (*User, error)
+	Login(ctx context.Context, email, password string) (*Tokens, error)
+	Refresh(ctx context.Context, refreshToken string) (*Tokens, error)
+	Logout(ctx context.Context, refreshToken string) error
+}
+
+// authService is the concrete implementation of the AuthService interface
+type authService struct {
+	users      Repository
+	tokens     RefreshTokenRepository
+	manager    *TokenManager
+	refreshTTL time.Duration
+	logger     *slog.Logger
+}
+
+func NewAuthService(users Repository, tokens RefreshTokenRepository, manager *TokenManager, refreshTTL time.Duration) AuthService {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &authService{users: users, tokens: tokens, manager: manager, refreshTTL: refreshTTL, logger: slog.New(handler)}
+}
+
+// dummyHash is compared when the email is unknown so the response time
+// does not tell whether an account exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+
+// VerifyCredentials checks the password against the stored hash
+func (s *authService) VerifyCredentials(ctx context.Context, email, password string) (*User, error) {
+	if email == "" || password == "" {
+		return nil, ErrMissingEmailPassword
+	}
+
+	u, err := s.users.GetByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		_ = comparePassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := comparePassword([]byte(u.Password), password); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	u.Password = ""
+	return &u, nil
+}
+
+// Login verifies the credentials and issues a new pair of tokens
+func (s *authService) Login(ctx context.Context, email, password string) (*Tokens, error) {
+	u, err := s.VerifyCredentials(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("user logged in", "user_id", u.ID)
+	return s.issue(ctx, u)
+}
+
+// Refresh revokes the refresh token and issues a new pair of tokens
+// A refresh token can only be used once
+func (s *authService) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	stored, err := s.tokens.Revoke(ctx, hashToken(refreshToken))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.users.GetByID(ctx, stored.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.issue(ctx, &u)
+}
+
+// Logout revokes the refresh token, the access token expires on its own
+func (s *authService) Logout(ctx context.Context, refreshToken string) error {
+	stored, err := s.tokens.Revoke(ctx, hashToken(refreshToken))
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.Info("user logged out", "user_id", stored.UserID)
+	return nil
+}
+
+// issue signs an access token and stores a new refresh token for the user
+func (s *authService) issue(ctx context.Context, u *User) (*Tokens, error) {
+	accessToken, accessExpiresAt, err := s.manager.Issue(u)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stored := &RefreshToken{
+		ID:        hashToken(refreshToken),
+		UserID:    u.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTTL),
+	}
+	if err := s.tokens.Create(ctx, stored); err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:           accessToken,
+		AccessTokenExpiresAt:  accessExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: stored.ExpiresAt,
+	}, nil
+}
+
+// newRefreshToken returns an opaque random token
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,157 @@
+package user
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+	"time"
+)
+
+// fakeTokenRepo keeps refresh tokens in memory
+type fakeTokenRepo struct {
+	tokens map[string]*RefreshToken
+}
+
+func newFakeTokenRepo() *fakeTokenRepo {
+	return &fakeTokenRepo{tokens: map[string]*RefreshToken{}}
+}
+
+func (f *fakeTokenRepo) Create(ctx context.Context, t *RefreshToken) error {
+	f.tokens[t.ID] = t
+	return nil
+}
+
+func (f *fakeTokenRepo) Revoke(ctx context.Context, id string) (RefreshToken, error) {
+	t, ok := f.tokens[id]
+	if !ok || t.RevokedAt != nil || t.ExpiresAt.Before(time.Now()) {
+		return RefreshToken{}, ErrNotFound
+	}
+	now := time.Now()
+	t.RevokedAt = &now
+	return *t, nil
+}
+
+func (f *fakeTokenRepo) RevokeAll(ctx context.Context, userID string) error {
+	now := time.Now()
+	for _, t := range f.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func newTestAuthService(t *testing.T) (AuthService, *TokenManager) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), 10)
+	require.NoError(t, err)
+	repo := &fakeRepo{user: &User{ID: "id", Email: "x@example.com", Password: string(hash)}}
+	manager := NewHS256TokenManager([]byte("secret"), time.Minute)
+	return NewAuthService(repo, newFakeTokenRepo(), manager, time.Hour), manager
+}
+
+// TestLogin test credentials checking
+func TestLogin(t *testing.T) {
+	cases := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"success", "x@example.com", "password", nil},
+		{"wrong password", "x@example.com", "wrong", ErrInvalidCredentials},
+		{"unknown email", "y@example.com", "password", ErrInvalidCredentials},
+		{"missing password", "x@example.com", "", ErrMissingEmailPassword},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, manager := newTestAuthService(t)
+			tokens, err := svc.Login(context.Background(), tc.email, tc.password)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			claims, err := manager.Verify(tokens.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, "id", claims.Subject)
+			assert.NotEmpty(t, tokens.RefreshToken)
+		})
+	}
+}
+
+// TestRefreshAndLogout test that refresh tokens are single use and revoked on logout
+func TestRefreshAndLogout(t *testing.T) {
+	svc, _ := newTestAuthService(t)
+	ctx := context.Background()
+
+	tokens, err := svc.Login(ctx, "x@example.com", "password")
+	require.NoError(t, err)
+
+	refreshed, err := svc.Refresh(ctx, tokens.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+	_, err = svc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidToken, "a refresh token can only be used once")
+
+	require.NoError(t, svc.Logout(ctx, refreshed.RefreshToken))
+	_, err = svc.Refresh(ctx, refreshed.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidToken, "a revoked refresh token can't be used")
+}
+
+// TestPasswordChangeRevokesRefreshTokens test that changing the password logs out every session
+// while other updates keep them
+func TestPasswordChangeRevokesRefreshTokens(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), 10)
+	require.NoError(t, err)
+	repo := &fakeRepo{user: &User{ID: "id", Email: "x@example.com", Password: string(hash)}}
+	tokens := newFakeTokenRepo()
+	auth := NewAuthService(repo, tokens, NewHS256TokenManager([]byte("secret"), time.Minute), time.Hour)
+	users := NewUserService(repo, &fakeOutbox{}, tokens, fakeTx{})
+	ctx := context.Background()
+
+	first, err := auth.Login(ctx, "x@example.com", "password")
+	require.NoError(t, err)
+	second, err := auth.Login(ctx, "x@example.com", "password")
+	require.NoError(t, err)
+
+	require.NoError(t, users.UpdateUser(ctx, &User{ID: "id", Nickname: "new"}, []string{FieldNickname}))
+	first, err = auth.Refresh(ctx, first.RefreshToken)
+	require.NoError(t, err, "other updates keep the sessions")
+
+	require.NoError(t, users.UpdateUser(ctx, &User{ID: "id", Password: "newpassword"}, []string{FieldPassword}))
+	for _, session := range []*Tokens{first, second} {
+		_, err = auth.Refresh(ctx, session.RefreshToken)
+		assert.ErrorIs(t, err, ErrInvalidToken, "the refresh tokens issued before the change are revoked")
+	}
+}
+
+// TestTokenManagerVerify test that tokens from another key or expired are refused
+func TestTokenManagerVerify(t *testing.T) {
+	u := &User{ID: "id"}
+
+	token, _, err := NewHS256TokenManager([]byte("other"), time.Minute).Issue(u)
+	require.NoError(t, err)
+	_, err = NewHS256TokenManager([]byte("secret"), time.Minute).Verify(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	token, _, err = NewHS256TokenManager([]byte("secret"), -time.Minute).Issue(u)
+	require.NoError(t, err)
+	_, err = NewHS256TokenManager([]byte("secret"), time.Minute).Verify(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	manager := NewEdDSATokenManager(priv, time.Minute)
+	token, _, err = manager.Issue(u)
+	require.NoError(t, err)
+	claims, err := manager.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, u.ID, claims.Subject)
+	assert.Equal(t, pub, manager.verifyKey)
+}
@@ -0,0 +1,100 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// AllEvents subscribes to every event type of the Bus
+const AllEvents = ""
+
+// BusHandler handles an event published on the Bus, it must not modify it
+type BusHandler func(ctx context.Context, e *Event) error
+
+// Bus is an in-process publish/subscribe Notifier
+// Handlers are called synchronously in their subscription order and their errors are
+// returned to the publisher, so the relay retries the event on every handler
+// It serves the tests and the single binary deployments without broker
+type Bus struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[string][]busSubscription
+}
+
+type busSubscription struct {
+	id      int
+	handler BusHandler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]busSubscription)}
+}
+
+// Subscribe calls h for every event of the type, or every event with AllEvents
+// The returned func removes the subscription
+func (b *Bus) Subscribe(eventType string, h BusHandler) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	b.handlers[eventType] = append(b.handlers[eventType], busSubscription{id: id, handler: h})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := b.handlers[eventType]
+		for i, s := range subs {
+			if s.id == id {
+				b.handlers[eventType] = append(subs[:i:i], subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish calls the handlers of the event type then the ones of every event
+// Every handler is called even when one fails, their errors are joined
+func (b *Bus) Publish(ctx context.Context, e *Event) error {
+	b.mu.RLock()
+	subs := append(append([]busSubscription(nil), b.handlers[e.Type]...), b.handlers[AllEvents]...)
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range subs {
+		if err := s.handler(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UserCreatedEvent handle the user created event
+func (b *Bus) UserCreatedEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
+
+// UserUpdatedEvent handle the user updated event
+func (b *Bus) UserUpdatedEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
+
+// UserDeletedEvent handle the user deleted event
+func (b *Bus) UserDeletedEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
+
+// UserRolesChangedEvent handle the user roles changed event
+func (b *Bus) UserRolesChangedEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
+
+// UserRestoredEvent handle the user restored event
+func (b *Bus) UserRestoredEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
+
+// UserPurgedEvent handle the user purged event
+func (b *Bus) UserPurgedEvent(ctx context.Context, e *Event) error {
+	return b.Publish(ctx, e)
+}
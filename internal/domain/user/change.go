@@ -0,0 +1,35 @@
+package user
+
+import "slices"
+
+// Redacted replaces the values of sensitive fields in change sets
+const Redacted = "[REDACTED]"
+
+// sensitiveFields are listed in change sets without their values
+var sensitiveFields = []string{FieldPassword}
+
+// FieldChange is the old and new value of a field changed by an update
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Diff returns the updatable fields having another value in after than in before
+// Sensitive fields are listed with both values redacted
+func Diff(before, after *User) []FieldChange {
+	oldValues, newValues := before.fieldValues(), after.fieldValues()
+
+	var changes []FieldChange
+	for _, field := range updatableFields {
+		if oldValues[field] == newValues[field] {
+			continue
+		}
+		change := FieldChange{Field: field, Old: oldValues[field], New: newValues[field]}
+		if slices.Contains(sensitiveFields, field) {
+			change.Old, change.New = Redacted, Redacted
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
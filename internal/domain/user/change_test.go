@@ -0,0 +1,20 @@
+package user
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// TestDiff test that only changed fields are listed and sensitive values are redacted
+func TestDiff(t *testing.T) {
+	before := &User{FirstName: "John", Email: "john@faceit.com", Country: "FR", Password: "$2a$10$old"}
+	after := &User{FirstName: "John", Email: "john@esl.com", Country: "DE", Password: "$2a$10$new"}
+
+	assert.Equal(t, []FieldChange{
+		{Field: FieldEmail, Old: "john@faceit.com", New: "john@esl.com"},
+		{Field: FieldCountry, Old: "FR", New: "DE"},
+		{Field: FieldPassword, Old: Redacted, New: Redacted},
+	}, Diff(before, after))
+
+	assert.Empty(t, Diff(before, before))
+}
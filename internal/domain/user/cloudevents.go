@@ -0,0 +1,167 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"strings"
+	"time"
+)
+
+// ContentMode is how events are wrapped in CloudEvents 1.0
+// In binary mode the attributes are ce- headers and the body is the event
+// In structured mode the body is the whole CloudEvent as JSON
+type ContentMode string
+
+const (
+	BinaryMode     ContentMode = "binary"
+	StructuredMode ContentMode = "structured"
+)
+
+// Content types of the event in the CloudEvent
+const (
+	JSONContentType     = "application/json"
+	ProtobufContentType = "application/protobuf"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	// cloudEventTypePrefix turns the routing key user.created into com.esl.user.created
+	cloudEventTypePrefix = "com.esl."
+	cloudEventsJSONType  = "application/cloudevents+json"
+	headerSpecVersion    = "ce-specversion"
+	headerID             = "ce-id"
+	headerSource         = "ce-source"
+	headerType           = "ce-type"
+	headerSubject        = "ce-subject"
+	headerTime           = "ce-time"
+)
+
+// ErrNotCloudEvent is returned when decoding a message without CloudEvents attributes
+var ErrNotCloudEvent = errors.New("message is not a CloudEvents 1.0 event")
+
+// cloudEvent is the JSON form of a CloudEvent used in structured mode
+// Protobuf data is carried base64 encoded in data_base64
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+// CloudEventsEncoder wraps events in CloudEvents 1.0 AMQP messages
+// The CloudEvent id is the event ID and its subject the user ID
+// The event is encoded as JSON or as the protobuf message of its type, following ContentType
+type CloudEventsEncoder struct {
+	Source      string
+	Mode        ContentMode
+	ContentType string
+}
+
+// Encode returns the message publishing the event
+func (c CloudEventsEncoder) Encode(e *Event) (amqp.Publishing, error) {
+	contentType := c.ContentType
+	if contentType == "" {
+		contentType = JSONContentType
+	}
+
+	var data []byte
+	var err error
+	switch contentType {
+	case JSONContentType:
+		data, err = json.Marshal(e)
+	case ProtobufContentType:
+		data, err = e.MarshalProto()
+	default:
+		err = fmt.Errorf("unknown event content type %q", contentType)
+	}
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	msg := amqp.Publishing{
+		MessageId: e.ID,
+		Type:      e.Type,
+		Timestamp: e.OccurredAt,
+	}
+	ce := cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              e.ID,
+		Source:          c.Source,
+		Type:            cloudEventTypePrefix + e.Type,
+		Subject:         e.User.ID,
+		Time:            e.OccurredAt.UTC(),
+		DataContentType: contentType,
+	}
+
+	switch c.Mode {
+	case StructuredMode:
+		if contentType == JSONContentType {
+			ce.Data = data
+		} else {
+			ce.DataBase64 = data
+		}
+		body, err := json.Marshal(ce)
+		if err != nil {
+			return amqp.Publishing{}, err
+		}
+		msg.ContentType = cloudEventsJSONType
+		msg.Body = body
+	case BinaryMode, "":
+		msg.ContentType = contentType
+		msg.Headers = amqp.Table{
+			headerSpecVersion: ce.SpecVersion,
+			headerID:          ce.ID,
+			headerSource:      ce.Source,
+			headerType:        ce.Type,
+			headerSubject:     ce.Subject,
+			headerTime:        ce.Time.Format(time.RFC3339Nano),
+		}
+		msg.Body = data
+	default:
+		return amqp.Publishing{}, fmt.Errorf("unknown CloudEvents content mode %q", c.Mode)
+	}
+	return msg, nil
+}
+
+// DecodeCloudEvent reads the event of a message published in either content mode
+// and either content type
+func DecodeCloudEvent(d amqp.Delivery) (*Event, error) {
+	if strings.HasPrefix(d.ContentType, cloudEventsJSONType) {
+		var ce cloudEvent
+		if err := json.Unmarshal(d.Body, &ce); err != nil {
+			return nil, fmt.Errorf("decoding CloudEvent: %w", err)
+		}
+		if ce.SpecVersion != cloudEventsSpecVersion {
+			return nil, ErrNotCloudEvent
+		}
+		if ce.DataBase64 != nil {
+			return decodeData(ce.Type, ce.DataContentType, ce.DataBase64)
+		}
+		return decodeData(ce.Type, ce.DataContentType, ce.Data)
+	}
+
+	if d.Headers[headerSpecVersion] != cloudEventsSpecVersion {
+		return nil, ErrNotCloudEvent
+	}
+	ceType, _ := d.Headers[headerType].(string)
+	return decodeData(ceType, d.ContentType, d.Body)
+}
+
+// decodeData reads the event carried by a CloudEvent of the given type
+func decodeData(ceType, contentType string, data []byte) (*Event, error) {
+	switch contentType {
+	case ProtobufContentType:
+		return DecodeProtoEvent(strings.TrimPrefix(ceType, cloudEventTypePrefix), data)
+	case JSONContentType, "":
+		return DecodeEvent(data)
+	default:
+		return nil, fmt.Errorf("unknown event content type %q", contentType)
+	}
+}
@@ -0,0 +1,112 @@
+package user
+
+import (
+	"encoding/json"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// deliver turns a published message into the delivery a consumer receives
+func deliver(msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body, MessageId: msg.MessageId}
+}
+
+// TestCloudEventsBinaryMode test that attributes are ce- headers and the body is the event
+func TestCloudEventsBinaryMode(t *testing.T) {
+	event := NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "user-id", Email: "john@faceit.com"}).Event()
+	encoder := CloudEventsEncoder{Source: "/esl/user-service", Mode: BinaryMode}
+
+	msg, err := encoder.Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", msg.ContentType)
+	assert.Equal(t, "1.0", msg.Headers["ce-specversion"])
+	assert.Equal(t, event.ID, msg.Headers["ce-id"])
+	assert.Equal(t, "/esl/user-service", msg.Headers["ce-source"])
+	assert.Equal(t, "com.esl.user.created", msg.Headers["ce-type"])
+	assert.Equal(t, "user-id", msg.Headers["ce-subject"])
+	ceTime, err := time.Parse(time.RFC3339Nano, msg.Headers["ce-time"].(string))
+	require.NoError(t, err)
+	assert.True(t, event.OccurredAt.Equal(ceTime))
+	assert.NoError(t, msg.Headers.Validate(), "headers must be valid AMQP field values")
+
+	decoded, err := DecodeCloudEvent(deliver(msg))
+	require.NoError(t, err)
+	assert.Equal(t, event.ID, decoded.ID)
+	assert.Equal(t, "john@faceit.com", decoded.User.Email)
+}
+
+// TestCloudEventsStructuredMode test that the body is the whole CloudEvent
+func TestCloudEventsStructuredMode(t *testing.T) {
+	event := NewOutboxEvent(UserPurgedRoutingKey, &User{ID: "user-id"}).Event()
+	encoder := CloudEventsEncoder{Source: "/esl/user-service", Mode: StructuredMode}
+
+	msg, err := encoder.Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, "application/cloudevents+json", msg.ContentType)
+	assert.Empty(t, msg.Headers)
+
+	var ce map[string]any
+	require.NoError(t, json.Unmarshal(msg.Body, &ce))
+	assert.Equal(t, "1.0", ce["specversion"])
+	assert.Equal(t, event.ID, ce["id"])
+	assert.Equal(t, "/esl/user-service", ce["source"])
+	assert.Equal(t, "com.esl.user.purged", ce["type"])
+	assert.Equal(t, "user-id", ce["subject"])
+	assert.Equal(t, "application/json", ce["datacontenttype"])
+	assert.NotEmpty(t, ce["time"])
+	assert.NotEmpty(t, ce["data"])
+
+	decoded, err := DecodeCloudEvent(deliver(msg))
+	require.NoError(t, err)
+	assert.Equal(t, event.ID, decoded.ID)
+	assert.Equal(t, UserPurgedRoutingKey, decoded.Type)
+}
+
+// TestDecodeCloudEventRejectsBareEvents test that messages without CloudEvents attributes are refused
+func TestDecodeCloudEventRejectsBareEvents(t *testing.T) {
+	body, err := json.Marshal(NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "id"}).Event())
+	require.NoError(t, err)
+
+	_, err = DecodeCloudEvent(amqp.Delivery{ContentType: "application/json", Body: body})
+	assert.ErrorIs(t, err, ErrNotCloudEvent)
+
+	_, err = DecodeCloudEvent(amqp.Delivery{ContentType: "application/cloudevents+json", Body: []byte(`{"specversion":"0.3"}`)})
+	assert.ErrorIs(t, err, ErrNotCloudEvent)
+
+	_, err = CloudEventsEncoder{Mode: "batched"}.Encode(&Event{})
+	assert.Error(t, err)
+}
+
+// TestCloudEventsProtobuf test that protobuf events are decoded in both content modes
+func TestCloudEventsProtobuf(t *testing.T) {
+	u := secretUser()
+	deletedAt := time.Now().UTC()
+	u.DeletedAt = &deletedAt
+	event := NewOutboxEvent(UserDeletedRoutingKey, u).Event()
+
+	for _, mode := range []ContentMode{BinaryMode, StructuredMode} {
+		t.Run(string(mode), func(t *testing.T) {
+			encoder := CloudEventsEncoder{Source: "/esl/user-service", Mode: mode, ContentType: ProtobufContentType}
+			msg, err := encoder.Encode(event)
+			require.NoError(t, err)
+			assert.NotContains(t, string(msg.Body), passwordHash)
+
+			decoded, err := DecodeCloudEvent(deliver(msg))
+			require.NoError(t, err)
+			assert.Equal(t, event.ID, decoded.ID)
+			assert.Equal(t, UserDeletedRoutingKey, decoded.Type)
+			assert.True(t, event.OccurredAt.Equal(decoded.OccurredAt))
+			assert.Equal(t, u.Email, decoded.User.Email)
+			assert.Equal(t, u.Roles, decoded.User.Roles)
+			require.NotNil(t, decoded.User.DeletedAt)
+			assert.True(t, deletedAt.Equal(*decoded.User.DeletedAt))
+		})
+	}
+
+	msg, err := CloudEventsEncoder{Mode: BinaryMode, ContentType: ProtobufContentType}.Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, "application/protobuf", msg.ContentType)
+}
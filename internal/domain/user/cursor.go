@@ -0,0 +1,114 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is used when the caller doesn't ask for a page size
+	DefaultPageSize = 20
+	// MaxPageSize caps the page size asked by callers
+	MaxPageSize = 100
+)
+
+// Fields users can be sorted by, they match the bson field names
+// Ties are broken by ID so the order is total
+const (
+	SortCreatedAt = "created_at"
+	SortUpdatedAt = "updated_at"
+	SortLastName  = FieldLastName
+	SortNickname  = FieldNickname
+)
+
+var sortFields = []string{SortCreatedAt, SortUpdatedAt, SortLastName, SortNickname}
+
+// ParseOrderBy reads an order like "nickname" or "created_at desc"
+// An empty order is the creation order
+func ParseOrderBy(orderBy string) (field string, desc bool, err error) {
+	parts := strings.Fields(orderBy)
+	switch {
+	case len(parts) == 0:
+		return SortCreatedAt, false, nil
+	case len(parts) == 2 && parts[1] == "desc":
+		desc = true
+	case len(parts) == 2 && parts[1] == "asc":
+	case len(parts) != 1:
+		return "", false, ErrInvalidOrderBy
+	}
+	for _, f := range sortFields {
+		if parts[0] == f {
+			return f, desc, nil
+		}
+	}
+	return "", false, ErrInvalidOrderBy
+}
+
+// Cursor is the position of the last user of a page in the listing order
+// Listings are ordered by the sort field then ID, which is stable even when
+// users are created while paging
+// The sort is part of the cursor so a token can't resume another listing
+type Cursor struct {
+	SortBy string `json:"s,omitempty"`
+	Desc   bool   `json:"d,omitempty"`
+	// Time or Text holds the sort field value, depending on its type
+	Time time.Time `json:"c"`
+	Text string    `json:"t,omitempty"`
+	ID   string    `json:"i"`
+}
+
+// Value returns the sort field value of the cursor
+func (c *Cursor) Value() any {
+	switch c.sortBy() {
+	case SortLastName, SortNickname:
+		return c.Text
+	default:
+		return c.Time
+	}
+}
+
+// sortBy defaults to the creation order, which tokens issued before sorting omit
+func (c *Cursor) sortBy() string {
+	if c.SortBy == "" {
+		return SortCreatedAt
+	}
+	return c.SortBy
+}
+
+// EncodeCursor returns the opaque page token resuming the listing after u
+func EncodeCursor(u *User, sortBy string, desc bool) string {
+	c := Cursor{SortBy: sortBy, Desc: desc, ID: u.ID}
+	switch sortBy {
+	case SortUpdatedAt:
+		c.Time = u.UpdatedAt
+	case SortLastName:
+		c.Text = u.LastName
+	case SortNickname:
+		c.Text = u.Nickname
+	default:
+		c.SortBy = ""
+		c.Time = u.CreatedAt
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor reads a page token returned by EncodeCursor
+// for a listing sorted by sortBy
+func DecodeCursor(token, sortBy string, desc bool) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidPageToken
+	}
+	if c.sortBy() != sortBy || c.Desc != desc {
+		return nil, ErrInvalidPageToken
+	}
+	c.SortBy = sortBy
+	return &c, nil
+}
@@ -0,0 +1,49 @@
+package user
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// TestParseOrderBy test the accepted orders
+func TestParseOrderBy(t *testing.T) {
+	cases := []struct {
+		orderBy   string
+		wantField string
+		wantDesc  bool
+		wantErr   error
+	}{
+		{"", SortCreatedAt, false, nil},
+		{"nickname", SortNickname, false, nil},
+		{"updated_at desc", SortUpdatedAt, true, nil},
+		{" last_name  asc ", SortLastName, false, nil},
+		{"email", "", false, ErrInvalidOrderBy},
+		{"created_at down", "", false, ErrInvalidOrderBy},
+		{"created_at desc nickname", "", false, ErrInvalidOrderBy},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			field, desc, err := ParseOrderBy(tc.orderBy)
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantField, field)
+			assert.Equal(t, tc.wantDesc, desc)
+		})
+	}
+}
+
+// TestCursorValue test that the cursor resumes on the value of the sort field
+func TestCursorValue(t *testing.T) {
+	u := &User{ID: "id", LastName: "Doe", Nickname: "ace"}
+
+	c, err := DecodeCursor(EncodeCursor(u, SortLastName, false), SortLastName, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "Doe", c.Value())
+
+	c, err = DecodeCursor(EncodeCursor(u, SortNickname, true), SortNickname, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "ace", c.Value())
+
+	_, err = DecodeCursor(EncodeCursor(u, SortNickname, true), SortNickname, false)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+}
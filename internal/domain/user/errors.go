@@ -0,0 +1,66 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error categories of the domain
+// Transport layers match on those with errors.Is to pick the right status
+// without having to know every specific error
+var (
+	ErrNotFound           = errors.New("user not found")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrFailedPrecondition = errors.New("failed precondition")
+	ErrUnauthenticated    = errors.New("unauthenticated")
+	ErrConflict           = errors.New("conflict")
+	ErrUnavailable        = errors.New("unavailable")
+)
+
+var (
+	ErrMissingEmailPassword = newError(ErrInvalidArgument, "email and password are required")
+	ErrMissingName          = newError(ErrInvalidArgument, "first_name and last_name are required")
+	ErrEmailExists          = newError(ErrAlreadyExists, "email already exists")
+	ErrUnknownField         = newError(ErrInvalidArgument, "unknown field in update mask")
+	ErrUnknownRole          = newError(ErrInvalidArgument, "unknown role")
+	ErrInvalidPageToken     = newError(ErrInvalidArgument, "invalid page token")
+	ErrInvalidOrderBy       = newError(ErrInvalidArgument, "invalid order_by, expected a sort field optionally followed by asc or desc")
+	ErrInvalidCredentials   = newError(ErrUnauthenticated, "invalid email or password")
+	ErrInvalidToken         = newError(ErrUnauthenticated, "invalid or expired token")
+	ErrNotDeleted           = newError(ErrFailedPrecondition, "user is not deleted")
+	ErrShuttingDown         = newError(ErrUnavailable, "service is shutting down")
+
+	ErrSubscriptionNotFound    = newError(ErrNotFound, "subscription not found")
+	ErrInvalidWebhookURL       = newError(ErrInvalidArgument, "url must be an absolute http or https url")
+	ErrUnknownEventType        = newError(ErrInvalidArgument, "unknown event type")
+	ErrInvalidWebhookSignature = newError(ErrUnauthenticated, "invalid webhook signature")
+	ErrExpiredWebhookSignature = newError(ErrUnauthenticated, "webhook timestamp out of tolerance")
+)
+
+// domainError is a specific error belonging to one of the categories above
+// It keeps its own message but unwraps to its category
+type domainError struct {
+	kind error
+	msg  string
+}
+
+func newError(kind error, msg string) error {
+	return &domainError{kind: kind, msg: msg}
+}
+
+func (e *domainError) Error() string { return e.msg }
+
+func (e *domainError) Unwrap() error { return e.kind }
+
+// VersionConflictError is returned when a write expected another version of the user
+// Clients should read the user again and retry with the current version
+type VersionConflictError struct {
+	Current int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("user was modified concurrently, current version is %d", e.Current)
+}
+
+func (e *VersionConflictError) Unwrap() error { return ErrConflict }
@@ -0,0 +1,74 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EventSchemaVersion is the version of the Event payload
+// It is bumped on breaking changes so consumers can reject what they don't understand
+const EventSchemaVersion = 1
+
+// ErrUnsupportedEvent is returned by DecodeEvent for payloads of another schema version
+var ErrUnsupportedEvent = errors.New("unsupported event schema version")
+
+// Event is the payload published for every change of a user
+// Type is the routing key and ID is stable across retries so consumers can deduplicate
+// User is the state after the change, or the last known state for deletions
+// Changes lists the fields changed by an update with their old and new values
+type Event struct {
+	ID            string        `json:"id"`
+	Type          string        `json:"type"`
+	OccurredAt    time.Time     `json:"occurred_at"`
+	SchemaVersion int           `json:"schema_version"`
+	User          UserSnapshot  `json:"user"`
+	Changes       []FieldChange `json:"changes,omitempty"`
+}
+
+// UserSnapshot is the state of a user carried by events
+// It never holds secrets: the password hash has no field here
+type UserSnapshot struct {
+	ID        string     `json:"id"`
+	FirstName string     `json:"first_name" bson:"first_name"`
+	LastName  string     `json:"last_name" bson:"last_name"`
+	Nickname  string     `json:"nickname"`
+	Email     string     `json:"email"`
+	Country   string     `json:"country"`
+	Roles     []string   `json:"roles" bson:",omitempty"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" bson:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+}
+
+// NewUserSnapshot copies the public fields of u
+func NewUserSnapshot(u *User) UserSnapshot {
+	return UserSnapshot{
+		ID:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		Email:     u.Email,
+		Country:   u.Country,
+		Roles:     u.Roles,
+		Version:   u.Version,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		DeletedAt: u.DeletedAt,
+	}
+}
+
+// DecodeEvent reads an event published by the Notifier
+// Consumers use it rather than decoding the payload themselves
+func DecodeEvent(body []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	if e.SchemaVersion != EventSchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedEvent, e.SchemaVersion)
+	}
+	return &e, nil
+}
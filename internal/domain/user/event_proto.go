@@ -0,0 +1,151 @@
+package user
+
+import (
+	"fmt"
+	"github.com/dylan-dinh/esl-test/internal/domain/user/eventpb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// protoEvent is implemented by every generated event message
+type protoEvent interface {
+	proto.Message
+	GetId() string
+	GetOccurredAt() *timestamppb.Timestamp
+	GetSchemaVersion() int32
+	GetUser() *eventpb.UserSnapshot
+}
+
+// newProtoEvent returns the empty message of the event type
+func newProtoEvent(eventType string) (protoEvent, error) {
+	switch eventType {
+	case UserCreatedRoutingKey:
+		return &eventpb.UserCreated{}, nil
+	case UserUpdatedRoutingKey:
+		return &eventpb.UserUpdated{}, nil
+	case UserDeletedRoutingKey:
+		return &eventpb.UserDeleted{}, nil
+	case UserRolesChangedRoutingKey:
+		return &eventpb.UserRolesChanged{}, nil
+	case UserRestoredRoutingKey:
+		return &eventpb.UserRestored{}, nil
+	case UserPurgedRoutingKey:
+		return &eventpb.UserPurged{}, nil
+	default:
+		return nil, fmt.Errorf("unknown event type %q", eventType)
+	}
+}
+
+// MarshalProto encodes the event as the protobuf message of its type
+func (e *Event) MarshalProto() ([]byte, error) {
+	id, at, v, u := e.ID, timestamppb.New(e.OccurredAt), int32(e.SchemaVersion), snapshotToProto(&e.User)
+
+	var msg proto.Message
+	switch e.Type {
+	case UserCreatedRoutingKey:
+		msg = &eventpb.UserCreated{Id: id, OccurredAt: at, SchemaVersion: v, User: u}
+	case UserUpdatedRoutingKey:
+		msg = &eventpb.UserUpdated{Id: id, OccurredAt: at, SchemaVersion: v, User: u, Changes: changesToProto(e.Changes)}
+	case UserDeletedRoutingKey:
+		msg = &eventpb.UserDeleted{Id: id, OccurredAt: at, SchemaVersion: v, User: u}
+	case UserRolesChangedRoutingKey:
+		msg = &eventpb.UserRolesChanged{Id: id, OccurredAt: at, SchemaVersion: v, User: u}
+	case UserRestoredRoutingKey:
+		msg = &eventpb.UserRestored{Id: id, OccurredAt: at, SchemaVersion: v, User: u}
+	case UserPurgedRoutingKey:
+		msg = &eventpb.UserPurged{Id: id, OccurredAt: at, SchemaVersion: v, User: u}
+	default:
+		return nil, fmt.Errorf("unknown event type %q", e.Type)
+	}
+	return proto.Marshal(msg)
+}
+
+// DecodeProtoEvent reads an event of the given type encoded by MarshalProto
+func DecodeProtoEvent(eventType string, data []byte) (*Event, error) {
+	msg, err := newProtoEvent(eventType)
+	if err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	if msg.GetSchemaVersion() != EventSchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedEvent, msg.GetSchemaVersion())
+	}
+
+	event := &Event{
+		ID:            msg.GetId(),
+		Type:          eventType,
+		OccurredAt:    protoTime(msg.GetOccurredAt()),
+		SchemaVersion: int(msg.GetSchemaVersion()),
+		User:          snapshotFromProto(msg.GetUser()),
+	}
+	if updated, ok := msg.(*eventpb.UserUpdated); ok {
+		event.Changes = changesFromProto(updated.GetChanges())
+	}
+	return event, nil
+}
+
+func changesToProto(changes []FieldChange) []*eventpb.FieldChange {
+	var pb []*eventpb.FieldChange
+	for _, c := range changes {
+		pb = append(pb, &eventpb.FieldChange{Field: c.Field, OldValue: c.Old, NewValue: c.New})
+	}
+	return pb
+}
+
+func changesFromProto(pb []*eventpb.FieldChange) []FieldChange {
+	var changes []FieldChange
+	for _, c := range pb {
+		changes = append(changes, FieldChange{Field: c.GetField(), Old: c.GetOldValue(), New: c.GetNewValue()})
+	}
+	return changes
+}
+
+func snapshotToProto(u *UserSnapshot) *eventpb.UserSnapshot {
+	pb := &eventpb.UserSnapshot{
+		Id:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		Email:     u.Email,
+		Country:   u.Country,
+		Roles:     u.Roles,
+		Version:   u.Version,
+		CreatedAt: timestamppb.New(u.CreatedAt),
+		UpdatedAt: timestamppb.New(u.UpdatedAt),
+	}
+	if u.DeletedAt != nil {
+		pb.DeletedAt = timestamppb.New(*u.DeletedAt)
+	}
+	return pb
+}
+
+func snapshotFromProto(pb *eventpb.UserSnapshot) UserSnapshot {
+	u := UserSnapshot{
+		ID:        pb.GetId(),
+		FirstName: pb.GetFirstName(),
+		LastName:  pb.GetLastName(),
+		Nickname:  pb.GetNickname(),
+		Email:     pb.GetEmail(),
+		Country:   pb.GetCountry(),
+		Roles:     pb.GetRoles(),
+		Version:   pb.GetVersion(),
+		CreatedAt: protoTime(pb.GetCreatedAt()),
+		UpdatedAt: protoTime(pb.GetUpdatedAt()),
+	}
+	if pb.GetDeletedAt() != nil {
+		deletedAt := pb.GetDeletedAt().AsTime()
+		u.DeletedAt = &deletedAt
+	}
+	return u
+}
+
+// protoTime reads an unset timestamp as the zero time, Timestamp.AsTime gives the unix epoch
+func protoTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
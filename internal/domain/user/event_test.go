@@ -0,0 +1,131 @@
+package user
+
+import (
+	"encoding/json"
+	"github.com/dylan-dinh/esl-test/internal/domain/user/eventpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const passwordHash = "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+
+// secretUser returns a user holding a password hash
+func secretUser() *User {
+	return &User{
+		ID:        "id",
+		FirstName: "John",
+		LastName:  "Doe",
+		Email:     "john@faceit.com",
+		Password:  passwordHash,
+		Roles:     []string{RoleAdmin},
+		Version:   2,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+// TestEventHasNoSecrets test that neither the published payload nor the outbox
+// document contain the password hash
+func TestEventHasNoSecrets(t *testing.T) {
+	before := secretUser()
+	before.Password = "$2a$10$previousHashOfTheUserPassword"
+	outboxEvent := NewOutboxEvent(UserUpdatedRoutingKey, secretUser())
+	outboxEvent.Changes = Diff(before, secretUser())
+	require.Len(t, outboxEvent.Changes, 1)
+
+	body, err := json.Marshal(outboxEvent.Event())
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), passwordHash)
+	assert.NotContains(t, string(body), before.Password)
+	assert.Contains(t, string(body), Redacted)
+
+	doc, err := bson.Marshal(outboxEvent)
+	require.NoError(t, err)
+	assert.NotContains(t, string(doc), passwordHash)
+	assert.NotContains(t, string(doc), before.Password)
+}
+
+// TestUserSnapshotFields test the fields carried by events
+// Adding a field to the snapshot is a decision: it must be added here, and never be a secret
+func TestUserSnapshotFields(t *testing.T) {
+	want := []string{
+		"id", "first_name", "last_name", "nickname", "email", "country",
+		"roles", "version", "created_at", "updated_at", "deleted_at",
+	}
+
+	var got []string
+	typ := reflect.TypeOf(UserSnapshot{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		got = append(got, name)
+		for _, secret := range []string{"password", "hash", "token", "secret"} {
+			assert.NotContains(t, strings.ToLower(typ.Field(i).Name), secret)
+		}
+	}
+	assert.Equal(t, want, got)
+}
+
+// TestDecodeEvent test that consumers read back what is published
+// and reject the schema versions they don't know
+func TestDecodeEvent(t *testing.T) {
+	event := NewOutboxEvent(UserCreatedRoutingKey, secretUser()).Event()
+	body, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	decoded, err := DecodeEvent(body)
+	require.NoError(t, err)
+	assert.Equal(t, event.ID, decoded.ID)
+	assert.Equal(t, UserCreatedRoutingKey, decoded.Type)
+	assert.Equal(t, EventSchemaVersion, decoded.SchemaVersion)
+	assert.Equal(t, "john@faceit.com", decoded.User.Email)
+	assert.Equal(t, []string{RoleAdmin}, decoded.User.Roles)
+
+	_, err = DecodeEvent([]byte(`{"id":"id","schema_version":2}`))
+	assert.ErrorIs(t, err, ErrUnsupportedEvent)
+
+	_, err = DecodeEvent([]byte(`"id"`))
+	assert.Error(t, err)
+}
+
+// TestProtoEvent test that every event type has a protobuf message
+// and that the protobuf snapshot has no secret field either
+func TestProtoEvent(t *testing.T) {
+	keys := []string{
+		UserCreatedRoutingKey, UserUpdatedRoutingKey, UserDeletedRoutingKey,
+		UserRolesChangedRoutingKey, UserRestoredRoutingKey, UserPurgedRoutingKey,
+	}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			outboxEvent := NewOutboxEvent(key, secretUser())
+			outboxEvent.Changes = []FieldChange{{Field: FieldPassword, Old: Redacted, New: Redacted}}
+			event := outboxEvent.Event()
+			data, err := event.MarshalProto()
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), passwordHash)
+
+			decoded, err := DecodeProtoEvent(key, data)
+			require.NoError(t, err)
+			assert.Equal(t, event.ID, decoded.ID)
+			assert.Equal(t, event.User.ID, decoded.User.ID)
+			assert.True(t, event.User.UpdatedAt.Equal(decoded.User.UpdatedAt))
+			if key == UserUpdatedRoutingKey {
+				assert.Equal(t, event.Changes, decoded.Changes)
+			}
+		})
+	}
+
+	fields := (&eventpb.UserSnapshot{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		for _, secret := range []string{"password", "hash", "token", "secret"} {
+			assert.NotContains(t, string(fields.Get(i).Name()), secret)
+		}
+	}
+
+	_, err := DecodeProtoEvent("user.unknown", nil)
+	assert.Error(t, err)
+}
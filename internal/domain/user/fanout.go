@@ -0,0 +1,106 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// SinkPolicy is what a failing sink does to the fan-out
+type SinkPolicy string
+
+const (
+	// Required sinks fail the event, the relay retries it on every sink
+	Required SinkPolicy = "required"
+	// BestEffort sinks are logged when failing and the event is confirmed anyway
+	BestEffort SinkPolicy = "best-effort"
+)
+
+// Sink is one destination of the events
+type Sink struct {
+	Name     string
+	Notifier Notifier
+	Policy   SinkPolicy
+}
+
+// FanOut is the Notifier sending each event to several sinks in parallel
+// It fails when a required sink fails, so events are delivered at least once to each
+// required sink, and more than once when another required sink failed
+type FanOut struct {
+	sinks  []Sink
+	logger *slog.Logger
+}
+
+func NewFanOut(sinks ...Sink) *FanOut {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &FanOut{sinks: sinks, logger: slog.New(handler)}
+}
+
+// notify dispatches the event to every sink and joins the errors of the required ones
+// A sink failure is always retried: it never makes the relay park an event the other sinks must receive
+func (f *FanOut) notify(ctx context.Context, e *Event) error {
+	errs := make([]error, len(f.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range f.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Dispatch(ctx, sink.Notifier, e)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrUnpublishable):
+				// keep the message only, the event stays pending for every sink
+				errs[i] = fmt.Errorf("sink %s: %v", sink.Name, err)
+			default:
+				errs[i] = fmt.Errorf("sink %s: %w", sink.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var required []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if f.sinks[i].Policy == BestEffort {
+			f.logger.Warn("best effort sink failed", "sink", f.sinks[i].Name, "event_id", e.ID, "error", err)
+			continue
+		}
+		required = append(required, err)
+	}
+	return errors.Join(required...)
+}
+
+// UserCreatedEvent handle the user created event
+func (f *FanOut) UserCreatedEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
+
+// UserUpdatedEvent handle the user updated event
+func (f *FanOut) UserUpdatedEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
+
+// UserDeletedEvent handle the user deleted event
+func (f *FanOut) UserDeletedEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
+
+// UserRolesChangedEvent handle the user roles changed event
+func (f *FanOut) UserRolesChangedEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
+
+// UserRestoredEvent handle the user restored event
+func (f *FanOut) UserRestoredEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
+
+// UserPurgedEvent handle the user purged event
+func (f *FanOut) UserPurgedEvent(ctx context.Context, e *Event) error {
+	return f.notify(ctx, e)
+}
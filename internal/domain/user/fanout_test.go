@@ -0,0 +1,91 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOut(t *testing.T) {
+	ctx := context.Background()
+	e := NewOutboxEvent(UserRestoredRoutingKey, &User{ID: "u1"}).Event()
+
+	t.Run("every sink receives the event", func(t *testing.T) {
+		broker, webhooks := &fakeNotifier{}, &fakeNotifier{}
+		fanOut := NewFanOut(Sink{Name: "rabbitmq", Notifier: broker, Policy: Required},
+			Sink{Name: "webhook", Notifier: webhooks, Policy: BestEffort})
+
+		require.NoError(t, Dispatch(ctx, fanOut, e))
+		assert.Equal(t, []string{UserRestoredRoutingKey}, broker.published)
+		assert.Equal(t, []string{UserRestoredRoutingKey}, webhooks.published)
+	})
+
+	t.Run("best effort failures are ignored", func(t *testing.T) {
+		broker := &fakeNotifier{}
+		fanOut := NewFanOut(Sink{Name: "rabbitmq", Notifier: broker, Policy: Required},
+			Sink{Name: "audit", Notifier: &fakeNotifier{err: errors.New("disk full")}, Policy: BestEffort})
+
+		require.NoError(t, fanOut.UserRestoredEvent(ctx, e))
+		assert.Len(t, broker.published, 1)
+	})
+
+	t.Run("required failures fail the event", func(t *testing.T) {
+		down := errors.New("broker down")
+		webhooks := &fakeNotifier{}
+		fanOut := NewFanOut(Sink{Name: "rabbitmq", Notifier: &fakeNotifier{err: down}, Policy: Required},
+			Sink{Name: "webhook", Notifier: webhooks, Policy: Required})
+
+		err := fanOut.UserRestoredEvent(ctx, e)
+		assert.ErrorIs(t, err, down)
+		assert.Contains(t, err.Error(), "sink rabbitmq")
+		assert.Len(t, webhooks.published, 1, "the other sinks still receive it")
+	})
+
+	t.Run("a sink can't park the event", func(t *testing.T) {
+		broker := &fakeNotifier{}
+		webhooks := &fakeNotifier{err: fmt.Errorf("%w: encoding event", ErrUnpublishable)}
+		fanOut := NewFanOut(Sink{Name: "rabbitmq", Notifier: broker, Policy: Required},
+			Sink{Name: "webhook", Notifier: webhooks, Policy: Required})
+
+		outbox := &fakeOutbox{}
+		require.NoError(t, outbox.Add(ctx, NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "u1"})))
+		_, err := NewRelay(outbox, fanOut).PublishPending(ctx)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrUnpublishable)
+		assert.Contains(t, err.Error(), "sink webhook")
+		assert.Empty(t, outbox.parked, "the event stays pending for every sink")
+	})
+}
+
+func TestBus(t *testing.T) {
+	ctx := context.Background()
+	bus := NewBus()
+
+	var created, all []string
+	bus.Subscribe(UserCreatedRoutingKey, func(_ context.Context, e *Event) error {
+		created = append(created, e.ID)
+		return nil
+	})
+	unsubscribe := bus.Subscribe(AllEvents, func(_ context.Context, e *Event) error {
+		all = append(all, e.Type)
+		return nil
+	})
+
+	first := NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "u1"}).Event()
+	require.NoError(t, Dispatch(ctx, bus, first))
+	require.NoError(t, Dispatch(ctx, bus, NewOutboxEvent(UserDeletedRoutingKey, &User{ID: "u1"}).Event()))
+	assert.Equal(t, []string{first.ID}, created)
+	assert.Equal(t, []string{UserCreatedRoutingKey, UserDeletedRoutingKey}, all)
+
+	unsubscribe()
+	failing := errors.New("cache unavailable")
+	bus.Subscribe(AllEvents, func(context.Context, *Event) error { return failing })
+	err := bus.UserCreatedEvent(ctx, NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "u2"}).Event())
+	assert.ErrorIs(t, err, failing)
+	assert.Len(t, created, 2, "handlers are called even when another fails")
+	assert.Len(t, all, 2, "unsubscribed handlers are not called")
+}
@@ -0,0 +1,36 @@
+package user
+
+import (
+	"context"
+	"slices"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID string
+	Email  string
+	Roles  []string
+}
+
+// HasRole tells if the caller was granted the role
+func (i *Identity) HasRole(role string) bool {
+	return slices.Contains(i.Roles, role)
+}
+
+// Can tells if the roles of the caller allow the permission
+func (i *Identity) Can(p Permission) bool {
+	return HasPermission(i.Roles, p)
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying the caller identity
+func ContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the caller identity, if the request was authenticated
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight counts the operations in progress so a shutdown can wait for them
+// Once closed it refuses new operations
+type inflight struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	idle   chan struct{}
+}
+
+// start registers an operation, false once closed
+func (w *inflight) start() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// done ends an operation registered by start
+func (w *inflight) done() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.n--
+	if w.closed && w.n == 0 {
+		close(w.idle)
+	}
+}
+
+// drain refuses new operations and waits for the ones in progress until ctx is done
+// It returns how many were still in progress when ctx ended
+func (w *inflight) drain(ctx context.Context) (int, error) {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		w.idle = make(chan struct{})
+		if w.n == 0 {
+			close(w.idle)
+		}
+	}
+	idle := w.idle
+	w.mu.Unlock()
+
+	select {
+	case <-idle:
+		return 0, nil
+	case <-ctx.Done():
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.n, ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package user
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// passwordCost is the bcrypt cost of the stored passwords
+const passwordCost = 10
+
+var (
+	passwordSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_password_bcrypt_seconds",
+		Help:    "Time bcrypt took to hash or compare a password",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 8),
+	}, []string{"operation"})
+
+	messagesPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_messages_published_total",
+		Help: "Messages sent to the broker",
+	}, []string{"routing_key"})
+	messagesConfirmed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_messages_confirmed_total",
+		Help: "Messages the broker confirmed",
+	}, []string{"routing_key"})
+	messagesNacked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_messages_nacked_total",
+		Help: "Messages the broker refused",
+	}, []string{"routing_key"})
+	outstandingConfirms = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_outstanding_confirms",
+		Help: "Messages sent and waiting for their confirmation",
+	})
+)
+
+// Collectors are the metrics of the package, registered by the metrics server
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{passwordSeconds, messagesPublished, messagesConfirmed, messagesNacked, outstandingConfirms}
+}
+
+// hashPassword hashes the password with bcrypt and records how long it took
+func hashPassword(password string) (string, error) {
+	defer observePassword("hash", time.Now())
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), err
+}
+
+// comparePassword checks the password against its hash and records how long it took
+func comparePassword(hash []byte, password string) error {
+	defer observePassword("compare", time.Now())
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+func observePassword(operation string, start time.Time) {
+	passwordSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
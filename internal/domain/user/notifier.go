@@ -2,115 +2,196 @@ package user
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log/slog"
 	"os"
-	"time"
+	"sync"
 )
 
 const (
-	exchangeName          = "user.events"
-	UserCreatedRoutingKey = "user.created"
-	UserUpdatedRoutingKey = "user.updated"
-	UserDeletedRoutingKey = "user.deleted"
-	queueName             = "user"
+	exchangeName               = "user.events"
+	UserCreatedRoutingKey      = "user.created"
+	UserUpdatedRoutingKey      = "user.updated"
+	UserDeletedRoutingKey      = "user.deleted"
+	UserRolesChangedRoutingKey = "user.roles_changed"
+	UserRestoredRoutingKey     = "user.restored"
+	UserPurgedRoutingKey       = "user.purged"
+	queueName                  = "user"
 )
 
+// RabbitMQOptions tunes the RabbitMQ notifier, zero values use the defaults
+type RabbitMQOptions struct {
+	// Encoder wraps the events in CloudEvents
+	Encoder CloudEventsEncoder
+	// Channels is the number of channels publishing in parallel
+	Channels int
+	// MaxInFlight is the number of messages waiting for their confirmation at most
+	MaxInFlight int
+	// Topology is the queues declared on the exchange, the user queue bound on user.* by default
+	Topology Topology
+}
+
+// RabbitMQ publishes the user events
+// Ch declares the topology and is never used to publish, the publisher has its own channels
+// Both are replaced by Setup when the connection is recovered
 type RabbitMQ struct {
-	logger   *slog.Logger
-	Ch       *amqp.Channel
-	queue    amqp.Queue
-	confirms chan amqp.Confirmation
+	logger      *slog.Logger
+	encoder     CloudEventsEncoder
+	channels    int
+	maxInFlight int
+	topology    Topology
+
+	mu        sync.RWMutex
+	Ch        *amqp.Channel
+	publisher *publisher
 }
 
-// NewRabbitMQ takes the Rabbit connection, create one exchange and one queue
-// Wildcard on user.* to match user create, update and delete
-// Use of Confirm to ensure all message are received
-func NewRabbitMQ(conn *amqp.Connection) (*RabbitMQ, error) {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+// NewRabbitMQ takes the Rabbit connection, create the exchange and the queues of the topology
+// By default one queue with a wildcard on user.* to match user create, update and delete
+// Events are published as CloudEvents on a pool of channels in confirm mode
+// to ensure all message are received
+func NewRabbitMQ(conn *amqp.Connection, opts RabbitMQOptions) (*RabbitMQ, error) {
+	if opts.Channels <= 0 {
+		opts.Channels = DefaultPublishChannels
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = DefaultMaxInFlight
+	}
+	topology := opts.Topology.withDefaults()
+	if err := topology.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology: %w", err)
+	}
+	r := &RabbitMQ{
+		logger:      slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		encoder:     opts.Encoder,
+		channels:    opts.Channels,
+		maxInFlight: opts.MaxInFlight,
+		topology:    topology,
+	}
+	if err := r.Setup(conn); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
+// Setup declares the exchange, the queues and the bindings and opens the confirm mode channels on conn
+// It is called again with the new connection after a reconnection, publishing on the previous
+// channels fails and the relay retries the events
+// A channel closed by the broker closes conn so the whole connection is recovered
+func (r *RabbitMQ) Setup(conn *amqp.Connection) error {
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if err = ch.ExchangeDeclare(exchangeName, "topic", true, false, false, false, nil); err != nil {
-		return nil, err
+		return err
 	}
 
-	queue, err := ch.QueueDeclare(queueName, false, false, false, false, nil)
-	if err != nil {
-		return nil, err
+	if err = r.topology.declare(ch); err != nil {
+		return err
 	}
+	closeOnChannelError(conn, ch)
 
-	if err = ch.QueueBind(queue.Name, "user.*", exchangeName, false, nil); err != nil {
-		return nil, err
-
+	channels := make([]publishChannel, 0, r.channels)
+	for range r.channels {
+		pubCh, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		// allow knowing if message are received successfully or not
+		if err := pubCh.Confirm(false); err != nil {
+			return fmt.Errorf("channel could not be put into confirm mode: %w", err)
+		}
+		closeOnChannelError(conn, pubCh)
+		channels = append(channels, amqpChannel{ch: pubCh})
 	}
 
-	// allow knowing if message are received successfully or not
-	if err := ch.Confirm(false); err != nil {
-		return nil, fmt.Errorf("channel could not be put into confirm mode: %w", err)
-	}
-	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 10))
+	r.mu.Lock()
+	r.Ch = ch
+	r.publisher = newPublisher(channels, r.maxInFlight)
+	r.mu.Unlock()
 
-	logger.Info("RabbitMQ setup complete", "exchange", exchangeName, "queue", queue.Name)
+	r.logger.Info("RabbitMQ setup complete", "exchange", exchangeName, "queues", len(r.topology.Queues),
+		"dead_letter_exchange", r.topology.DeadLetterExchange, "channels", r.channels, "max_in_flight", r.maxInFlight)
+	return nil
+}
 
-	return &RabbitMQ{
-		logger:   logger,
-		Ch:       ch,
-		queue:    queue,
-		confirms: confirms,
-	}, nil
+// closeOnChannelError closes the connection when the broker closes the channel
+// A graceful close of the channel or the connection gives no error and is ignored
+func closeOnChannelError(conn *amqp.Connection, ch *amqp.Channel) {
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err := <-closed; err != nil {
+			_ = conn.Close()
+		}
+	}()
 }
 
 // publishAndConfirm is a helper func to be reused to publish message
-func (r *RabbitMQ) publishAndConfirm(ctx context.Context, routingKey string, body []byte) error {
-	if err := r.Ch.Publish(exchangeName, routingKey, false, false,
-		amqp.Publishing{ContentType: "application/json", Body: body, Timestamp: time.Now()},
-	); err != nil {
+// The event is routed by its type and the call returns once the broker confirmed it
+// It is safe to call from several goroutines
+func (r *RabbitMQ) publishAndConfirm(ctx context.Context, e *Event) error {
+	msg, err := r.encoder.Encode(e)
+	if err != nil {
+		return fmt.Errorf("%w: encoding event: %w", ErrUnpublishable, err)
+	}
+	msg.DeliveryMode = r.topology.deliveryMode()
+
+	r.mu.RLock()
+	p := r.publisher
+	r.mu.RUnlock()
+	if err := p.publish(ctx, exchangeName, e.Type, msg); err != nil {
 		return err
 	}
+	r.logger.Info("message ACK", "event_id", e.ID, "type", e.Type)
+	return nil
+}
 
-	select {
-	case confirm := <-r.confirms:
-		if !confirm.Ack {
-			return fmt.Errorf("message NACK : %d", confirm.DeliveryTag)
-		} else {
-			r.logger.Info("message ACK", "confirm", confirm.DeliveryTag)
+// Close waits for the events in flight to be confirmed then closes the channels
+// The connection is closed by its owner afterwards
+func (r *RabbitMQ) Close(ctx context.Context) error {
+	r.mu.RLock()
+	ch, p := r.Ch, r.publisher
+	r.mu.RUnlock()
+
+	if n, err := p.close(ctx); err != nil {
+		if n > 0 {
+			r.logger.Warn("events dropped waiting for their confirmation", "dropped", n)
+			return fmt.Errorf("%d events not confirmed: %w", n, err)
 		}
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+		return err
 	}
+	return ch.Close()
 }
 
 // UserCreatedEvent handle the user created event
-func (r *RabbitMQ) UserCreatedEvent(ctx context.Context, u *User) error {
-	body, err := json.Marshal(u)
-	if err != nil {
-		return err
-	}
-	return r.publishAndConfirm(ctx, UserCreatedRoutingKey, body)
+func (r *RabbitMQ) UserCreatedEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
 }
 
 // UserUpdatedEvent handle the user updated event
-func (r *RabbitMQ) UserUpdatedEvent(ctx context.Context, u *User) error {
-	body, err := json.Marshal(u)
-	if err != nil {
-		return err
-	}
-
-	return r.publishAndConfirm(ctx, UserUpdatedRoutingKey, body)
+func (r *RabbitMQ) UserUpdatedEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
 }
 
 // UserDeletedEvent handle the user deleted event
-func (r *RabbitMQ) UserDeletedEvent(ctx context.Context, id string) error {
-	body, err := json.Marshal(id) // produces a quoted JSON string
-	if err != nil {
-		return err
-	}
-	return r.publishAndConfirm(ctx, UserDeletedRoutingKey, body)
+func (r *RabbitMQ) UserDeletedEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
+}
+
+// UserRolesChangedEvent handle the user roles changed event
+func (r *RabbitMQ) UserRolesChangedEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
+}
+
+// UserRestoredEvent handle the user restored event
+func (r *RabbitMQ) UserRestoredEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
+}
+
+// UserPurgedEvent handle the user purged event
+func (r *RabbitMQ) UserPurgedEvent(ctx context.Context, e *Event) error {
+	return r.publishAndConfirm(ctx, e)
 }
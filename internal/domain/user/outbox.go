@@ -0,0 +1,66 @@
+package user
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// OutboxEvent is an event waiting to be published on the broker
+// It is stored in the same transaction as the user change it describes
+// so an event exists if and only if the change was committed
+type OutboxEvent struct {
+	ID         string
+	RoutingKey string       `bson:"routing_key"`
+	User       UserSnapshot // the user when the change happened
+	// Changes are the fields changed by an update
+	Changes   []FieldChange `bson:",omitempty"`
+	CreatedAt time.Time     `bson:"created_at"`
+	SentAt    *time.Time    `bson:"sent_at,omitempty"`
+	Attempts  int
+	LastError string `bson:"last_error,omitempty"`
+	// ParkedAt is set once the event failed too many times, it is not published anymore
+	ParkedAt *time.Time `bson:"parked_at,omitempty"`
+}
+
+// NewOutboxEvent create an event for the given routing key with a snapshot of the user
+func NewOutboxEvent(routingKey string, u *User) *OutboxEvent {
+	return &OutboxEvent{
+		ID:         uuid.New().String(),
+		RoutingKey: routingKey,
+		User:       NewUserSnapshot(u),
+		CreatedAt:  time.Now(),
+	}
+}
+
+// Event returns the payload to publish, its ID is the outbox event ID
+// so retries publish the same event
+func (e *OutboxEvent) Event() *Event {
+	return &Event{
+		ID:            e.ID,
+		Type:          e.RoutingKey,
+		OccurredAt:    e.CreatedAt,
+		SchemaVersion: EventSchemaVersion,
+		User:          e.User,
+		Changes:       e.Changes,
+	}
+}
+
+// Outbox define the interface to store and track events to be published
+type Outbox interface {
+	Add(context.Context, *OutboxEvent) error
+	// Pending returns the events neither sent nor parked, oldest first
+	Pending(context.Context, int) ([]OutboxEvent, error)
+	// CountPending returns how many events are neither sent nor parked
+	CountPending(context.Context) (int64, error)
+	MarkSent(context.Context, string) error
+	MarkFailed(context.Context, string, error) error
+	// Park records the last failure and excludes the event from Pending
+	Park(context.Context, string, error) error
+}
+
+// Transactor runs fn in a transaction
+// Repository calls made with the ctx given to fn are committed or aborted together
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
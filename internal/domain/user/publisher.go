@@ -0,0 +1,125 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// DefaultPublishChannels is the size of the channel pool when none is configured
+	DefaultPublishChannels = 4
+	// DefaultMaxInFlight is the in-flight window when none is configured
+	DefaultMaxInFlight = 256
+)
+
+// confirmation is the broker answer to one published message
+// *amqp.DeferredConfirmation implements it
+type confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// publishChannel is a channel in confirm mode
+type publishChannel interface {
+	publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (confirmation, error)
+	close() error
+}
+
+// amqpChannel publishes on an amqp.Channel put in confirm mode
+type amqpChannel struct {
+	ch *amqp.Channel
+}
+
+func (c amqpChannel) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (confirmation, error) {
+	dc, err := c.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, msg)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (c amqpChannel) close() error {
+	return c.ch.Close()
+}
+
+// publisher publishes messages on a pool of confirm mode channels
+// A channel is used by one goroutine at a time and given back as soon as the message is sent,
+// the caller then waits for the confirmation of its own delivery tag
+// At most maxInFlight messages wait for their confirmation, callers block past that
+type publisher struct {
+	channels chan publishChannel
+	inFlight chan struct{}
+}
+
+func newPublisher(channels []publishChannel, maxInFlight int) *publisher {
+	p := &publisher{
+		channels: make(chan publishChannel, len(channels)),
+		inFlight: make(chan struct{}, maxInFlight),
+	}
+	for _, ch := range channels {
+		p.channels <- ch
+	}
+	return p
+}
+
+// publish sends the message and waits for the broker to confirm it
+// It blocks while the in-flight window is full or every channel is busy, until ctx is done
+func (p *publisher) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	select {
+	case p.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.inFlight }()
+
+	var ch publishChannel
+	select {
+	case ch = <-p.channels:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	confirm, err := ch.publish(ctx, exchange, routingKey, msg)
+	p.channels <- ch
+	if err != nil {
+		return err
+	}
+	messagesPublished.WithLabelValues(routingKey).Inc()
+
+	outstandingConfirms.Inc()
+	ack, err := confirm.WaitContext(ctx)
+	outstandingConfirms.Dec()
+	if err != nil {
+		return err
+	}
+	if !ack {
+		messagesNacked.WithLabelValues(routingKey).Inc()
+		return fmt.Errorf("message %s NACK", msg.MessageId)
+	}
+	messagesConfirmed.WithLabelValues(routingKey).Inc()
+	return nil
+}
+
+// close waits for the messages in flight to be confirmed then closes the channels
+// When ctx is done first it returns how many messages were still waiting and the channels stay open
+func (p *publisher) close(ctx context.Context) (int, error) {
+	for taken := range cap(p.inFlight) {
+		select {
+		case p.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			waiting := len(p.inFlight) - taken
+			for range taken {
+				<-p.inFlight
+			}
+			return waiting, ctx.Err()
+		}
+	}
+
+	var errs []error
+	for range cap(p.channels) {
+		if err := (<-p.channels).close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return 0, errors.Join(errs...)
+}
@@ -0,0 +1,165 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConfirmation is resolved by the fake broker
+type fakeConfirmation struct {
+	done chan struct{}
+	ack  bool
+}
+
+func (c *fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	select {
+	case <-c.done:
+		return c.ack, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// fakeChannel confirms messages after a random delay, so out of order,
+// and refuses the ones whose id starts with "nack"
+// It fails the test when used by two goroutines at once
+type fakeChannel struct {
+	t       *testing.T
+	busy    atomic.Bool
+	pending *atomic.Int64
+	maxSeen *atomic.Int64
+	hold    chan struct{}
+}
+
+func (c *fakeChannel) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (confirmation, error) {
+	if !c.busy.CompareAndSwap(false, true) {
+		c.t.Error("channel used by two goroutines at once")
+	}
+	defer c.busy.Store(false)
+
+	pending := c.pending.Add(1)
+	for {
+		seen := c.maxSeen.Load()
+		if pending <= seen || c.maxSeen.CompareAndSwap(seen, pending) {
+			break
+		}
+	}
+
+	confirm := &fakeConfirmation{done: make(chan struct{}), ack: !strings.HasPrefix(msg.MessageId, "nack")}
+	go func() {
+		if c.hold != nil {
+			<-c.hold
+		}
+		time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+		c.pending.Add(-1)
+		close(confirm.done)
+	}()
+	return confirm, nil
+}
+
+func (c *fakeChannel) close() error { return nil }
+
+func newFakePublisher(t *testing.T, channels, maxInFlight int, hold chan struct{}) (*publisher, *atomic.Int64) {
+	pending, maxSeen := &atomic.Int64{}, &atomic.Int64{}
+	var pool []publishChannel
+	for range channels {
+		pool = append(pool, &fakeChannel{t: t, pending: pending, maxSeen: maxSeen, hold: hold})
+	}
+	return newPublisher(pool, maxInFlight), maxSeen
+}
+
+// TestPublisherConfirmsUnderLoad test that concurrent callers each get the confirmation
+// of their own message, with the in-flight window respected
+// Run it with -race
+func TestPublisherConfirmsUnderLoad(t *testing.T) {
+	const callers, maxInFlight = 500, 16
+	p, maxSeen := newFakePublisher(t, 4, maxInFlight, nil)
+	published := testutil.ToFloat64(messagesPublished.WithLabelValues(UserCreatedRoutingKey))
+	confirmed := testutil.ToFloat64(messagesConfirmed.WithLabelValues(UserCreatedRoutingKey))
+	nacked := testutil.ToFloat64(messagesNacked.WithLabelValues(UserCreatedRoutingKey))
+
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("ack-%d", i)
+			if i%3 == 0 {
+				id = fmt.Sprintf("nack-%d", i)
+			}
+			errs[i] = p.publish(context.Background(), exchangeName, UserCreatedRoutingKey, amqp.Publishing{MessageId: id})
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i%3 == 0 {
+			assert.ErrorContains(t, err, fmt.Sprintf("nack-%d NACK", i), "caller %d must get its own nack", i)
+		} else {
+			assert.NoError(t, err, "caller %d must get its own ack", i)
+		}
+	}
+	assert.LessOrEqual(t, maxSeen.Load(), int64(maxInFlight), "in-flight window exceeded")
+
+	assert.Equal(t, published+callers, testutil.ToFloat64(messagesPublished.WithLabelValues(UserCreatedRoutingKey)))
+	assert.Equal(t, confirmed+callers*2/3, testutil.ToFloat64(messagesConfirmed.WithLabelValues(UserCreatedRoutingKey)))
+	assert.Equal(t, nacked+callers/3+1, testutil.ToFloat64(messagesNacked.WithLabelValues(UserCreatedRoutingKey)))
+	assert.Zero(t, testutil.ToFloat64(outstandingConfirms))
+}
+
+// TestPublisherBackpressure test that callers wait while the window is full and give up with their context
+func TestPublisherBackpressure(t *testing.T) {
+	hold := make(chan struct{})
+	p, _ := newFakePublisher(t, 1, 1, hold)
+
+	first := make(chan error)
+	go func() {
+		first <- p.publish(context.Background(), exchangeName, UserCreatedRoutingKey, amqp.Publishing{MessageId: "first"})
+	}()
+
+	// the window is taken by the first message until the broker confirms it
+	require.Eventually(t, func() bool { return len(p.inFlight) == 1 }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := p.publish(ctx, exchangeName, UserCreatedRoutingKey, amqp.Publishing{MessageId: "second"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(hold)
+	assert.NoError(t, <-first)
+	assert.NoError(t, p.publish(context.Background(), exchangeName, UserCreatedRoutingKey, amqp.Publishing{MessageId: "third"}))
+}
+
+// TestPublisherClose test that close waits for the confirmations and reports the ones missing at the deadline
+func TestPublisherClose(t *testing.T) {
+	hold := make(chan struct{})
+	p, _ := newFakePublisher(t, 2, 4, hold)
+
+	first := make(chan error)
+	go func() {
+		first <- p.publish(context.Background(), exchangeName, UserCreatedRoutingKey, amqp.Publishing{MessageId: "first"})
+	}()
+	require.Eventually(t, func() bool { return len(p.inFlight) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	waiting, err := p.close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, waiting)
+
+	close(hold)
+	assert.NoError(t, <-first)
+	waiting, err = p.close(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, waiting)
+}
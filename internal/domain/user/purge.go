@@ -0,0 +1,44 @@
+package user
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// PurgeJob periodically purges the users soft deleted for longer than the retention
+type PurgeJob struct {
+	svc       Service
+	retention time.Duration
+	interval  time.Duration
+	logger    *slog.Logger
+}
+
+func NewPurgeJob(svc Service, retention, interval time.Duration) *PurgeJob {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &PurgeJob{svc: svc, retention: retention, interval: interval, logger: slog.New(handler)}
+}
+
+// Run purges on every interval until ctx is cancelled
+func (j *PurgeJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := j.svc.PurgeDeleted(ctx, time.Now().Add(-j.retention))
+		if err != nil {
+			j.logger.Error("failed to purge deleted users", "purged", purged, "error", err)
+			continue
+		}
+		if purged > 0 {
+			j.logger.Info("deleted users purged", "purged", purged, "retention", j.retention)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	relayInterval   = 500 * time.Millisecond
+	relayBatchSize  = 100
+	relayMaxBackoff = 30 * time.Second
+	publishTimeout  = 3 * time.Second
+	// countTimeout bounds the count of the events left when the shutdown deadline is hit
+	countTimeout = time.Second
+)
+
+// ErrUnpublishable marks the errors no retry can fix, like an unknown event type
+// or an event that can't be encoded
+var ErrUnpublishable = errors.New("event can't be published")
+
+// Relay publishes the events stored in the Outbox through the Notifier
+// The events of a user are published oldest first and marked as sent once the broker confirmed them
+// On failure the events of that user stop, so their order is kept, and the relay retries with
+// an exponential backoff: an event is never lost but can be delivered more than once
+// An event failing with ErrUnpublishable is parked so it does not block the ones after it,
+// any other error is retried until it succeeds, however long the broker is down
+type Relay struct {
+	outbox   Outbox
+	mq       Notifier
+	logger   *slog.Logger
+	interval time.Duration
+
+	// busy is held while a batch is published, Shutdown keeps it once taken
+	busy     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewRelay(outbox Outbox, mq Notifier) *Relay {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &Relay{
+		outbox:   outbox,
+		mq:       mq,
+		logger:   slog.New(handler),
+		interval: relayInterval,
+		busy:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run polls the outbox until ctx is cancelled or Shutdown is called
+func (r *Relay) Run(ctx context.Context) {
+	wait := r.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		select {
+		case r.busy <- struct{}{}:
+		case <-r.stop:
+			return
+		}
+		_, err := r.PublishPending(ctx)
+		<-r.busy
+		if err != nil {
+			wait = min(wait*2, relayMaxBackoff)
+			r.logger.Error("outbox relay failed, backing off", "retry_in", wait, "error", err)
+			continue
+		}
+		wait = r.interval
+	}
+}
+
+// Shutdown stops the polling, waits for the batch being published then publishes
+// the events left in the outbox until it is empty or ctx is done
+// On failure it returns how many events were dropped, they stay in the outbox
+// and are published by the next relay to run
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	select {
+	case r.busy <- struct{}{}:
+	case <-ctx.Done():
+		return r.dropped(ctx, ctx.Err())
+	}
+
+	for {
+		sent, err := r.PublishPending(ctx)
+		if err != nil {
+			return r.dropped(ctx, err)
+		}
+		if sent < relayBatchSize {
+			return nil
+		}
+	}
+}
+
+// dropped logs and wraps the number of events left unpublished by the shutdown
+func (r *Relay) dropped(ctx context.Context, cause error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), countTimeout)
+	defer cancel()
+	n, err := r.outbox.CountPending(ctx)
+	if err != nil {
+		r.logger.Error("outbox drain failed, unknown number of events dropped", "error", cause)
+		return fmt.Errorf("draining outbox: %w", cause)
+	}
+	r.logger.Warn("outbox drain failed, events dropped until the next start", "dropped", n, "error", cause)
+	return fmt.Errorf("draining outbox: %d events dropped: %w", n, cause)
+}
+
+// PublishPending publishes one batch of pending events and returns how many were
+// sent or parked
+// The events of a user are published one after the other, oldest first, and the users
+// in parallel so the channels and the in-flight window of the publisher are used
+// A failing event stops the events of its user, the other users are still published
+// Events are marked sent in the outbox order
+func (r *Relay) PublishPending(ctx context.Context) (int, error) {
+	events, err := r.outbox.Pending(ctx, relayBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	results := make([]error, len(events))
+	// attempted is false for the events left behind a failure of their user
+	attempted := make([]bool, len(events))
+	var wg sync.WaitGroup
+	for _, indexes := range byUser(events) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range indexes {
+				attempted[i] = true
+				results[i] = r.publish(ctx, &events[i])
+				if results[i] != nil && !errors.Is(results[i], ErrUnpublishable) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	done := 0
+	var errs []error
+	for i, e := range events {
+		if !attempted[i] {
+			continue
+		}
+		switch err := results[i]; {
+		case err == nil:
+			if err := r.outbox.MarkSent(ctx, e.ID); err != nil {
+				return done, err
+			}
+		case errors.Is(err, ErrUnpublishable):
+			if parkErr := r.outbox.Park(ctx, e.ID, err); parkErr != nil {
+				return done, fmt.Errorf("parking event %s: %w", e.ID, parkErr)
+			}
+			r.logger.Error("outbox event parked, it can't be published",
+				"event_id", e.ID, "routing_key", e.RoutingKey, "error", err)
+		default:
+			if markErr := r.outbox.MarkFailed(ctx, e.ID, err); markErr != nil {
+				r.logger.Error("failed to record outbox failure", "event_id", e.ID, "error", markErr)
+			}
+			errs = append(errs, fmt.Errorf("publishing event %s: %w", e.ID, err))
+			continue
+		}
+		done++
+	}
+	return done, errors.Join(errs...)
+}
+
+// byUser groups the indexes of the events by user, keeping their order
+func byUser(events []OutboxEvent) map[string][]int {
+	groups := make(map[string][]int)
+	for i, e := range events {
+		groups[e.User.ID] = append(groups[e.User.ID], i)
+	}
+	return groups
+}
+
+// publish sends the event to the Notifier method matching its routing key
+func (r *Relay) publish(ctx context.Context, e *OutboxEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	return Dispatch(ctx, r.mq, e.Event())
+}
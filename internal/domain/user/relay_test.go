@@ -0,0 +1,171 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// TestRelayPublishPending test that pending events are published in order and marked as sent
+func TestRelayPublishPending(t *testing.T) {
+	outbox := &fakeOutbox{}
+	u := &User{ID: "id"}
+	for _, key := range []string{UserCreatedRoutingKey, UserUpdatedRoutingKey, UserDeletedRoutingKey} {
+		require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(key, u)))
+	}
+	mq := &fakeNotifier{}
+
+	sent, err := NewRelay(outbox, mq).PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, []string{UserCreatedRoutingKey, UserUpdatedRoutingKey, UserDeletedRoutingKey}, mq.published)
+	assert.Len(t, outbox.sent, 3)
+
+	// nothing left to publish on the next run
+	sent, err = NewRelay(outbox, mq).PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+}
+
+// TestRelayKeepsFailedEvents test that an event the broker refused stays pending
+func TestRelayKeepsFailedEvents(t *testing.T) {
+	outbox := &fakeOutbox{}
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "id"})))
+	mq := &fakeNotifier{err: errors.New("broker down")}
+
+	sent, err := NewRelay(outbox, mq).PublishPending(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, []string{outbox.events[0].ID}, outbox.failed)
+	assert.Empty(t, outbox.sent)
+
+	// the broker is back
+	mq.err = nil
+	sent, err = NewRelay(outbox, mq).PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	// the retry publishes the same event so consumers can deduplicate it
+	assert.Equal(t, outbox.events[0].ID, mq.events[0].ID)
+}
+
+// TestRelayParksUnpublishableEvent test that an event no retry can fix is parked
+// and the events after it are still published
+func TestRelayParksUnpublishableEvent(t *testing.T) {
+	outbox := &fakeOutbox{}
+	u := &User{ID: "id"}
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent("user.unknown", u)))
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserCreatedRoutingKey, u)))
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserUpdatedRoutingKey, u)))
+	mq := &fakeNotifier{}
+
+	sent, err := NewRelay(outbox, mq).PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, []string{outbox.events[0].ID}, outbox.parked)
+	assert.Equal(t, []string{UserCreatedRoutingKey, UserUpdatedRoutingKey}, mq.published)
+
+	pending, err := outbox.CountPending(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+}
+
+// TestRelayOutageKeepsOrder test that a long broker outage parks nothing
+// and the events are published in order once the broker is back
+func TestRelayOutageKeepsOrder(t *testing.T) {
+	outbox := &fakeOutbox{}
+	u := &User{ID: "id"}
+	keys := []string{UserCreatedRoutingKey, UserUpdatedRoutingKey, UserDeletedRoutingKey}
+	for _, key := range keys {
+		require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(key, u)))
+	}
+	mq := &fakeNotifier{err: errors.New("broker down")}
+	relay := NewRelay(outbox, mq)
+
+	for range 100 {
+		sent, err := relay.PublishPending(context.Background())
+		assert.Error(t, err)
+		assert.Equal(t, 0, sent)
+	}
+	assert.Empty(t, outbox.parked)
+	assert.Equal(t, 100, outbox.events[0].Attempts)
+
+	mq.err = nil
+	sent, err := relay.PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, keys, mq.published)
+	assert.Empty(t, outbox.parked)
+}
+
+// TestRelayPublishesUsersInParallel test that the events of different users are
+// published at the same time while the events of a user keep their order
+func TestRelayPublishesUsersInParallel(t *testing.T) {
+	outbox := &fakeOutbox{}
+	for _, id := range []string{"u1", "u2", "u3"} {
+		for _, key := range []string{UserCreatedRoutingKey, UserUpdatedRoutingKey} {
+			require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(key, &User{ID: id})))
+		}
+	}
+
+	// the created events are only confirmed once every user has one in flight
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(3)
+	order := map[string][]string{}
+	bus := NewBus()
+	bus.Subscribe(AllEvents, func(ctx context.Context, e *Event) error {
+		if e.Type == UserCreatedRoutingKey {
+			wg.Done()
+			wg.Wait()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order[e.User.ID] = append(order[e.User.ID], e.Type)
+		return nil
+	})
+
+	sent, err := NewRelay(outbox, bus).PublishPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 6, sent)
+	for _, id := range []string{"u1", "u2", "u3"} {
+		assert.Equal(t, []string{UserCreatedRoutingKey, UserUpdatedRoutingKey}, order[id], id)
+	}
+	// sent events are marked in the outbox order
+	var ids []string
+	for _, e := range outbox.events {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, ids, outbox.sent)
+}
+
+// TestRelayFailureStopsOneUser test that a failing event holds back the later events
+// of its user only
+func TestRelayFailureStopsOneUser(t *testing.T) {
+	outbox := &fakeOutbox{}
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "down"})))
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "up"})))
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserUpdatedRoutingKey, &User{ID: "down"})))
+	require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserUpdatedRoutingKey, &User{ID: "up"})))
+	var published []string
+	var mu sync.Mutex
+	bus := NewBus()
+	bus.Subscribe(AllEvents, func(ctx context.Context, e *Event) error {
+		if e.User.ID == "down" {
+			return errors.New("sink down")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, e.ID)
+		return nil
+	})
+
+	sent, err := NewRelay(outbox, bus).PublishPending(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []string{outbox.events[1].ID, outbox.events[3].ID}, published)
+	assert.Equal(t, []string{outbox.events[0].ID}, outbox.failed, "the later event of the user isn't tried")
+	assert.Equal(t, published, outbox.sent)
+}
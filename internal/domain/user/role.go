@@ -0,0 +1,45 @@
+package user
+
+import "slices"
+
+// Roles a user can be granted
+const (
+	// RoleAdmin can act on any user
+	RoleAdmin = "admin"
+	// RoleSupport can look users up for back office
+	RoleSupport = "support"
+)
+
+// Permission is an action on users a role can allow
+type Permission string
+
+const (
+	PermissionReadUsers   Permission = "users:read"
+	PermissionWriteUsers  Permission = "users:write"
+	PermissionDeleteUsers Permission = "users:delete"
+	PermissionManageRoles Permission = "roles:manage"
+	// PermissionManageWebhooks allows managing the webhook subscriptions and reading their deliveries
+	PermissionManageWebhooks Permission = "webhooks:manage"
+)
+
+// rolePermissions is the single source of truth of what each role allows
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:   {PermissionReadUsers, PermissionWriteUsers, PermissionDeleteUsers, PermissionManageRoles, PermissionManageWebhooks},
+	RoleSupport: {PermissionReadUsers},
+}
+
+// IsValidRole tells if the role exists
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission tells if one of the roles allows the permission
+func HasPermission(roles []string, p Permission) bool {
+	for _, role := range roles {
+		if slices.Contains(rolePermissions[role], p) {
+			return true
+		}
+	}
+	return false
+}
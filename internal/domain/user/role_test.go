@@ -0,0 +1,30 @@
+package user
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// TestHasPermission test the permissions granted by each role
+func TestHasPermission(t *testing.T) {
+	cases := []struct {
+		name  string
+		roles []string
+		perm  Permission
+		want  bool
+	}{
+		{"admin manages roles", []string{RoleAdmin}, PermissionManageRoles, true},
+		{"support reads users", []string{RoleSupport}, PermissionReadUsers, true},
+		{"support can't delete", []string{RoleSupport}, PermissionDeleteUsers, false},
+		{"any role is enough", []string{RoleSupport, RoleAdmin}, PermissionDeleteUsers, true},
+		{"no role", nil, PermissionReadUsers, false},
+		{"unknown role", []string{"superuser"}, PermissionReadUsers, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, HasPermission(tc.roles, tc.perm))
+			assert.Equal(t, tc.want, (&Identity{Roles: tc.roles}).Can(tc.perm))
+		})
+	}
+}
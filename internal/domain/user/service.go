@@ -3,50 +3,85 @@ package user
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 	"log/slog"
 	"os"
+	"slices"
 	"time"
 )
 
-var (
-	ErrMissingEmailPassword = errors.New("email and password are required")
-	ErrMissingName          = errors.New("first_name and last_name are required")
-	ErrEmailExists          = errors.New("email already exists")
-)
-
+// Notifier publishes the events of users, one method per event type
 type Notifier interface {
-	UserCreatedEvent(ctx context.Context, user *User) error
-	UserUpdatedEvent(ctx context.Context, user *User) error
-	UserDeletedEvent(ctx context.Context, id string) error
+	UserCreatedEvent(ctx context.Context, e *Event) error
+	UserUpdatedEvent(ctx context.Context, e *Event) error
+	UserDeletedEvent(ctx context.Context, e *Event) error
+	UserRolesChangedEvent(ctx context.Context, e *Event) error
+	UserRestoredEvent(ctx context.Context, e *Event) error
+	UserPurgedEvent(ctx context.Context, e *Event) error
+}
+
+// Dispatch calls the Notifier method matching the event type
+func Dispatch(ctx context.Context, n Notifier, e *Event) error {
+	switch e.Type {
+	case UserCreatedRoutingKey:
+		return n.UserCreatedEvent(ctx, e)
+	case UserUpdatedRoutingKey:
+		return n.UserUpdatedEvent(ctx, e)
+	case UserDeletedRoutingKey:
+		return n.UserDeletedEvent(ctx, e)
+	case UserRolesChangedRoutingKey:
+		return n.UserRolesChangedEvent(ctx, e)
+	case UserRestoredRoutingKey:
+		return n.UserRestoredEvent(ctx, e)
+	case UserPurgedRoutingKey:
+		return n.UserPurgedEvent(ctx, e)
+	default:
+		return fmt.Errorf("%w: unknown routing key %q", ErrUnpublishable, e.Type)
+	}
 }
 
 // Service define the interface for the business logic of the User entity
 type Service interface {
 	CreateUser(ctx context.Context, u *User) error
-	UpdateUser(ctx context.Context, u *User) error
-	DeleteUser(ctx context.Context, id string) error
+	UpdateUser(ctx context.Context, u *User, fields []string) error
+	DeleteUser(ctx context.Context, id string, version int64) (*User, error)
+	RestoreUser(ctx context.Context, id string) (*User, error)
+	PurgeUser(ctx context.Context, id string) error
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
 	GetUser(ctx context.Context, id string) (*User, error)
-	ListUsers(ctx context.Context, filter *UserFilter) ([]User, int64, error)
+	ListUsers(ctx context.Context, filter *UserFilter) (*UserPage, error)
+	GrantRole(ctx context.Context, id, role string) (*User, error)
+	RevokeRole(ctx context.Context, id, role string) (*User, error)
+	// Shutdown refuses new writes and waits for the ones in progress until ctx is done
+	Shutdown(ctx context.Context) error
 }
 
 // userService is the concrete implementation of the Service interface
-// We inject the user Repository and the Notifier interfaces
+// We inject the user Repository, the Outbox receiving the events,
+// the refresh tokens revoked on password changes and the Transactor making the writes atomic
+// The writes in progress are tracked so a shutdown doesn't cut a transaction
 type userService struct {
 	repo   Repository
-	mq     Notifier
+	outbox Outbox
+	tokens RefreshTokenRepository
+	tx     Transactor
 	logger *slog.Logger
+	writes inflight
 }
 
-func NewUserService(repo Repository, mq Notifier) Service {
+func NewUserService(repo Repository, outbox Outbox, tokens RefreshTokenRepository, tx Transactor) Service {
 	handler := slog.NewTextHandler(os.Stdout, nil)
-	return &userService{repo: repo, logger: slog.New(handler), mq: mq}
+	return &userService{repo: repo, outbox: outbox, tokens: tokens, tx: tx, logger: slog.New(handler)}
 }
 
 // CreateUser create a user using the repository
-// Start a routine to send a user created message to the broker
+// The user created event is stored in the outbox in the same transaction
 func (s *userService) CreateUser(ctx context.Context, u *User) error {
+	if !s.writes.start() {
+		return ErrShuttingDown
+	}
+	defer s.writes.done()
 	if u.Email == "" || u.Password == "" {
 		return ErrMissingEmailPassword
 	}
@@ -61,62 +96,179 @@ func (s *userService) CreateUser(ctx context.Context, u *User) error {
 		return ErrEmailExists
 	}
 	u.ID = uuid.New().String()
+	u.Version = 1
 	u.CreatedAt = time.Now()
 	u.UpdatedAt = time.Now()
-	password, err := bcrypt.GenerateFromPassword([]byte(u.Password), 10)
+	password, err := hashPassword(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(password)
+	u.Password = password
 
-	if err = s.repo.Create(ctx, u); err != nil {
+	return s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := s.repo.Create(ctx, u); err != nil {
+			return err
+		}
+		return s.outbox.Add(ctx, NewOutboxEvent(UserCreatedRoutingKey, u))
+	})
+}
+
+// UpdateUser update the given fields of the user and updated at timestamp
+// When no field is given every non empty field of u is updated
+// When the user is not at u.Version, a VersionConflictError with the current one is returned
+// The password is only hashed and changed when it is part of the fields,
+// every refresh token of the user is then revoked in the same transaction
+// The user updated event, with the changed fields, is stored in the outbox in the same transaction
+func (s *userService) UpdateUser(ctx context.Context, u *User, fields []string) error {
+	if !s.writes.start() {
+		return ErrShuttingDown
+	}
+	defer s.writes.done()
+	if len(fields) == 0 {
+		fields = u.populatedFields()
+	}
+	if err := validateUpdate(u, fields); err != nil {
 		return err
 	}
 
-	// fire and forget
-	go func(u *User) {
-		rabbitCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		if err := s.mq.UserCreatedEvent(rabbitCtx, u); err != nil {
-			slog.Error("failed to publish UserCreated event", "user_id", u.ID, "error", err)
+	u.UpdatedAt = time.Now()
+	if slices.Contains(fields, FieldPassword) {
+		password, err := hashPassword(u.Password)
+		if err != nil {
+			return err
 		}
-	}(u)
+		u.Password = password
+	}
 
+	return s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		before, err := s.repo.Update(ctx, u, fields)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(fields, FieldPassword) {
+			if err := s.tokens.RevokeAll(ctx, u.ID); err != nil {
+				return err
+			}
+		}
+		event := NewOutboxEvent(UserUpdatedRoutingKey, u)
+		event.Changes = Diff(&before, u)
+		return s.outbox.Add(ctx, event)
+	})
+}
+
+// validateUpdate checks the fields are known and the required ones are not emptied
+func validateUpdate(u *User, fields []string) error {
+	for _, field := range fields {
+		if !slices.Contains(updatableFields, field) {
+			return fmt.Errorf("%w: %q", ErrUnknownField, field)
+		}
+	}
+	switch {
+	case slices.Contains(fields, FieldEmail) && u.Email == "",
+		slices.Contains(fields, FieldPassword) && u.Password == "":
+		return ErrMissingEmailPassword
+	case slices.Contains(fields, FieldFirstName) && u.FirstName == "",
+		slices.Contains(fields, FieldLastName) && u.LastName == "":
+		return ErrMissingName
+	}
 	return nil
 }
 
-// UpdateUser update the user data and updated at timestamp
-// Start a routine to send an update user message to the broker
-func (s *userService) UpdateUser(ctx context.Context, u *User) error {
-	u.UpdatedAt = time.Now()
-	password, err := bcrypt.GenerateFromPassword([]byte(u.Password), 10)
+// DeleteUser soft deletes a user by its ID, it can be restored until it is purged
+// When the user is not at version, a VersionConflictError with the current one is returned
+// The user deleted event is stored in the outbox in the same transaction
+func (s *userService) DeleteUser(ctx context.Context, id string, version int64) (*User, error) {
+	if !s.writes.start() {
+		return nil, ErrShuttingDown
+	}
+	defer s.writes.done()
+	var u User
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if u, err = s.repo.SoftDelete(ctx, id, version); err != nil {
+			return err
+		}
+		return s.outbox.Add(ctx, NewOutboxEvent(UserDeletedRoutingKey, &u))
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	u.Password = string(password)
+	return &u, nil
+}
 
-	go func(u *User) {
-		rabbitCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		if err := s.mq.UserUpdatedEvent(rabbitCtx, u); err != nil {
-			slog.Error("failed to publish UserUpdated event", "user_id", u.ID, "error", err)
+// RestoreUser brings back a soft deleted user
+// The user restored event is stored in the outbox in the same transaction
+func (s *userService) RestoreUser(ctx context.Context, id string) (*User, error) {
+	if !s.writes.start() {
+		return nil, ErrShuttingDown
+	}
+	defer s.writes.done()
+	var u User
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if u, err = s.repo.Restore(ctx, id); err != nil {
+			return err
 		}
-	}(u)
+		return s.outbox.Add(ctx, NewOutboxEvent(UserRestoredRoutingKey, &u))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
 
-	return s.repo.Update(ctx, u)
+// PurgeUser permanently removes a soft deleted user
+// The user purged event, with the last state of the user, is stored in the outbox in the same transaction
+func (s *userService) PurgeUser(ctx context.Context, id string) error {
+	if !s.writes.start() {
+		return ErrShuttingDown
+	}
+	defer s.writes.done()
+	return s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		u, err := s.repo.Purge(ctx, id)
+		if err != nil {
+			return err
+		}
+		return s.outbox.Add(ctx, NewOutboxEvent(UserPurgedRoutingKey, &u))
+	})
 }
 
-// DeleteUser delete a user by its ID
-// Start a routine to send a delete user message to the broker
-func (s *userService) DeleteUser(ctx context.Context, id string) error {
-	go func(id string) {
-		rabbitCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		if err := s.mq.UserDeletedEvent(rabbitCtx, id); err != nil {
-			slog.Error("failed to publish UserUpdated event", "user_id", id, "error", err)
+// purgeBatchSize is the number of users loaded at once by PurgeDeleted
+const purgeBatchSize = 100
+
+// PurgeDeleted purges the users soft deleted before the given time
+// and returns how many were purged
+func (s *userService) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	for {
+		users, err := s.repo.ListDeletedBefore(ctx, before, purgeBatchSize)
+		if err != nil {
+			return purged, err
+		}
+		for _, u := range users {
+			// restored or purged in the meantime
+			if err := s.PurgeUser(ctx, u.ID); errors.Is(err, ErrNotDeleted) || errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return purged, err
+			}
+			purged++
+		}
+		if len(users) < purgeBatchSize {
+			return purged, nil
 		}
-	}(id)
-	return s.repo.DeleteByID(ctx, id)
+	}
+}
+
+// Shutdown refuses new writes and waits for the ones in progress until ctx is done
+// Their events are in the outbox once they return, the relay publishes them
+func (s *userService) Shutdown(ctx context.Context) error {
+	n, err := s.writes.drain(ctx)
+	if err != nil {
+		s.logger.Warn("shutdown deadline hit, writes still in progress", "writes", n)
+		return fmt.Errorf("%d writes still in progress: %w", n, err)
+	}
+	return nil
 }
 
 // GetUser gets a user by its ID
@@ -128,7 +280,73 @@ func (s *userService) GetUser(ctx context.Context, id string) (*User, error) {
 	return &u, nil
 }
 
-// ListUsers return the list of user according to filter
-func (s *userService) ListUsers(ctx context.Context, filter *UserFilter) ([]User, int64, error) {
-	return s.repo.List(ctx, filter)
+// ListUsers return one page of the users matching the filter
+// The page size is capped to MaxPageSize
+func (s *userService) ListUsers(ctx context.Context, filter *UserFilter) (*UserPage, error) {
+	switch {
+	case filter.PageSize <= 0:
+		filter.PageSize = DefaultPageSize
+	case filter.PageSize > MaxPageSize:
+		filter.PageSize = MaxPageSize
+	}
+	if filter.Page < 0 {
+		filter.Page = 0
+	}
+
+	sortBy, desc, err := ParseOrderBy(filter.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+	filter.SortBy, filter.Desc = sortBy, desc
+
+	if filter.PageToken != "" {
+		after, err := DecodeCursor(filter.PageToken, sortBy, desc)
+		if err != nil {
+			return nil, err
+		}
+		filter.After = after
+		filter.Page = 0
+	}
+
+	page, err := s.repo.List(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GrantRole adds the role to the user
+// The roles changed event is stored in the outbox in the same transaction
+func (s *userService) GrantRole(ctx context.Context, id, role string) (*User, error) {
+	return s.changeRoles(ctx, id, role, s.repo.AddRole)
+}
+
+// RevokeRole removes the role from the user
+// The roles changed event is stored in the outbox in the same transaction
+func (s *userService) RevokeRole(ctx context.Context, id, role string) (*User, error) {
+	return s.changeRoles(ctx, id, role, s.repo.RemoveRole)
+}
+
+func (s *userService) changeRoles(ctx context.Context, id, role string, change func(ctx context.Context, id, role string) (User, error)) (*User, error) {
+	if !s.writes.start() {
+		return nil, ErrShuttingDown
+	}
+	defer s.writes.done()
+	if !IsValidRole(role) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRole, role)
+	}
+
+	var u User
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if u, err = change(ctx, id, role); err != nil {
+			return err
+		}
+		return s.outbox.Add(ctx, NewOutboxEvent(UserRolesChangedRoutingKey, &u))
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("user roles changed", "user_id", id, "roles", u.Roles)
+	return &u, nil
 }
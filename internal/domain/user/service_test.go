@@ -2,39 +2,233 @@ package user
 
 import (
 	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 )
 
-type fakeNotifier struct{}
+// fakeNotifier records the published routing keys and events and fails when err is set
+type fakeNotifier struct {
+	mu        sync.Mutex
+	published []string
+	events    []*Event
+	err       error
+}
+
+func (r *fakeNotifier) UserCreatedEvent(ctx context.Context, e *Event) error {
+	return r.record(UserCreatedRoutingKey, e)
+}
+
+func (r *fakeNotifier) UserUpdatedEvent(ctx context.Context, e *Event) error {
+	return r.record(UserUpdatedRoutingKey, e)
+}
+
+func (r *fakeNotifier) UserDeletedEvent(ctx context.Context, e *Event) error {
+	return r.record(UserDeletedRoutingKey, e)
+}
+
+func (r *fakeNotifier) UserRolesChangedEvent(ctx context.Context, e *Event) error {
+	return r.record(UserRolesChangedRoutingKey, e)
+}
+
+func (r *fakeNotifier) UserRestoredEvent(ctx context.Context, e *Event) error {
+	return r.record(UserRestoredRoutingKey, e)
+}
+
+func (r *fakeNotifier) UserPurgedEvent(ctx context.Context, e *Event) error {
+	return r.record(UserPurgedRoutingKey, e)
+}
+
+func (r *fakeNotifier) record(routingKey string, e *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.published = append(r.published, routingKey)
+	r.events = append(r.events, e)
+	return nil
+}
 
-func (r *fakeNotifier) UserCreatedEvent(ctx context.Context, u *User) error { return nil }
+// fakeOutbox keeps events in memory and records which ones were sent or failed
+type fakeOutbox struct {
+	mu     sync.Mutex
+	events []OutboxEvent
+	sent   []string
+	failed []string
+	parked []string
+}
 
-func (r *fakeNotifier) UserUpdatedEvent(ctx context.Context, u *User) error { return nil }
+func (f *fakeOutbox) Add(ctx context.Context, e *OutboxEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, *e)
+	return nil
+}
+func (f *fakeOutbox) Pending(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var pending []OutboxEvent
+	for _, e := range f.events {
+		if e.SentAt == nil && e.ParkedAt == nil && len(pending) < limit {
+			pending = append(pending, e)
+		}
+	}
+	return pending, nil
+}
+func (f *fakeOutbox) CountPending(ctx context.Context) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, e := range f.events {
+		if e.SentAt == nil && e.ParkedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+func (f *fakeOutbox) MarkSent(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.events {
+		if f.events[i].ID == id {
+			now := time.Now()
+			f.events[i].SentAt = &now
+		}
+	}
+	f.sent = append(f.sent, id)
+	return nil
+}
+func (f *fakeOutbox) MarkFailed(ctx context.Context, id string, err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.events {
+		if f.events[i].ID == id {
+			f.events[i].Attempts++
+		}
+	}
+	f.failed = append(f.failed, id)
+	return nil
+}
+func (f *fakeOutbox) Park(ctx context.Context, id string, err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.events {
+		if f.events[i].ID == id {
+			now := time.Now()
+			f.events[i].Attempts++
+			f.events[i].ParkedAt = &now
+		}
+	}
+	f.parked = append(f.parked, id)
+	return nil
+}
+
+// fakeTx runs fn without any transaction
+type fakeTx struct{}
 
-func (r *fakeNotifier) UserDeletedEvent(ctx context.Context, id string) error { return nil }
+func (fakeTx) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
 
 type fakeRepo struct {
-	exists bool
-	err    error
+	exists  bool
+	err     error
+	updated []string
+	user    *User
+	listed  *UserFilter
 }
 
-func (f *fakeRepo) Create(ctx context.Context, u *User) error       { return nil }
-func (f *fakeRepo) Update(ctx context.Context, u *User) error       { return nil }
-func (f *fakeRepo) DeleteByID(ctx context.Context, id string) error { return nil }
+func (f *fakeRepo) Create(ctx context.Context, u *User) error { return nil }
+func (f *fakeRepo) Update(ctx context.Context, u *User, fields []string) (User, error) {
+	f.updated = fields
+	if f.user == nil {
+		return User{}, nil
+	}
+	before := *f.user
+	f.user.ApplyFields(u, fields)
+	*u = *f.user
+	return before, nil
+}
+func (f *fakeRepo) SoftDelete(ctx context.Context, id string, version int64) (User, error) {
+	if f.user == nil || f.user.ID != id || f.user.DeletedAt != nil {
+		return User{}, ErrNotFound
+	}
+	now := time.Now()
+	f.user.DeletedAt = &now
+	return *f.user, nil
+}
+func (f *fakeRepo) Restore(ctx context.Context, id string) (User, error) {
+	if f.user == nil || f.user.ID != id {
+		return User{}, ErrNotFound
+	}
+	if f.user.DeletedAt == nil {
+		return User{}, ErrNotDeleted
+	}
+	f.user.DeletedAt = nil
+	return *f.user, nil
+}
+func (f *fakeRepo) Purge(ctx context.Context, id string) (User, error) {
+	if f.user == nil || f.user.ID != id {
+		return User{}, ErrNotFound
+	}
+	if f.user.DeletedAt == nil {
+		return User{}, ErrNotDeleted
+	}
+	purged := *f.user
+	f.user = nil
+	return purged, nil
+}
+func (f *fakeRepo) ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	if f.user == nil || f.user.DeletedAt == nil || !f.user.DeletedAt.Before(before) {
+		return nil, nil
+	}
+	return []User{*f.user}, nil
+}
 func (f *fakeRepo) GetByID(ctx context.Context, id string) (User, error) {
+	if f.user != nil {
+		return *f.user, nil
+	}
 	return User{}, nil
 }
-func (f *fakeRepo) List(ctx context.Context, filter *UserFilter) ([]User, int64, error) {
-	return []User{}, 0, nil
+func (f *fakeRepo) List(ctx context.Context, filter *UserFilter) (UserPage, error) {
+	f.listed = filter
+	return UserPage{}, nil
 }
 func (f *fakeRepo) ExistsByEmail(ctx context.Context, email string) (bool, error) {
 	return f.exists, f.err
 }
+func (f *fakeRepo) AddRole(ctx context.Context, id, role string) (User, error) {
+	if f.user == nil || f.user.ID != id {
+		return User{}, ErrNotFound
+	}
+	if !slices.Contains(f.user.Roles, role) {
+		f.user.Roles = append(f.user.Roles, role)
+	}
+	return *f.user, nil
+}
+func (f *fakeRepo) RemoveRole(ctx context.Context, id, role string) (User, error) {
+	if f.user == nil || f.user.ID != id {
+		return User{}, ErrNotFound
+	}
+	f.user.Roles = slices.DeleteFunc(f.user.Roles, func(r string) bool { return r == role })
+	return *f.user, nil
+}
+func (f *fakeRepo) GetByEmail(ctx context.Context, email string) (User, error) {
+	if f.user == nil || f.user.Email != email {
+		return User{}, ErrNotFound
+	}
+	return *f.user, nil
+}
 
 // TestCreateUserValidation test payload integrity following business rules
 func TestCreateUserValidation(t *testing.T) {
-	notifier := &fakeNotifier{}
 	cases := []struct {
 		name    string
 		input   *User
@@ -101,14 +295,243 @@ func TestCreateUserValidation(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			svc := NewUserService(tc.repo, notifier)
+			outbox := &fakeOutbox{}
+			svc := NewUserService(tc.repo, outbox, newFakeTokenRepo(), fakeTx{})
 			err := svc.CreateUser(context.Background(), tc.input)
 			if tc.wantErr != nil {
 				assert.ErrorIs(t, err, tc.wantErr)
+				assert.Empty(t, outbox.events)
 			} else {
 				assert.NoError(t, err)
 				assert.NotEmpty(t, tc.input.ID)
+				if assert.Len(t, outbox.events, 1) {
+					assert.Equal(t, UserCreatedRoutingKey, outbox.events[0].RoutingKey)
+					assert.Equal(t, tc.input.ID, outbox.events[0].User.ID)
+				}
+			}
+		})
+	}
+}
+
+// TestUpdateUserFields test that only the fields of the mask reach the repository
+func TestUpdateUserFields(t *testing.T) {
+	cases := []struct {
+		name       string
+		input      *User
+		fields     []string
+		wantFields []string
+		wantErr    error
+	}{
+		{"nickname only",
+			&User{ID: "id", Nickname: "new"},
+			[]string{FieldNickname},
+			[]string{FieldNickname},
+			nil,
+		},
+		{"no mask updates the populated fields",
+			&User{ID: "id", Nickname: "new", Country: "FR"},
+			nil,
+			[]string{FieldNickname, FieldCountry},
+			nil,
+		},
+		{"unknown field",
+			&User{ID: "id"},
+			[]string{"id"},
+			nil,
+			ErrUnknownField,
+		},
+		{"emptying the email",
+			&User{ID: "id"},
+			[]string{FieldEmail},
+			nil,
+			ErrMissingEmailPassword,
+		},
+		{"emptying the last name",
+			&User{ID: "id", FirstName: "foo"},
+			[]string{FieldFirstName, FieldLastName},
+			nil,
+			ErrMissingName,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := &fakeRepo{}
+			outbox := &fakeOutbox{}
+			svc := NewUserService(repo, outbox, newFakeTokenRepo(), fakeTx{})
+			err := svc.UpdateUser(context.Background(), tc.input, tc.fields)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.Empty(t, outbox.events)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantFields, repo.updated)
+			assert.Len(t, outbox.events, 1)
+		})
+	}
+}
+
+// TestUpdateUserPassword test that the password is hashed only when part of the mask
+func TestUpdateUserPassword(t *testing.T) {
+	svc := NewUserService(&fakeRepo{}, &fakeOutbox{}, newFakeTokenRepo(), fakeTx{})
+
+	hashes := func() uint64 {
+		var m dto.Metric
+		require.NoError(t, passwordSeconds.WithLabelValues("hash").(prometheus.Histogram).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := hashes()
+
+	u := &User{ID: "id", Nickname: "new", Password: "plain"}
+	assert.NoError(t, svc.UpdateUser(context.Background(), u, []string{FieldNickname}))
+	assert.Equal(t, "plain", u.Password, "password outside of the mask should be left untouched")
+	assert.Equal(t, before, hashes())
+
+	assert.NoError(t, svc.UpdateUser(context.Background(), u, []string{FieldPassword}))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(u.Password), []byte("plain")))
+	assert.Equal(t, before+1, hashes(), "the hashing time is recorded")
+}
+
+// TestGrantRevokeRole test role changes and their event
+func TestGrantRevokeRole(t *testing.T) {
+	repo := &fakeRepo{user: &User{ID: "id", Email: "john@faceit.com"}}
+	outbox := &fakeOutbox{}
+	svc := NewUserService(repo, outbox, newFakeTokenRepo(), fakeTx{})
+	ctx := context.Background()
+
+	u, err := svc.GrantRole(ctx, "id", RoleAdmin)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RoleAdmin}, u.Roles)
+
+	u, err = svc.RevokeRole(ctx, "id", RoleAdmin)
+	assert.NoError(t, err)
+	assert.Empty(t, u.Roles)
+
+	_, err = svc.GrantRole(ctx, "id", "superuser")
+	assert.ErrorIs(t, err, ErrUnknownRole)
+
+	_, err = svc.GrantRole(ctx, "unknown", RoleAdmin)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	if assert.Len(t, outbox.events, 2) {
+		assert.Equal(t, UserRolesChangedRoutingKey, outbox.events[0].RoutingKey)
+		assert.Equal(t, UserRolesChangedRoutingKey, outbox.events[1].RoutingKey)
+	}
+}
+
+// TestUpdateUserChanges test that the updated event carries the changed fields
+// without the password hash
+func TestUpdateUserChanges(t *testing.T) {
+	repo := &fakeRepo{user: &User{ID: "id", Email: "john@faceit.com", Country: "FR", Password: "$2a$10$old"}}
+	outbox := &fakeOutbox{}
+	svc := NewUserService(repo, outbox, newFakeTokenRepo(), fakeTx{})
+
+	u := &User{ID: "id", Country: "DE", Nickname: "john", Password: "newpassword"}
+	require.NoError(t, svc.UpdateUser(context.Background(), u, []string{FieldCountry, FieldPassword}))
+
+	require.Len(t, outbox.events, 1)
+	event := outbox.events[0]
+	assert.Equal(t, "DE", event.User.Country)
+	assert.Equal(t, "john@faceit.com", event.User.Email, "fields out of the mask keep their value")
+	assert.Equal(t, []FieldChange{
+		{Field: FieldCountry, Old: "FR", New: "DE"},
+		{Field: FieldPassword, Old: Redacted, New: Redacted},
+	}, event.Changes)
+}
+
+// TestDeleteRestorePurge test the lifecycle of a deleted user and its events
+func TestDeleteRestorePurge(t *testing.T) {
+	repo := &fakeRepo{user: &User{ID: "id", Email: "john@faceit.com"}}
+	outbox := &fakeOutbox{}
+	svc := NewUserService(repo, outbox, newFakeTokenRepo(), fakeTx{})
+	ctx := context.Background()
+
+	_, err := svc.RestoreUser(ctx, "id")
+	assert.ErrorIs(t, err, ErrNotDeleted, "a live user can't be restored")
+	assert.ErrorIs(t, svc.PurgeUser(ctx, "id"), ErrNotDeleted, "a live user can't be purged")
+
+	deleted, err := svc.DeleteUser(ctx, "id", 0)
+	assert.NoError(t, err)
+	require.NotNil(t, deleted.DeletedAt)
+	assert.Equal(t, *deleted.DeletedAt, *outbox.events[0].User.DeletedAt, "the event reports the stored deletion time")
+	restored, err := svc.RestoreUser(ctx, "id")
+	assert.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+
+	_, err = svc.DeleteUser(ctx, "id", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, svc.PurgeUser(ctx, "id"))
+	assert.Nil(t, repo.user)
+
+	var keys []string
+	for _, e := range outbox.events {
+		keys = append(keys, e.RoutingKey)
+	}
+	assert.Equal(t, []string{UserDeletedRoutingKey, UserRestoredRoutingKey, UserDeletedRoutingKey, UserPurgedRoutingKey}, keys)
+	// deletions carry the last known state of the user
+	assert.Equal(t, "john@faceit.com", outbox.events[2].User.Email)
+	assert.Equal(t, "john@faceit.com", outbox.events[3].User.Email)
+	assert.NotNil(t, outbox.events[3].User.DeletedAt)
+}
+
+// TestPurgeDeleted test that only the users deleted before the retention are purged
+func TestPurgeDeleted(t *testing.T) {
+	deletedAt := time.Now().Add(-2 * time.Hour)
+	repo := &fakeRepo{user: &User{ID: "id", DeletedAt: &deletedAt}}
+	svc := NewUserService(repo, &fakeOutbox{}, newFakeTokenRepo(), fakeTx{})
+
+	purged, err := svc.PurgeDeleted(context.Background(), time.Now().Add(-3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	assert.NotNil(t, repo.user)
+
+	purged, err = svc.PurgeDeleted(context.Background(), time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Nil(t, repo.user)
+}
+
+// TestListUsersPagination test the page size bounds and the decoding of page tokens
+func TestListUsersPagination(t *testing.T) {
+	created := time.Unix(1700000000, 0).UTC()
+	token := EncodeCursor(&User{ID: "id", CreatedAt: created}, SortCreatedAt, false)
+	nicknameToken := EncodeCursor(&User{ID: "id", Nickname: "ace"}, SortNickname, true)
+
+	cases := []struct {
+		name      string
+		filter    *UserFilter
+		wantSize  int32
+		wantPage  int32
+		wantAfter *Cursor
+		wantErr   error
+	}{
+		{"default page size", &UserFilter{}, DefaultPageSize, 0, nil, nil},
+		{"page size capped", &UserFilter{PageSize: 1000}, MaxPageSize, 0, nil, nil},
+		{"legacy page", &UserFilter{Page: 2, PageSize: 10}, 10, 2, nil, nil},
+		{"negative page", &UserFilter{Page: -1, PageSize: 10}, 10, 0, nil, nil},
+		{"page token wins over page", &UserFilter{Page: 2, PageToken: token}, DefaultPageSize, 0,
+			&Cursor{SortBy: SortCreatedAt, ID: "id", Time: created}, nil},
+		{"page token of the order", &UserFilter{OrderBy: "nickname desc", PageToken: nicknameToken}, DefaultPageSize, 0,
+			&Cursor{SortBy: SortNickname, Desc: true, ID: "id", Text: "ace"}, nil},
+		{"invalid page token", &UserFilter{PageToken: "not a token"}, 0, 0, nil, ErrInvalidPageToken},
+		{"page token of another order", &UserFilter{OrderBy: "nickname", PageToken: nicknameToken}, 0, 0, nil, ErrInvalidPageToken},
+		{"invalid order", &UserFilter{OrderBy: "email"}, 0, 0, nil, ErrInvalidOrderBy},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := &fakeRepo{}
+			svc := NewUserService(repo, &fakeOutbox{}, newFakeTokenRepo(), fakeTx{})
+			_, err := svc.ListUsers(context.Background(), tc.filter)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
 			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantSize, repo.listed.PageSize)
+			assert.Equal(t, tc.wantPage, repo.listed.Page)
+			assert.Equal(t, tc.wantAfter, repo.listed.After)
 		})
 	}
 }
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestShutdownOnSIGTERMUnderLoad test that on SIGTERM every committed write is published
+// before the shutdown returns and that the writes coming after are refused
+// Run it with -race
+func TestShutdownOnSIGTERMUnderLoad(t *testing.T) {
+	const writers = 8
+	outbox, mq := &fakeOutbox{}, &fakeNotifier{}
+	svc := NewUserService(&fakeRepo{}, outbox, newFakeTokenRepo(), fakeTx{})
+	relay := NewRelay(outbox, mq)
+	relay.interval = 5 * time.Millisecond
+	go relay.Run(context.Background())
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	var created, refused atomic.Int64
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				u := &User{FirstName: "foo", LastName: "bar", Password: "password", Email: fmt.Sprintf("%d-%d@test.com", w, i)}
+				err := svc.CreateUser(context.Background(), u)
+				if errors.Is(err, ErrShuttingDown) {
+					refused.Add(1)
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				created.Add(1)
+			}
+		}()
+	}
+
+	// the other writers are in the middle of a write when the signal comes
+	require.Eventually(t, func() bool { return created.Load() > 0 }, time.Minute, time.Millisecond)
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, process.Signal(syscall.SIGTERM))
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, svc.Shutdown(ctx))
+	require.NoError(t, relay.Shutdown(ctx))
+	wg.Wait()
+
+	assert.Equal(t, int64(writers), refused.Load(), "every writer is refused once shut down")
+	pending, err := outbox.CountPending(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, pending, "no event left in the outbox")
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	assert.Len(t, mq.published, int(created.Load()), "every committed write is published once")
+}
+
+// TestRelayShutdownDeadline test that the events not published by the deadline are reported as dropped
+func TestRelayShutdownDeadline(t *testing.T) {
+	outbox := &fakeOutbox{}
+	for range 3 {
+		require.NoError(t, outbox.Add(context.Background(), NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "id"})))
+	}
+	// the broker never confirms
+	bus := NewBus()
+	bus.Subscribe(AllEvents, func(ctx context.Context, e *Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := NewRelay(outbox, bus).Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "3 events dropped")
+}
+
+// TestServiceShutdownWaitsForWrites test that Shutdown waits for the write in progress
+func TestServiceShutdownWaitsForWrites(t *testing.T) {
+	release := make(chan struct{})
+	svc := NewUserService(&fakeRepo{}, &fakeOutbox{}, newFakeTokenRepo(), blockingTx{release: release})
+
+	done := make(chan error)
+	go func() {
+		done <- svc.CreateUser(context.Background(), &User{FirstName: "foo", LastName: "bar", Password: "password", Email: "foo@bar.com"})
+	}()
+	writes := &svc.(*userService).writes
+	require.Eventually(t, func() bool {
+		writes.mu.Lock()
+		defer writes.mu.Unlock()
+		return writes.n == 1
+	}, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, svc.Shutdown(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, <-done)
+	assert.NoError(t, svc.Shutdown(context.Background()))
+}
+
+// blockingTx runs fn once release is closed
+type blockingTx struct {
+	release chan struct{}
+}
+
+func (b blockingTx) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	<-b.release
+	return fn(ctx)
+}
@@ -0,0 +1,82 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"time"
+)
+
+const tokenIssuer = "esl-user-service"
+
+// Claims are the claims carried by an access token
+// The subject is the user ID
+type Claims struct {
+	jwt.RegisteredClaims
+	Email string   `json:"email"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Identity returns the caller described by the claims
+func (c *Claims) Identity() *Identity {
+	return &Identity{UserID: c.Subject, Email: c.Email, Roles: c.Roles}
+}
+
+// TokenManager issues and verifies signed access tokens
+type TokenManager struct {
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+	ttl       time.Duration
+}
+
+// NewHS256TokenManager signs tokens with a shared secret
+func NewHS256TokenManager(secret []byte, ttl time.Duration) *TokenManager {
+	return &TokenManager{method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret, ttl: ttl}
+}
+
+// NewEdDSATokenManager signs tokens with an ed25519 private key
+// Other services only need the public key to verify them
+func NewEdDSATokenManager(key ed25519.PrivateKey, ttl time.Duration) *TokenManager {
+	return &TokenManager{method: jwt.SigningMethodEdDSA, signKey: key, verifyKey: key.Public(), ttl: ttl}
+}
+
+// Issue returns a signed access token for the user and its expiration
+func (m *TokenManager) Issue(u *User) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.ttl)
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    tokenIssuer,
+			Subject:   u.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Email: u.Email,
+		Roles: u.Roles,
+	}
+
+	token, err := jwt.NewWithClaims(m.method, claims).SignedString(m.signKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// Verify checks the signature, issuer and expiration of the token and returns its claims
+func (m *TokenManager) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return m.verifyKey, nil
+	},
+		jwt.WithValidMethods([]string{m.method.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,147 @@
+package user
+
+import (
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// QueueType is the RabbitMQ queue implementation
+type QueueType string
+
+const (
+	ClassicQueue QueueType = "classic"
+	// QuorumQueue is replicated, it is always durable
+	QuorumQueue QueueType = "quorum"
+)
+
+// DefaultQueue is the queue declared when the topology has none
+var DefaultQueue = QueueSpec{Name: queueName, BindingKeys: []string{"user.*"}}
+
+// QueueSpec is a queue bound to the user.events exchange
+// Each consuming team gets its own queue with the routing keys it needs
+type QueueSpec struct {
+	Name        string
+	BindingKeys []string
+}
+
+// Topology is the set of queues declared next to the exchange and their options
+// The same options apply to every queue
+type Topology struct {
+	Queues []QueueSpec
+	Type   QueueType
+	// Durable queues survive a broker restart
+	Durable bool
+	// Persistent messages are written to disk, they survive a restart in a durable queue
+	Persistent bool
+	// DeadLetterExchange receives the messages rejected or expired from the queues
+	// and routes them all to DeadLetterQueue, none is declared when empty
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// MessageTTL and MaxLength limit the queues when set, the messages dropped are dead lettered
+	MessageTTL time.Duration
+	MaxLength  int
+}
+
+// withDefaults fills the queues and the type left empty
+func (t Topology) withDefaults() Topology {
+	if len(t.Queues) == 0 {
+		t.Queues = []QueueSpec{DefaultQueue}
+	}
+	if t.Type == "" {
+		t.Type = ClassicQueue
+	}
+	if t.DeadLetterExchange != "" && t.DeadLetterQueue == "" {
+		t.DeadLetterQueue = t.DeadLetterExchange
+	}
+	return t
+}
+
+// Validate checks the topology can be declared
+func (t Topology) Validate() error {
+	if t.Type != "" && t.Type != ClassicQueue && t.Type != QuorumQueue {
+		return fmt.Errorf("unknown queue type %q", t.Type)
+	}
+	if t.Type == QuorumQueue && !t.Durable {
+		return fmt.Errorf("quorum queues must be durable")
+	}
+	if t.MessageTTL < 0 || t.MaxLength < 0 {
+		return fmt.Errorf("message ttl and max length can't be negative")
+	}
+	names := make(map[string]bool)
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("queue without name")
+		}
+		if names[q.Name] {
+			return fmt.Errorf("queue %q declared twice", q.Name)
+		}
+		names[q.Name] = true
+		if len(q.BindingKeys) == 0 {
+			return fmt.Errorf("queue %q has no binding key", q.Name)
+		}
+	}
+	return nil
+}
+
+// queueArgs are the x- arguments of every queue
+func (t Topology) queueArgs() amqp.Table {
+	args := amqp.Table{}
+	if t.Type == QuorumQueue {
+		args[amqp.QueueTypeArg] = amqp.QueueTypeQuorum
+	}
+	if t.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = t.DeadLetterExchange
+	}
+	if t.MessageTTL > 0 {
+		args["x-message-ttl"] = t.MessageTTL.Milliseconds()
+	}
+	if t.MaxLength > 0 {
+		args["x-max-length"] = int64(t.MaxLength)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// deliveryMode of the published messages
+func (t Topology) deliveryMode() uint8 {
+	if t.Persistent {
+		return amqp.Persistent
+	}
+	return amqp.Transient
+}
+
+// declare declares the dead letter exchange and queue then the queues and their bindings
+func (t Topology) declare(ch *amqp.Channel) error {
+	if t.DeadLetterExchange != "" {
+		// fanout since dead lettered messages keep their routing key
+		if err := ch.ExchangeDeclare(t.DeadLetterExchange, "fanout", true, false, false, false, nil); err != nil {
+			return err
+		}
+		dlqArgs := amqp.Table(nil)
+		if t.Type == QuorumQueue {
+			dlqArgs = amqp.Table{amqp.QueueTypeArg: amqp.QueueTypeQuorum}
+		}
+		if _, err := ch.QueueDeclare(t.DeadLetterQueue, t.Durable, false, false, false, dlqArgs); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(t.DeadLetterQueue, "", t.DeadLetterExchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	args := t.queueArgs()
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, t.Durable, false, false, false, args); err != nil {
+			return fmt.Errorf("declaring queue %s: %w", q.Name, err)
+		}
+		for _, key := range q.BindingKeys {
+			if err := ch.QueueBind(q.Name, key, exchangeName, false, nil); err != nil {
+				return fmt.Errorf("binding queue %s to %s: %w", q.Name, key, err)
+			}
+		}
+	}
+	return nil
+}
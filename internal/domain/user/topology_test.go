@@ -0,0 +1,66 @@
+package user
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTopologyDefaults(t *testing.T) {
+	topology := Topology{DeadLetterExchange: "user.events.dlx"}.withDefaults()
+
+	assert.Equal(t, []QueueSpec{DefaultQueue}, topology.Queues)
+	assert.Equal(t, ClassicQueue, topology.Type)
+	assert.Equal(t, "user.events.dlx", topology.DeadLetterQueue)
+	assert.Nil(t, Topology{}.queueArgs())
+	assert.Equal(t, uint8(amqp.Transient), Topology{}.deliveryMode())
+	assert.Equal(t, uint8(amqp.Persistent), Topology{Persistent: true}.deliveryMode())
+}
+
+func TestTopologyQueueArgs(t *testing.T) {
+	topology := Topology{
+		Type:               QuorumQueue,
+		Durable:            true,
+		DeadLetterExchange: "user.events.dlx",
+		MessageTTL:         90 * time.Second,
+		MaxLength:          1000,
+	}
+
+	assert.Equal(t, amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-dead-letter-exchange": "user.events.dlx",
+		"x-message-ttl":          int64(90000),
+		"x-max-length":           int64(1000),
+	}, topology.queueArgs())
+	assert.NoError(t, amqp.Table(topology.queueArgs()).Validate())
+}
+
+func TestTopologyValidate(t *testing.T) {
+	queue := QueueSpec{Name: "billing", BindingKeys: []string{"user.created"}}
+	testCases := []struct {
+		name     string
+		topology Topology
+		wantErr  bool
+	}{
+		{name: "defaults", topology: Topology{}},
+		{name: "durable quorum", topology: Topology{Type: QuorumQueue, Durable: true, Queues: []QueueSpec{queue}}},
+		{name: "non durable quorum", topology: Topology{Type: QuorumQueue}, wantErr: true},
+		{name: "unknown type", topology: Topology{Type: "stream"}, wantErr: true},
+		{name: "negative ttl", topology: Topology{MessageTTL: -time.Second}, wantErr: true},
+		{name: "queue without key", topology: Topology{Queues: []QueueSpec{{Name: "billing"}}}, wantErr: true},
+		{name: "queue without name", topology: Topology{Queues: []QueueSpec{{BindingKeys: []string{"user.*"}}}}, wantErr: true},
+		{name: "duplicated queue", topology: Topology{Queues: []QueueSpec{queue, queue}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.topology.Validate()
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
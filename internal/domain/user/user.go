@@ -6,6 +6,8 @@ import (
 )
 
 // User represent our entity user
+// Version is incremented by every write, on updates it holds the version
+// the caller expects, 0 meaning no check
 type User struct {
 	ID        string
 	FirstName string `bson:"first_name"`
@@ -14,26 +16,135 @@ type User struct {
 	Email     string
 	Country   string
 	Password  string
+	Roles     []string `bson:",omitempty"`
+	Version   int64
 	CreatedAt time.Time `bson:"created_at"`
 	UpdatedAt time.Time `bson:"updated_at"`
+	// DeletedAt is set while the user is soft deleted
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
 }
 
-// UserFilter holds criteria for filtering and paginating users
+// Fields of a User that can be changed by an update
+// They match the proto and bson field names
+const (
+	FieldFirstName = "first_name"
+	FieldLastName  = "last_name"
+	FieldNickname  = "nickname"
+	FieldEmail     = "email"
+	FieldCountry   = "country"
+	FieldPassword  = "password"
+)
+
+var updatableFields = []string{FieldFirstName, FieldLastName, FieldNickname, FieldEmail, FieldCountry, FieldPassword}
+
+// fieldValues returns the updatable fields of u by name
+func (u *User) fieldValues() map[string]string {
+	return map[string]string{
+		FieldFirstName: u.FirstName,
+		FieldLastName:  u.LastName,
+		FieldNickname:  u.Nickname,
+		FieldEmail:     u.Email,
+		FieldCountry:   u.Country,
+		FieldPassword:  u.Password,
+	}
+}
+
+// populatedFields returns the updatable fields of u having a non empty value
+func (u *User) populatedFields() []string {
+	values := u.fieldValues()
+	var fields []string
+	for _, field := range updatableFields {
+		if values[field] != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// ApplyFields copies the given updatable fields of src into u
+func (u *User) ApplyFields(src *User, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case FieldFirstName:
+			u.FirstName = src.FirstName
+		case FieldLastName:
+			u.LastName = src.LastName
+		case FieldNickname:
+			u.Nickname = src.Nickname
+		case FieldEmail:
+			u.Email = src.Email
+		case FieldCountry:
+			u.Country = src.Country
+		case FieldPassword:
+			u.Password = src.Password
+		}
+	}
+}
+
+// UserFilter holds criteria for filtering, sorting and paginating users
+// FirstName, LastName and Country match exactly, prefixes ignore the case
+// Users are in one of Countries when it is set, zero times leave ranges open
+// Pages are read with PageToken, the NextPageToken of the previous page
+// Page numbers are a legacy mode used when Page is set and PageToken is not
 type UserFilter struct {
-	FirstName string
-	LastName  string
-	Country   string
+	FirstName       string
+	LastName        string
+	Country         string
+	Role            string
+	FirstNamePrefix string
+	LastNamePrefix  string
+	NicknamePrefix  string
+	EmailDomain     string
+	Countries       []string
+	CreatedAfter    time.Time
+	CreatedBefore   time.Time
+	UpdatedAfter    time.Time
+	UpdatedBefore   time.Time
+
+	// OrderBy is parsed by ParseOrderBy into SortBy and Desc
+	OrderBy string
+	SortBy  string
+	Desc    bool
+
+	PageToken string
 	Page      int32
 	PageSize  int32
+
+	// After is the decoded PageToken
+	After *Cursor
+}
+
+// UserPage is one page of a listing
+// NextPageToken is empty on the last page, Total is only counted on the pages fetched without token
+type UserPage struct {
+	Users         []User
+	Total         int64
+	NextPageToken string
 }
 
 // Repository define the interface to interact with the entity User
 // It serves the mongoDB
+// Soft deleted users are hidden from every method but Restore, Purge and ListDeletedBefore
 type Repository interface {
 	Create(context.Context, *User) error
-	Update(context.Context, *User) error
-	DeleteByID(context.Context, string) error
+	// Update sets the given fields of the user and loads the updated document in it
+	// The document as it was before the update is returned, both are read atomically
+	// The update only applies to u.Version, another version is a VersionConflictError
+	Update(context.Context, *User, []string) (User, error)
+	// SoftDelete marks the given version of the user as deleted
+	SoftDelete(ctx context.Context, id string, version int64) (User, error)
+	// Restore and Purge return ErrNotDeleted when the user isn't soft deleted
+	// Purge returns the last state of the user, without its password
+	Restore(context.Context, string) (User, error)
+	Purge(context.Context, string) (User, error)
+	// ListDeletedBefore returns up to limit users soft deleted before the given time
+	ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]User, error)
 	GetByID(context.Context, string) (User, error)
-	List(context.Context, *UserFilter) ([]User, int64, error)
+	List(context.Context, *UserFilter) (UserPage, error)
 	ExistsByEmail(context.Context, string) (bool, error)
+	// GetByEmail returns the user with its password hash
+	GetByEmail(context.Context, string) (User, error)
+	// AddRole and RemoveRole return the user with its updated roles
+	AddRole(ctx context.Context, id, role string) (User, error)
+	RemoveRole(ctx context.Context, id, role string) (User, error)
 }
@@ -0,0 +1,352 @@
+package user
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Headers of the webhook requests
+// The signature is the HMAC-SHA256 of "<timestamp>.<body>" with the subscription secret,
+// receivers reject old timestamps so a captured request can't be replayed
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+
+	webhookSignaturePrefix = "sha256="
+	// DefaultWebhookTolerance is how old a webhook request can be when verified
+	DefaultWebhookTolerance = 5 * time.Minute
+)
+
+// EventTypes are the routing keys of the published events
+var EventTypes = []string{
+	UserCreatedRoutingKey,
+	UserUpdatedRoutingKey,
+	UserDeletedRoutingKey,
+	UserRolesChangedRoutingKey,
+	UserRestoredRoutingKey,
+	UserPurgedRoutingKey,
+}
+
+// Subscription is an HTTP endpoint receiving the user events
+// The secret signs the requests, it is only given to the client when the subscription is created
+// An endpoint failing too many times in a row is disabled until enabled again
+type Subscription struct {
+	ID     string
+	URL    string
+	Secret string
+	// EventTypes the subscriber receives, all of them when empty
+	EventTypes          []string  `bson:"event_types"`
+	Enabled             bool      `bson:"enabled"`
+	ConsecutiveFailures int       `bson:"consecutive_failures"`
+	DisabledReason      string    `bson:"disabled_reason,omitempty"`
+	CreatedAt           time.Time `bson:"created_at"`
+	UpdatedAt           time.Time `bson:"updated_at"`
+}
+
+// Accepts tells if the subscriber receives the event type
+func (s *Subscription) Accepts(eventType string) bool {
+	return len(s.EventTypes) == 0 || slices.Contains(s.EventTypes, eventType)
+}
+
+// DeliveryStatus is the state of a webhook delivery
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// WebhookDelivery is one event to send to one subscriber, it is also its delivery log
+// Pending deliveries are stored so the retries survive a restart
+type WebhookDelivery struct {
+	ID             string
+	SubscriptionID string `bson:"subscription_id"`
+	EventID        string `bson:"event_id"`
+	EventType      string `bson:"event_type"`
+	// Payload is the body posted, a structured CloudEvent
+	Payload        []byte
+	ContentType    string         `bson:"content_type"`
+	Status         DeliveryStatus `bson:"status"`
+	Attempts       int            `bson:"attempts"`
+	NextAttemptAt  time.Time      `bson:"next_attempt_at"`
+	LastStatusCode int            `bson:"last_status_code,omitempty"`
+	LastError      string         `bson:"last_error,omitempty"`
+	CreatedAt      time.Time      `bson:"created_at"`
+	UpdatedAt      time.Time      `bson:"updated_at"`
+	DeliveredAt    *time.Time     `bson:"delivered_at,omitempty"`
+}
+
+// SubscriptionRepository define the interface to store webhook subscriptions
+type SubscriptionRepository interface {
+	Create(context.Context, *Subscription) error
+	Get(ctx context.Context, id string) (Subscription, error)
+	List(context.Context) ([]Subscription, error)
+	// ListEnabled returns the enabled subscriptions receiving the event type
+	ListEnabled(ctx context.Context, eventType string) ([]Subscription, error)
+	Delete(ctx context.Context, id string) error
+	// SetEnabled enables or disables the subscription and resets its failures
+	SetEnabled(ctx context.Context, id string, enabled bool, reason string) (Subscription, error)
+	// RecordFailure counts one more failure in a row and returns the subscription
+	RecordFailure(ctx context.Context, id string) (Subscription, error)
+	// RecordSuccess resets the failures in a row
+	RecordSuccess(ctx context.Context, id string) error
+}
+
+// DeliveryRepository define the interface to store the webhook deliveries
+type DeliveryRepository interface {
+	// Add stores the deliveries, one already stored for the same subscription and event is skipped
+	Add(context.Context, []WebhookDelivery) error
+	// Claim returns the oldest pending delivery due at now and pushes its next attempt after the lease,
+	// so it is retried if the process stops while sending it
+	// ErrNotFound is returned when none is due
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (WebhookDelivery, error)
+	Update(context.Context, *WebhookDelivery) error
+	// List returns the last deliveries of a subscription, newest first
+	List(ctx context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error)
+}
+
+const (
+	webhookSecretPrefix = "whsec_"
+	// webhookSecretSize is the number of random bytes of a secret, the size of a SHA-256 HMAC key
+	webhookSecretSize = 32
+)
+
+// newWebhookSecret returns a random signing secret, whsec_ followed by 64 hex characters
+func newWebhookSecret() (string, error) {
+	b := make([]byte, webhookSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + hex.EncodeToString(b), nil
+}
+
+// SignWebhook returns the signature header of a body sent at timestamp
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	mac.Write(body)
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook request
+// Requests signed more than tolerance away from now are rejected to prevent replays
+func VerifyWebhook(secret string, header http.Header, body []byte, tolerance time.Duration, now time.Time) error {
+	unix, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	timestamp := time.Unix(unix, 0)
+	if now.Sub(timestamp).Abs() > tolerance {
+		return ErrExpiredWebhookSignature
+	}
+	expected := SignWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(WebhookSignatureHeader))) {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
+
+// WebhookNotifier is the Notifier storing a delivery for each subscriber of the event
+// The WebhookDispatcher sends them, an event is confirmed once its deliveries are stored
+type WebhookNotifier struct {
+	subscriptions SubscriptionRepository
+	deliveries    DeliveryRepository
+	encoder       CloudEventsEncoder
+	logger        *slog.Logger
+}
+
+// NewWebhookNotifier creates the notifier, events are posted as JSON structured CloudEvents
+func NewWebhookNotifier(subscriptions SubscriptionRepository, deliveries DeliveryRepository, source string) *WebhookNotifier {
+	return &WebhookNotifier{
+		subscriptions: subscriptions,
+		deliveries:    deliveries,
+		encoder:       CloudEventsEncoder{Source: source, Mode: StructuredMode, ContentType: JSONContentType},
+		logger:        slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+}
+
+// enqueue stores one delivery of the event per subscriber
+func (w *WebhookNotifier) enqueue(ctx context.Context, e *Event) error {
+	subs, err := w.subscriptions.ListEnabled(ctx, e.Type)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	msg, err := w.encoder.Encode(e)
+	if err != nil {
+		return fmt.Errorf("%w: encoding event: %w", ErrUnpublishable, err)
+	}
+	now := time.Now()
+	deliveries := make([]WebhookDelivery, 0, len(subs))
+	for _, sub := range subs {
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:             uuid.New().String(),
+			SubscriptionID: sub.ID,
+			EventID:        e.ID,
+			EventType:      e.Type,
+			Payload:        msg.Body,
+			ContentType:    msg.ContentType,
+			Status:         DeliveryPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+	if err := w.deliveries.Add(ctx, deliveries); err != nil {
+		return err
+	}
+	w.logger.Info("webhook deliveries queued", "event_id", e.ID, "type", e.Type, "subscribers", len(subs))
+	return nil
+}
+
+// UserCreatedEvent handle the user created event
+func (w *WebhookNotifier) UserCreatedEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// UserUpdatedEvent handle the user updated event
+func (w *WebhookNotifier) UserUpdatedEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// UserDeletedEvent handle the user deleted event
+func (w *WebhookNotifier) UserDeletedEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// UserRolesChangedEvent handle the user roles changed event
+func (w *WebhookNotifier) UserRolesChangedEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// UserRestoredEvent handle the user restored event
+func (w *WebhookNotifier) UserRestoredEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// UserPurgedEvent handle the user purged event
+func (w *WebhookNotifier) UserPurgedEvent(ctx context.Context, e *Event) error {
+	return w.enqueue(ctx, e)
+}
+
+// WebhookService define the interface to manage the webhook subscriptions
+type WebhookService interface {
+	// CreateSubscription registers an endpoint, the returned subscription holds its secret
+	CreateSubscription(ctx context.Context, endpoint string, eventTypes []string) (*Subscription, error)
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	// SetSubscriptionEnabled enables a subscription again, or disables it, and resets its failures
+	SetSubscriptionEnabled(ctx context.Context, id string, enabled bool) (*Subscription, error)
+	// ListDeliveries returns the delivery log of a subscription, newest first
+	ListDeliveries(ctx context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error)
+}
+
+// webhookService is the concrete implementation of the WebhookService interface
+type webhookService struct {
+	subscriptions SubscriptionRepository
+	deliveries    DeliveryRepository
+	logger        *slog.Logger
+}
+
+func NewWebhookService(subscriptions SubscriptionRepository, deliveries DeliveryRepository) WebhookService {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &webhookService{subscriptions: subscriptions, deliveries: deliveries, logger: slog.New(handler)}
+}
+
+func (s *webhookService) CreateSubscription(ctx context.Context, endpoint string, eventTypes []string) (*Subscription, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	for _, t := range eventTypes {
+		if !slices.Contains(EventTypes, t) {
+			return nil, ErrUnknownEventType
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	sub := &Subscription{
+		ID:         uuid.New().String(),
+		URL:        endpoint,
+		Secret:     secret,
+		EventTypes: eventTypes,
+		Enabled:    true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := s.subscriptions.Create(ctx, sub); err != nil {
+		return nil, err
+	}
+	s.logger.Info("webhook subscription created", "id", sub.ID, "url", sub.URL)
+	return sub, nil
+}
+
+func (s *webhookService) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	sub, err := s.subscriptions.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (s *webhookService) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	return s.subscriptions.List(ctx)
+}
+
+func (s *webhookService) DeleteSubscription(ctx context.Context, id string) error {
+	if err := s.subscriptions.Delete(ctx, id); err != nil {
+		return err
+	}
+	s.logger.Info("webhook subscription deleted", "id", id)
+	return nil
+}
+
+func (s *webhookService) SetSubscriptionEnabled(ctx context.Context, id string, enabled bool) (*Subscription, error) {
+	reason := ""
+	if !enabled {
+		reason = "disabled manually"
+	}
+	sub, err := s.subscriptions.SetEnabled(ctx, id, enabled, reason)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (s *webhookService) ListDeliveries(ctx context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error) {
+	if _, err := s.subscriptions.Get(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > MaxPageSize {
+		limit = DefaultPageSize
+	}
+	return s.deliveries.List(ctx, subscriptionID, limit)
+}
+
+// disabledReason explains an automatic disabling
+func disabledReason(failures int) string {
+	return fmt.Sprintf("disabled after %d failed deliveries in a row", failures)
+}
@@ -0,0 +1,219 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	DefaultWebhookTimeout      = 10 * time.Second
+	DefaultWebhookMaxAttempts  = 10
+	DefaultWebhookBaseBackoff  = 30 * time.Second
+	DefaultWebhookMaxBackoff   = 6 * time.Hour
+	DefaultWebhookDisableAfter = 20
+
+	webhookInterval  = time.Second
+	webhookBatchSize = 50
+)
+
+// WebhookDispatcherOptions tunes the dispatcher, zero values use the defaults
+type WebhookDispatcherOptions struct {
+	Client *http.Client
+	// Timeout of one request
+	Timeout time.Duration
+	// MaxAttempts of a delivery before it fails for good
+	MaxAttempts int
+	// BaseBackoff is the wait after the first failure, it doubles up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// DisableAfter is the number of failed attempts in a row disabling a subscription
+	DisableAfter int
+}
+
+// WebhookDispatcher posts the pending deliveries to the subscribers
+// A delivery succeeds on a 2xx answer, otherwise it is retried with an exponential backoff
+// The subscription is disabled after DisableAfter failures in a row, its pending deliveries then fail
+type WebhookDispatcher struct {
+	subscriptions SubscriptionRepository
+	deliveries    DeliveryRepository
+	opts          WebhookDispatcherOptions
+	logger        *slog.Logger
+	interval      time.Duration
+	now           func() time.Time
+}
+
+func NewWebhookDispatcher(subscriptions SubscriptionRepository, deliveries DeliveryRepository, opts WebhookDispatcherOptions) *WebhookDispatcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultWebhookTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = DefaultWebhookBaseBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+	if opts.DisableAfter <= 0 {
+		opts.DisableAfter = DefaultWebhookDisableAfter
+	}
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	return &WebhookDispatcher{
+		subscriptions: subscriptions,
+		deliveries:    deliveries,
+		opts:          opts,
+		logger:        slog.New(handler),
+		interval:      webhookInterval,
+		now:           time.Now,
+	}
+}
+
+// Run sends the due deliveries until ctx is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.interval):
+		}
+
+		if _, err := d.DispatchDue(ctx); err != nil {
+			d.logger.Error("webhook dispatch failed", "error", err)
+		}
+	}
+}
+
+// DispatchDue sends one batch of due deliveries and returns how many were attempted
+func (d *WebhookDispatcher) DispatchDue(ctx context.Context) (int, error) {
+	// the lease covers the request so a delivery isn't claimed twice while being sent
+	lease := 2 * d.opts.Timeout
+	for i := range webhookBatchSize {
+		delivery, err := d.deliveries.Claim(ctx, d.now(), lease)
+		if errors.Is(err, ErrNotFound) {
+			return i, nil
+		}
+		if err != nil {
+			return i, err
+		}
+		if err := d.deliver(ctx, &delivery); err != nil {
+			return i, err
+		}
+	}
+	return webhookBatchSize, nil
+}
+
+// deliver sends the delivery and records the outcome
+// The returned error is a storage failure, a failed request is recorded on the delivery
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	sub, err := d.subscriptions.Get(ctx, delivery.SubscriptionID)
+	if errors.Is(err, ErrNotFound) {
+		return d.fail(ctx, delivery, "subscription deleted")
+	}
+	if err != nil {
+		return err
+	}
+	if !sub.Enabled {
+		return d.fail(ctx, delivery, "subscription disabled")
+	}
+
+	delivery.Attempts++
+	code, sendErr := d.send(ctx, &sub, delivery)
+	delivery.LastStatusCode = code
+	delivery.UpdatedAt = d.now()
+
+	if sendErr == nil {
+		delivered := d.now()
+		delivery.Status = DeliverySucceeded
+		delivery.DeliveredAt = &delivered
+		delivery.LastError = ""
+		if err := d.deliveries.Update(ctx, delivery); err != nil {
+			return err
+		}
+		return d.subscriptions.RecordSuccess(ctx, sub.ID)
+	}
+
+	delivery.LastError = sendErr.Error()
+	if delivery.Attempts >= d.opts.MaxAttempts {
+		delivery.Status = DeliveryFailed
+	} else {
+		delivery.NextAttemptAt = d.now().Add(d.backoff(delivery.Attempts))
+	}
+	d.logger.Error("webhook delivery failed", "delivery_id", delivery.ID, "subscription_id", sub.ID,
+		"attempt", delivery.Attempts, "status", delivery.Status, "error", sendErr)
+	if err := d.deliveries.Update(ctx, delivery); err != nil {
+		return err
+	}
+
+	sub, err = d.subscriptions.RecordFailure(ctx, sub.ID)
+	if err != nil {
+		return err
+	}
+	if sub.Enabled && sub.ConsecutiveFailures >= d.opts.DisableAfter {
+		if _, err := d.subscriptions.SetEnabled(ctx, sub.ID, false, disabledReason(sub.ConsecutiveFailures)); err != nil {
+			return err
+		}
+		d.logger.Warn("webhook subscription disabled", "subscription_id", sub.ID, "failures", sub.ConsecutiveFailures)
+	}
+	return nil
+}
+
+// send posts the signed payload and returns the status code of the answer
+func (d *WebhookDispatcher) send(ctx context.Context, sub *Subscription, delivery *WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", delivery.ContentType)
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookEventHeader, delivery.EventType)
+	timestamp := d.now()
+	req.Header.Set(WebhookTimestampHeader, fmt.Sprint(timestamp.Unix()))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(sub.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drained so the connection is reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// fail ends a delivery which can't be sent anymore
+func (d *WebhookDispatcher) fail(ctx context.Context, delivery *WebhookDelivery, reason string) error {
+	delivery.Status = DeliveryFailed
+	delivery.LastError = reason
+	delivery.UpdatedAt = d.now()
+	return d.deliveries.Update(ctx, delivery)
+}
+
+// backoff is the wait after the given number of failed attempts
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.opts.BaseBackoff
+	for range attempts - 1 {
+		wait *= 2
+		if wait >= d.opts.MaxBackoff {
+			return d.opts.MaxBackoff
+		}
+	}
+	return wait
+}
@@ -0,0 +1,353 @@
+package user
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSubscriptions is an in memory SubscriptionRepository
+type fakeSubscriptions struct {
+	mu   sync.Mutex
+	subs map[string]Subscription
+}
+
+func newFakeSubscriptions(subs ...Subscription) *fakeSubscriptions {
+	f := &fakeSubscriptions{subs: make(map[string]Subscription)}
+	for _, s := range subs {
+		f.subs[s.ID] = s
+	}
+	return f
+}
+
+func (f *fakeSubscriptions) Create(_ context.Context, s *Subscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[s.ID] = *s
+	return nil
+}
+
+func (f *fakeSubscriptions) Get(_ context.Context, id string) (Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.subs[id]
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return s, nil
+}
+
+func (f *fakeSubscriptions) List(context.Context) ([]Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var subs []Subscription
+	for _, s := range f.subs {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+func (f *fakeSubscriptions) ListEnabled(ctx context.Context, eventType string) ([]Subscription, error) {
+	all, _ := f.List(ctx)
+	var subs []Subscription
+	for _, s := range all {
+		if s.Enabled && s.Accepts(eventType) {
+			subs = append(subs, s)
+		}
+	}
+	return subs, nil
+}
+
+func (f *fakeSubscriptions) Delete(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[id]; !ok {
+		return ErrSubscriptionNotFound
+	}
+	delete(f.subs, id)
+	return nil
+}
+
+func (f *fakeSubscriptions) update(id string, change func(*Subscription)) (Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.subs[id]
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	change(&s)
+	f.subs[id] = s
+	return s, nil
+}
+
+func (f *fakeSubscriptions) SetEnabled(_ context.Context, id string, enabled bool, reason string) (Subscription, error) {
+	return f.update(id, func(s *Subscription) {
+		s.Enabled, s.DisabledReason, s.ConsecutiveFailures = enabled, reason, 0
+	})
+}
+
+func (f *fakeSubscriptions) RecordFailure(_ context.Context, id string) (Subscription, error) {
+	return f.update(id, func(s *Subscription) { s.ConsecutiveFailures++ })
+}
+
+func (f *fakeSubscriptions) RecordSuccess(_ context.Context, id string) error {
+	_, err := f.update(id, func(s *Subscription) { s.ConsecutiveFailures = 0 })
+	return err
+}
+
+// fakeDeliveries is an in memory DeliveryRepository
+type fakeDeliveries struct {
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+func (f *fakeDeliveries) Add(_ context.Context, deliveries []WebhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range deliveries {
+		duplicate := false
+		for _, stored := range f.deliveries {
+			duplicate = duplicate || (stored.SubscriptionID == d.SubscriptionID && stored.EventID == d.EventID)
+		}
+		if !duplicate {
+			f.deliveries = append(f.deliveries, d)
+		}
+	}
+	return nil
+}
+
+func (f *fakeDeliveries) Claim(_ context.Context, now time.Time, lease time.Duration) (WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, d := range f.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			f.deliveries[i].NextAttemptAt = now.Add(lease)
+			return f.deliveries[i], nil
+		}
+	}
+	return WebhookDelivery{}, ErrNotFound
+}
+
+func (f *fakeDeliveries) Update(_ context.Context, d *WebhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.deliveries {
+		if f.deliveries[i].ID == d.ID {
+			f.deliveries[i] = *d
+		}
+	}
+	return nil
+}
+
+func (f *fakeDeliveries) List(_ context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deliveries []WebhookDelivery
+	for i := len(f.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if f.deliveries[i].SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, f.deliveries[i])
+		}
+	}
+	return deliveries, nil
+}
+
+func (f *fakeDeliveries) get(id string) WebhookDelivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return WebhookDelivery{}
+}
+
+func TestSignAndVerifyWebhook(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"id":"event-1"}`)
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	header.Set(WebhookSignatureHeader, SignWebhook("whsec_secret", now, body))
+
+	assert.NoError(t, VerifyWebhook("whsec_secret", header, body, DefaultWebhookTolerance, now))
+	assert.ErrorIs(t, VerifyWebhook("whsec_other", header, body, DefaultWebhookTolerance, now), ErrInvalidWebhookSignature)
+	assert.ErrorIs(t, VerifyWebhook("whsec_secret", header, []byte(`{"id":"event-2"}`), DefaultWebhookTolerance, now),
+		ErrInvalidWebhookSignature, "the body is signed")
+	assert.ErrorIs(t, VerifyWebhook("whsec_secret", header, body, DefaultWebhookTolerance, now.Add(10*time.Minute)),
+		ErrExpiredWebhookSignature, "an old request is a replay")
+
+	// the timestamp is signed too, a replay can't refresh it
+	header.Set(WebhookTimestampHeader, strconv.FormatInt(now.Add(10*time.Minute).Unix(), 10))
+	assert.ErrorIs(t, VerifyWebhook("whsec_secret", header, body, DefaultWebhookTolerance, now.Add(10*time.Minute)),
+		ErrInvalidWebhookSignature)
+}
+
+func TestWebhookNotifierQueuesDeliveries(t *testing.T) {
+	subs := newFakeSubscriptions(
+		Subscription{ID: "all", Enabled: true},
+		Subscription{ID: "created", Enabled: true, EventTypes: []string{UserCreatedRoutingKey}},
+		Subscription{ID: "disabled", Enabled: false},
+	)
+	deliveries := &fakeDeliveries{}
+	notifier := NewWebhookNotifier(subs, deliveries, "/test")
+	ctx := context.Background()
+
+	created := NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "u1", Password: "hash"}).Event()
+	require.NoError(t, notifier.UserCreatedEvent(ctx, created))
+	require.NoError(t, notifier.UserCreatedEvent(ctx, created), "a relayed twice event is queued once")
+	require.NoError(t, notifier.UserDeletedEvent(ctx, NewOutboxEvent(UserDeletedRoutingKey, &User{ID: "u1"}).Event()))
+
+	var queued []string
+	for _, d := range deliveries.deliveries {
+		queued = append(queued, d.SubscriptionID+" "+d.EventType)
+		assert.Equal(t, DeliveryPending, d.Status)
+		assert.Equal(t, "application/cloudevents+json", d.ContentType)
+		assert.NotContains(t, string(d.Payload), "hash")
+	}
+	assert.ElementsMatch(t, []string{"all user.created", "created user.created", "all user.deleted"}, queued)
+}
+
+// newDispatcherTest returns a dispatcher posting one queued delivery to handler
+func newDispatcherTest(t *testing.T, handler http.HandlerFunc, opts WebhookDispatcherOptions) (*WebhookDispatcher, *fakeSubscriptions, *fakeDeliveries, *time.Time) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	subs := newFakeSubscriptions(Subscription{ID: "sub", URL: server.URL, Secret: "whsec_secret", Enabled: true})
+	deliveries := &fakeDeliveries{}
+	event := NewOutboxEvent(UserCreatedRoutingKey, &User{ID: "u1"}).Event()
+	require.NoError(t, NewWebhookNotifier(subs, deliveries, "/test").UserCreatedEvent(context.Background(), event))
+
+	now := time.Now()
+	d := NewWebhookDispatcher(subs, deliveries, opts)
+	d.now = func() time.Time { return now }
+	return d, subs, deliveries, &now
+}
+
+func TestWebhookDispatcherDelivers(t *testing.T) {
+	var received http.Header
+	d, subs, deliveries, _ := newDispatcherTest(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = r.Header
+		if err := VerifyWebhook("whsec_secret", r.Header, body, DefaultWebhookTolerance, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}, WebhookDispatcherOptions{})
+	_, _ = subs.RecordFailure(context.Background(), "sub")
+
+	sent, err := d.DispatchDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	delivery := deliveries.deliveries[0]
+	assert.Equal(t, DeliverySucceeded, delivery.Status)
+	assert.Equal(t, http.StatusNoContent, delivery.LastStatusCode)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.NotNil(t, delivery.DeliveredAt)
+	assert.Equal(t, delivery.ID, received.Get(WebhookIDHeader))
+	assert.Equal(t, UserCreatedRoutingKey, received.Get(WebhookEventHeader))
+
+	sub, _ := subs.Get(context.Background(), "sub")
+	assert.Zero(t, sub.ConsecutiveFailures, "a success resets the failures")
+
+	sent, err = d.DispatchDue(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, sent, "a delivered event is not sent again")
+}
+
+func TestWebhookDispatcherRetriesWithBackoff(t *testing.T) {
+	calls := 0
+	d, _, deliveries, now := newDispatcherTest(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, WebhookDispatcherOptions{MaxAttempts: 3, BaseBackoff: time.Minute})
+	ctx := context.Background()
+
+	_, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	delivery := deliveries.deliveries[0]
+	assert.Equal(t, DeliveryPending, delivery.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	assert.Contains(t, delivery.LastError, "503")
+	assert.Equal(t, now.Add(time.Minute), delivery.NextAttemptAt)
+
+	sent, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, sent, "not due before the backoff")
+
+	*now = now.Add(time.Minute)
+	_, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(2*time.Minute), deliveries.get(delivery.ID).NextAttemptAt, "the backoff doubles")
+
+	*now = now.Add(2 * time.Minute)
+	_, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, DeliveryFailed, deliveries.get(delivery.ID).Status, "fails for good after the max attempts")
+	assert.Equal(t, 3, calls)
+}
+
+func TestWebhookDispatcherDisablesFailingEndpoints(t *testing.T) {
+	d, subs, deliveries, now := newDispatcherTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}, WebhookDispatcherOptions{BaseBackoff: time.Second, DisableAfter: 2})
+	ctx := context.Background()
+	notifier := NewWebhookNotifier(subs, deliveries, "/test")
+
+	_, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	*now = now.Add(time.Second)
+	_, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+
+	sub, _ := subs.Get(ctx, "sub")
+	assert.False(t, sub.Enabled)
+	assert.Equal(t, "disabled after 2 failed deliveries in a row", sub.DisabledReason)
+
+	*now = now.Add(time.Hour)
+	_, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+	delivery := deliveries.deliveries[0]
+	assert.Equal(t, DeliveryFailed, delivery.Status)
+	assert.Equal(t, "subscription disabled", delivery.LastError)
+	assert.Equal(t, 2, delivery.Attempts)
+
+	require.NoError(t, notifier.UserUpdatedEvent(ctx, NewOutboxEvent(UserUpdatedRoutingKey, &User{ID: "u1"}).Event()))
+	assert.Len(t, deliveries.deliveries, 1, "a disabled endpoint receives no new event")
+}
+
+func TestWebhookServiceCreateSubscription(t *testing.T) {
+	svc := NewWebhookService(newFakeSubscriptions(), &fakeDeliveries{})
+	ctx := context.Background()
+
+	_, err := svc.CreateSubscription(ctx, "ftp://partner.example", nil)
+	assert.ErrorIs(t, err, ErrInvalidWebhookURL)
+	_, err = svc.CreateSubscription(ctx, "https://partner.example/hook", []string{"user.renamed"})
+	assert.ErrorIs(t, err, ErrUnknownEventType)
+
+	sub, err := svc.CreateSubscription(ctx, "https://partner.example/hook", []string{UserCreatedRoutingKey})
+	require.NoError(t, err)
+	assert.True(t, sub.Enabled)
+	assert.True(t, strings.HasPrefix(sub.Secret, "whsec_"))
+	assert.Len(t, sub.Secret, len("whsec_")+2*webhookSecretSize)
+
+	sub, err = svc.SetSubscriptionEnabled(ctx, sub.ID, false)
+	require.NoError(t, err)
+	assert.False(t, sub.Enabled)
+
+	_, err = svc.ListDeliveries(ctx, "unknown", 10)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
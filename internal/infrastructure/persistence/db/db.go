@@ -7,6 +7,7 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"net"
 	"time"
 )
 
@@ -17,8 +18,11 @@ type DB struct {
 // NewDb handle connection to database and to collection directly since
 // we only manage user entity
 func NewDb(config config.Config) (DB, error) {
-	client, err := mongo.Connect(options.Client().
-		ApplyURI(fmt.Sprintf("mongodb://%s:%s", config.DbHost, config.DbPort)))
+	opts, err := clientOptions(config)
+	if err != nil {
+		return DB{}, err
+	}
+	client, err := mongo.Connect(opts)
 	if err != nil {
 		return DB{}, err
 	}
@@ -37,3 +41,40 @@ func NewDb(config config.Config) (DB, error) {
 		DB: client,
 	}, nil
 }
+
+// clientOptions connects with the complete URI when configured
+// Otherwise we connect directly to the given host: mongo runs as a single node replica set
+// to support transactions and its member address may not resolve from the client
+// With a replica set name the host is a seed and the members are discovered
+// Every command is timed for the metrics
+func clientOptions(config config.Config) (*options.ClientOptions, error) {
+	opts := options.Client()
+	if config.MongoURI != "" {
+		opts.ApplyURI(config.MongoURI)
+	} else {
+		opts.ApplyURI("mongodb://" + net.JoinHostPort(config.DbHost, config.DbPort))
+		if config.DbReplicaSet != "" {
+			opts.SetReplicaSet(config.DbReplicaSet)
+		} else {
+			opts.SetDirect(true)
+		}
+		if config.DbUsername != "" {
+			opts.SetAuth(options.Credential{
+				Username:   config.DbUsername,
+				Password:   config.DbPassword,
+				AuthSource: config.DbAuthSource,
+			})
+		}
+	}
+
+	opts.SetMonitor(commandMonitor)
+
+	if config.DbTLS.Enabled {
+		tlsConfig, err := config.DbTLS.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("mongo tls: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, opts.Validate()
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/v2/event"
+)
+
+var commandSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "mongodb_command_duration_seconds",
+	Help:    "Time the MongoDB commands took, by command name and outcome",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+}, []string{"command", "outcome"})
+
+// Collectors are the metrics of the MongoDB client, registered by the metrics server
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{commandSeconds}
+}
+
+// commandMonitor times every command the driver sends
+var commandMonitor = &event.CommandMonitor{
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		commandSeconds.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		commandSeconds.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+	},
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"github.com/dylan-dinh/esl-test/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestClientOptions test the mongo options built from the config
+func TestClientOptions(t *testing.T) {
+	t.Run("single node", func(t *testing.T) {
+		opts, err := clientOptions(config.Config{DbHost: "mongodb", DbPort: "27017"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mongodb:27017"}, opts.Hosts)
+		require.NotNil(t, opts.Direct)
+		assert.True(t, *opts.Direct)
+		assert.Nil(t, opts.Auth)
+		assert.Nil(t, opts.TLSConfig)
+	})
+
+	t.Run("replica set with credentials", func(t *testing.T) {
+		opts, err := clientOptions(config.Config{
+			DbHost: "mongo-0.mongo", DbPort: "27017", DbReplicaSet: "rs0",
+			DbUsername: "users", DbPassword: "secret", DbAuthSource: "admin",
+			DbTLS: config.TLS{Enabled: true},
+		})
+		require.NoError(t, err)
+		assert.Nil(t, opts.Direct, "members are discovered")
+		require.NotNil(t, opts.ReplicaSet)
+		assert.Equal(t, "rs0", *opts.ReplicaSet)
+		require.NotNil(t, opts.Auth)
+		assert.Equal(t, "users", opts.Auth.Username)
+		assert.Equal(t, "secret", opts.Auth.Password)
+		assert.Equal(t, "admin", opts.Auth.AuthSource)
+		assert.NotNil(t, opts.TLSConfig)
+	})
+
+	t.Run("complete uri", func(t *testing.T) {
+		opts, err := clientOptions(config.Config{MongoURI: "mongodb://svc:secret@a:27017,b:27017/?replicaSet=rs0&authSource=users"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a:27017", "b:27017"}, opts.Hosts)
+		assert.Equal(t, "rs0", *opts.ReplicaSet)
+		assert.Equal(t, "svc", opts.Auth.Username)
+		assert.Equal(t, "users", opts.Auth.AuthSource)
+	})
+
+	t.Run("invalid uri", func(t *testing.T) {
+		_, err := clientOptions(config.Config{MongoURI: "mongodb://a/?replicaSet=rs0&directConnection=true&connect=bogus"})
+		assert.Error(t, err)
+	})
+
+	t.Run("missing CA file", func(t *testing.T) {
+		_, err := clientOptions(config.Config{DbHost: "mongodb", DbPort: "27017", DbTLS: config.TLS{Enabled: true, CAFile: "/nope/ca.pem"}})
+		assert.ErrorContains(t, err, "mongo tls")
+	})
+}
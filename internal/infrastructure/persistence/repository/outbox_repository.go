@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	outboxCollectionName = "outbox"
+	// sentEventRetention is how long sent events are kept before mongo removes them
+	sentEventRetention = 7 * 24 * time.Hour
+)
+
+// OutboxRepository concrete implementation of user.Outbox
+type OutboxRepository struct {
+	coll   *mongo.Collection
+	logger *slog.Logger
+}
+
+// NewOutboxRepository create an instance of OutboxRepository
+func NewOutboxRepository(conn *mongo.Client, dbName string) (*OutboxRepository, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	coll := conn.Database(dbName).Collection(outboxCollectionName)
+
+	indexes := []mongo.IndexModel{
+		// serves the pending query of the relay
+		{Keys: bson.D{{Key: "sent_at", Value: 1}, {Key: "parked_at", Value: 1}, {Key: "created_at", Value: 1}}},
+		// documents without sent_at are never expired
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(sentEventRetention.Seconds())),
+		},
+	}
+	if _, err := coll.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		logger.Error("error creating index ", "error", err.Error())
+		return nil, err
+	}
+	logger.Info("indexes on outbox created")
+
+	return &OutboxRepository{
+		coll:   coll,
+		logger: logger,
+	}, nil
+}
+
+// Add an event to the outbox
+// Called with a transaction ctx it is committed along the user change
+func (r *OutboxRepository) Add(ctx context.Context, e *user.OutboxEvent) error {
+	_, err := r.coll.InsertOne(ctx, e)
+	return err
+}
+
+// pendingFilter matches the events neither sent nor parked
+var pendingFilter = bson.D{{Key: "sent_at", Value: nil}, {Key: "parked_at", Value: nil}}
+
+// Pending returns up to limit events neither sent nor parked, oldest first
+func (r *OutboxRepository) Pending(ctx context.Context, limit int) ([]user.OutboxEvent, error) {
+	filter := pendingFilter
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []user.OutboxEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// CountPending returns how many events are neither sent nor parked
+func (r *OutboxRepository) CountPending(ctx context.Context) (int64, error) {
+	return r.coll.CountDocuments(ctx, pendingFilter)
+}
+
+// MarkSent flags the event as published
+func (r *OutboxRepository) MarkSent(ctx context.Context, id string) error {
+	filter := bson.D{{Key: "id", Value: id}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "sent_at", Value: time.Now()}}}}
+	_, err := r.coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// MarkFailed records a failed attempt to publish the event
+func (r *OutboxRepository) MarkFailed(ctx context.Context, id string, cause error) error {
+	filter := bson.D{{Key: "id", Value: id}}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		{Key: "$set", Value: bson.D{{Key: "last_error", Value: cause.Error()}}},
+	}
+	_, err := r.coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Park records the last failed attempt and stops publishing the event
+// Parked events are kept for inspection and can be replayed by unsetting parked_at
+func (r *OutboxRepository) Park(ctx context.Context, id string, cause error) error {
+	filter := bson.D{{Key: "id", Value: id}}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		{Key: "$set", Value: bson.D{
+			{Key: "last_error", Value: cause.Error()},
+			{Key: "parked_at", Value: time.Now()},
+		}},
+	}
+	_, err := r.coll.UpdateOne(ctx, filter, update)
+	return err
+}
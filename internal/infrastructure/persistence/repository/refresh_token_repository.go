@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const refreshTokenCollectionName = "refresh_tokens"
+
+// RefreshTokenRepository concrete implementation of user.RefreshTokenRepository
+type RefreshTokenRepository struct {
+	coll   *mongo.Collection
+	logger *slog.Logger
+}
+
+// NewRefreshTokenRepository create an instance of RefreshTokenRepository
+func NewRefreshTokenRepository(conn *mongo.Client, dbName string) (*RefreshTokenRepository, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	coll := conn.Database(dbName).Collection(refreshTokenCollectionName)
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// serves the revocation of every token of a user
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		// mongo removes the tokens once expired
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+	if _, err := coll.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		logger.Error("error creating index ", "error", err.Error())
+		return nil, err
+	}
+	logger.Info("indexes on refresh_tokens created")
+
+	return &RefreshTokenRepository{
+		coll:   coll,
+		logger: logger,
+	}, nil
+}
+
+// Create a refresh token in DB
+func (r *RefreshTokenRepository) Create(ctx context.Context, t *user.RefreshToken) error {
+	_, err := r.coll.InsertOne(ctx, t)
+	return err
+}
+
+// Revoke an active refresh token by its hash and returns it
+// The filter on revoked_at makes sure a token is only revoked once
+// even when used concurrently
+func (r *RefreshTokenRepository) Revoke(ctx context.Context, id string) (user.RefreshToken, error) {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "revoked_at", Value: nil},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: now}}}}
+
+	var token user.RefreshToken
+	err := r.coll.FindOneAndUpdate(ctx, filter, update).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.RefreshToken{}, user.ErrNotFound
+	}
+	if err != nil {
+		return user.RefreshToken{}, err
+	}
+
+	r.logger.Info("refresh token revoked", "user_id", token.UserID)
+	return token, nil
+}
+
+// RevokeAll revokes every active refresh token of the user
+func (r *RefreshTokenRepository) RevokeAll(ctx context.Context, userID string) error {
+	filter := bson.D{{Key: "user_id", Value: userID}, {Key: "revoked_at", Value: nil}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}}
+	res, err := r.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Info("refresh tokens revoked", "user_id", userID, "tokens", res.ModifiedCount)
+	return nil
+}
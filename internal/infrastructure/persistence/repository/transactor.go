@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Transactor concrete implementation of user.Transactor using mongo sessions
+// Transactions need mongo to run as a replica set, even a single node one
+type Transactor struct {
+	client *mongo.Client
+}
+
+// NewTransactor create an instance of Transactor
+func NewTransactor(client *mongo.Client) *Transactor {
+	return &Transactor{client: client}
+}
+
+// WithTransaction runs fn in a transaction, retried by the driver on transient errors
+// fn must use the ctx it receives so its operations belong to the session
+func (t *Transactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
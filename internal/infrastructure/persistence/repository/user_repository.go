@@ -9,6 +9,9 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"log/slog"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
 const collectionName = "users"
@@ -24,20 +27,46 @@ func NewUserRepository(conn *mongo.Client, dbName string) (*UserRepository, erro
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	coll := conn.Database(dbName).Collection(collectionName)
 
-	constraint := mongo.IndexModel{
-		Keys:    bson.D{{Key: "email", Value: 1}},
-		Options: options.Index().SetUnique(true),
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// serves the listing of users by role
+		{Keys: bson.D{{Key: "roles", Value: 1}}},
+		// serves the purge of deleted users
+		{Keys: bson.D{{Key: "deleted_at", Value: 1}}},
+		// serve the listing orders and their cursor, in both directions
+		{Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "updated_at", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "last_name", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "nickname", Value: 1}, {Key: "id", Value: 1}}},
+		// serve the listing of users by country, the nickname is read from the index
+		{Keys: bson.D{{Key: "country", Value: 1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}, {Key: "nickname", Value: 1}}},
+		{Keys: bson.D{{Key: "country", Value: 1}, {Key: "nickname", Value: 1}, {Key: "id", Value: 1}}},
 	}
 
 	// Create index commands will not recreate existing indexes
 	// and instead return success so it's safe to call it even though the
 	// index already exists
-	_, err := coll.Indexes().CreateOne(context.Background(), constraint)
+	_, err := coll.Indexes().CreateMany(context.Background(), indexes)
 	if err != nil {
 		logger.Error("error creating index ", "error", err.Error())
 		return nil, err
 	}
-	logger.Info("unicity on users.email created")
+	logger.Info("unicity on users.email and listing indexes on users created")
+
+	// users created before the versions have none, the writes would never match them
+	res, err := coll.UpdateMany(context.Background(),
+		bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "version", Value: int64(1)}}}})
+	if err != nil {
+		logger.Error("error backfilling the user versions", "error", err.Error())
+		return nil, err
+	}
+	if res.ModifiedCount > 0 {
+		logger.Info("user versions backfilled", "users", res.ModifiedCount)
+	}
 
 	return &UserRepository{
 		coll:   coll,
@@ -49,6 +78,10 @@ func NewUserRepository(conn *mongo.Client, dbName string) (*UserRepository, erro
 func (r *UserRepository) Create(ctx context.Context, u *user.User) error {
 	_, err := r.coll.InsertOne(ctx, &u)
 	if err != nil {
+		// the unique index on email is the last guard against concurrent creations
+		if mongo.IsDuplicateKeyError(err) {
+			return user.ErrEmailExists
+		}
 		return err
 	}
 
@@ -57,62 +90,164 @@ func (r *UserRepository) Create(ctx context.Context, u *user.User) error {
 	return nil
 }
 
-// Update a user in DB filtering by UUID
-func (r *UserRepository) Update(ctx context.Context, u *user.User) error {
-	filter := bson.D{{"id", u.ID}}
-	update := bson.D{{
-		"$set", bson.D{
-			{"first_name", u.FirstName},
-			{"last_name", u.LastName},
-			{"nickname", u.Nickname},
-			{"email", u.Email},
-			{"country", u.Country},
-			{"password", u.Password},
-			{"updated_at", u.UpdatedAt},
-		},
-	}}
-	res := r.coll.FindOneAndUpdate(ctx, filter, update)
-	if res.Err() != nil {
-		if errors.Is(res.Err(), mongo.ErrNoDocuments) {
-			r.logger.Error("user not found", "id", u.ID)
-			return res.Err()
+// Update the given fields of a user in DB filtering by UUID
+// and by u.Version
+// The version is incremented, the document before the update is returned
+// and the updated user is loaded into u
+func (r *UserRepository) Update(ctx context.Context, u *user.User, fields []string) (user.User, error) {
+	values := map[string]string{
+		user.FieldFirstName: u.FirstName,
+		user.FieldLastName:  u.LastName,
+		user.FieldNickname:  u.Nickname,
+		user.FieldEmail:     u.Email,
+		user.FieldCountry:   u.Country,
+		user.FieldPassword:  u.Password,
+	}
+	set := bson.D{{Key: "updated_at", Value: u.UpdatedAt}}
+	for _, field := range fields {
+		set = append(set, bson.E{Key: field, Value: values[field]})
+	}
+
+	filter := versionFilter(u.ID, u.Version)
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	// the old document is returned, the new one is the old one with the update applied
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	res := r.coll.FindOneAndUpdate(ctx, filter, update, opts)
+	if err := res.Err(); err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return user.User{}, r.notFoundOrConflict(ctx, u.ID)
+		case mongo.IsDuplicateKeyError(err):
+			return user.User{}, user.ErrEmailExists
+		default:
+			return user.User{}, err
 		}
 	}
-	r.logger.Info("user modified successfully", "id", u.ID)
-	return nil
+	var before user.User
+	if err := res.Decode(&before); err != nil {
+		r.logger.Error("couldn't decode result from mongo")
+		return user.User{}, err
+	}
+
+	after := before
+	after.ApplyFields(u, fields)
+	after.Version++
+	// mongo stores times in UTC with a millisecond precision
+	after.UpdatedAt = u.UpdatedAt.Truncate(time.Millisecond).UTC()
+	*u = after
+
+	r.logger.Info("user modified successfully", "id", u.ID, "fields", fields)
+	return before, nil
 }
 
-// DeleteByID deletes a user by UUID
-func (r *UserRepository) DeleteByID(ctx context.Context, id string) error {
-	filter := bson.D{{"id", id}}
+// SoftDelete marks a user as deleted filtering by UUID and version
+// The version is incremented and the deleted user returned without its password
+func (r *UserRepository) SoftDelete(ctx context.Context, id string, version int64) (user.User, error) {
+	now := time.Now()
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deleted_at", Value: now}, {Key: "updated_at", Value: now}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{Key: "password", Value: 0}})
 
-	res, err := r.coll.DeleteOne(ctx, filter)
+	var deleted user.User
+	err := r.coll.FindOneAndUpdate(ctx, versionFilter(id, version), update, opts).Decode(&deleted)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.User{}, r.notFoundOrConflict(ctx, id)
+	}
 	if err != nil {
 		r.logger.Error("error deleting user", "id", id, "error", err)
-		return err
+		return user.User{}, err
 	}
 
-	if res.DeletedCount == 0 {
-		r.logger.Error("user not found", "id", id)
-		return mongo.ErrNoDocuments
+	r.logger.Info("user deleted", "id", id)
+	return deleted, nil
+}
+
+// Restore a soft deleted user by UUID
+// The version is incremented and the restored user returned without its password
+func (r *UserRepository) Restore(ctx context.Context, id string) (user.User, error) {
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deleted_at", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	update := bson.D{
+		{Key: "$unset", Value: bson.D{{Key: "deleted_at", Value: ""}}},
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
 	}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{Key: "password", Value: 0}})
 
-	r.logger.Info("user deleted", "id", id)
-	return nil
+	var restored user.User
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&restored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.User{}, r.notFoundOrNotDeleted(ctx, id)
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+
+	r.logger.Info("user restored", "id", id)
+	return restored, nil
+}
+
+// Purge permanently deletes a soft deleted user by UUID
+// The deleted user is returned without its password
+func (r *UserRepository) Purge(ctx context.Context, id string) (user.User, error) {
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deleted_at", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	opts := options.FindOneAndDelete().SetProjection(bson.D{{Key: "password", Value: 0}})
+
+	var purged user.User
+	err := r.coll.FindOneAndDelete(ctx, filter, opts).Decode(&purged)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.User{}, r.notFoundOrNotDeleted(ctx, id)
+	}
+	if err != nil {
+		r.logger.Error("error purging user", "id", id, "error", err)
+		return user.User{}, err
+	}
+
+	r.logger.Info("user purged", "id", id)
+	return purged, nil
+}
+
+// ListDeletedBefore returns up to limit users soft deleted before the given time, oldest first
+func (r *UserRepository) ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]user.User, error) {
+	filter := bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$lt", Value: before}}}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deleted_at", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.D{{Key: "password", Value: 0}})
+
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []user.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
 // GetByID get user by UUID
 func (r *UserRepository) GetByID(ctx context.Context, id string) (user.User, error) {
-	filter := bson.D{{"id", id}}
+	filter := liveFilter(id)
 
-	opts := options.FindOne().SetProjection(bson.D{{"password", 0}})
+	opts := options.FindOne().SetProjection(bson.D{{Key: "password", Value: 0}})
 
 	res := r.coll.FindOne(ctx, filter, opts)
-	if res.Err() != nil {
-		if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			r.logger.Error("user not found", "id", id)
-			return user.User{}, res.Err()
+			return user.User{}, user.ErrNotFound
 		}
+		return user.User{}, err
 	}
 
 	var getUser user.User
@@ -126,44 +261,160 @@ func (r *UserRepository) GetByID(ctx context.Context, id string) (user.User, err
 
 }
 
-// List users using first_name, last_name and country filter
-// Pagination is also available
-// We count documents and return the result as well
-func (r *UserRepository) List(ctx context.Context, filter *user.UserFilter) ([]user.User, int64, error) {
-	query := bson.D{}
+// Count returns the number of users not deleted, for the metrics
+func (r *UserRepository) Count(ctx context.Context) (int64, error) {
+	return r.coll.CountDocuments(ctx, bson.D{{Key: "deleted_at", Value: nil}})
+}
+
+// List users matching the filter, see user.UserFilter
+// Users are ordered by filter.SortBy then id, pages resume after filter.After
+// or skip to filter.Page in legacy mode
+// The matching users are only counted without filter.After: the prefix filters
+// can't use an index so counting scans the collection, the first page pays it once
+func (r *UserRepository) List(ctx context.Context, filter *user.UserFilter) (user.UserPage, error) {
+	query := listQuery(filter)
+
+	var total int64
+	if filter.After == nil {
+		var err error
+		if total, err = r.coll.CountDocuments(ctx, query); err != nil {
+			return user.UserPage{}, err
+		}
+	}
+
+	sortBy, direction := filter.SortBy, 1
+	if sortBy == "" {
+		sortBy = user.SortCreatedAt
+	}
+	if filter.Desc {
+		direction = -1
+	}
+
+	// one more user than the page size tells if there is a next page
+	opts := options.Find().
+		SetSort(bson.D{{Key: sortBy, Value: direction}, {Key: "id", Value: direction}}).
+		SetLimit(int64(filter.PageSize) + 1).
+		SetProjection(bson.D{{Key: "password", Value: 0}})
+
+	switch {
+	case filter.After != nil:
+		query = append(query, afterCursor(filter.After, sortBy, filter.Desc))
+	case filter.Page > 0:
+		// legacy mode, slow on large collections and unstable under inserts
+		opts.SetSkip(int64(filter.Page-1) * int64(filter.PageSize))
+	}
+
+	cursor, err := r.coll.Find(ctx, query, opts)
+	if err != nil {
+		return user.UserPage{}, err
+	}
+	var users []user.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return user.UserPage{}, err
+	}
+
+	page := user.UserPage{Users: users, Total: total}
+	if len(users) > int(filter.PageSize) {
+		page.Users = users[:filter.PageSize]
+		page.NextPageToken = user.EncodeCursor(&page.Users[filter.PageSize-1], sortBy, filter.Desc)
+	}
+	return page, nil
+}
+
+// listQuery translates the filter of live users
+func listQuery(filter *user.UserFilter) bson.D {
+	query := bson.D{{Key: "deleted_at", Value: nil}}
 	if filter.FirstName != "" {
 		query = append(query, bson.E{Key: "first_name", Value: filter.FirstName})
 	}
 	if filter.LastName != "" {
 		query = append(query, bson.E{Key: "last_name", Value: filter.LastName})
 	}
+	if filter.Role != "" {
+		// matches users having the role among others
+		query = append(query, bson.E{Key: "roles", Value: filter.Role})
+	}
+
+	countries := filter.Countries
 	if filter.Country != "" {
-		query = append(query, bson.E{Key: "country", Value: filter.Country})
+		countries = append([]string{filter.Country}, countries...)
+	}
+	if len(countries) > 0 {
+		query = append(query, bson.E{Key: "country", Value: bson.D{{Key: "$in", Value: countries}}})
 	}
 
-	total, err := r.coll.CountDocuments(ctx, query)
-	if err != nil {
-		return nil, 0, err
+	prefixes := []struct{ field, prefix string }{
+		{"first_name", filter.FirstNamePrefix},
+		{"last_name", filter.LastNamePrefix},
+		{"nickname", filter.NicknamePrefix},
+	}
+	for _, p := range prefixes {
+		if p.prefix != "" {
+			query = append(query, bson.E{Key: p.field, Value: bson.Regex{Pattern: "^" + regexp.QuoteMeta(p.prefix), Options: "i"}})
+		}
+	}
+	if filter.EmailDomain != "" {
+		domain := strings.TrimPrefix(filter.EmailDomain, "@")
+		query = append(query, bson.E{Key: "email", Value: bson.Regex{Pattern: "@" + regexp.QuoteMeta(domain) + "$", Options: "i"}})
 	}
 
-	skip := int64((filter.Page - 1) * filter.PageSize)
-	limit := int64(filter.PageSize)
-	opts := options.Find().SetSkip(skip).SetLimit(limit)
+	if r := timeRange(filter.CreatedAfter, filter.CreatedBefore); r != nil {
+		query = append(query, bson.E{Key: "created_at", Value: r})
+	}
+	if r := timeRange(filter.UpdatedAfter, filter.UpdatedBefore); r != nil {
+		query = append(query, bson.E{Key: "updated_at", Value: r})
+	}
+	return query
+}
 
-	cursor, err := r.coll.Find(ctx, query, opts)
-	if err != nil {
-		return nil, 0, err
+// timeRange matches times from after included to before excluded, a zero bound is open
+func timeRange(after, before time.Time) bson.D {
+	var r bson.D
+	if !after.IsZero() {
+		r = append(r, bson.E{Key: "$gte", Value: after})
 	}
-	var users []user.User
-	if err := cursor.All(ctx, &users); err != nil {
-		return nil, 0, err
+	if !before.IsZero() {
+		r = append(r, bson.E{Key: "$lt", Value: before})
+	}
+	return r
+}
+
+// afterCursor matches the users coming after the cursor in the listing order
+func afterCursor(c *user.Cursor, sortBy string, desc bool) bson.E {
+	op := "$gt"
+	if desc {
+		op = "$lt"
 	}
-	return users, total, nil
+	return bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: sortBy, Value: bson.D{{Key: op, Value: c.Value()}}}},
+		bson.D{
+			{Key: sortBy, Value: c.Value()},
+			{Key: "id", Value: bson.D{{Key: op, Value: c.ID}}},
+		},
+	}}
+}
+
+// GetByEmail get user by email, including its password hash
+func (r *UserRepository) GetByEmail(ctx context.Context, email string) (user.User, error) {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "deleted_at", Value: nil}}
+
+	var getUser user.User
+	err := r.coll.FindOne(ctx, filter).Decode(&getUser)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.User{}, user.ErrNotFound
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+
+	return getUser, nil
 }
 
 // ExistsByEmail check if a user exists by its email
+// The email of a soft deleted user stays reserved by the unique index until it is purged
+// so it can still be restored
 func (r *UserRepository) ExistsByEmail(ctx context.Context, email string) (bool, error) {
-	filter := bson.D{{Key: "email", Value: email}}
+	filter := bson.D{{Key: "email", Value: email}, {Key: "deleted_at", Value: nil}}
 	err := r.coll.FindOne(ctx, filter).Err()
 
 	switch {
@@ -175,3 +426,89 @@ func (r *UserRepository) ExistsByEmail(ctx context.Context, email string) (bool,
 		return true, nil
 	}
 }
+
+// AddRole adds the role to the user, granting it twice has no effect
+func (r *UserRepository) AddRole(ctx context.Context, id, role string) (user.User, error) {
+	update := bson.D{
+		{Key: "$addToSet", Value: bson.D{{Key: "roles", Value: role}}},
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	return r.updateRoles(ctx, id, update)
+}
+
+// RemoveRole removes the role from the user
+func (r *UserRepository) RemoveRole(ctx context.Context, id, role string) (user.User, error) {
+	update := bson.D{
+		{Key: "$pull", Value: bson.D{{Key: "roles", Value: role}}},
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	return r.updateRoles(ctx, id, update)
+}
+
+// updateRoles applies the update and returns the updated user without its password
+func (r *UserRepository) updateRoles(ctx context.Context, id string, update bson.D) (user.User, error) {
+	filter := liveFilter(id)
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{Key: "password", Value: 0}})
+
+	var updated user.User
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		r.logger.Error("user not found", "id", id)
+		return user.User{}, user.ErrNotFound
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+
+	r.logger.Info("user roles modified", "id", id, "roles", updated.Roles)
+	return updated, nil
+}
+
+// liveFilter matches the user by UUID unless it is soft deleted
+// A null filter also matches documents without deleted_at
+func liveFilter(id string) bson.D {
+	return bson.D{{Key: "id", Value: id}, {Key: "deleted_at", Value: nil}}
+}
+
+// versionFilter matches the live user by UUID and version
+// Versions start at 1 so 0 never matches and the write fails with a conflict
+func versionFilter(id string, version int64) bson.D {
+	return append(liveFilter(id), bson.E{Key: "version", Value: version})
+}
+
+// notFoundOrConflict tells why a write matched no document:
+// either the user doesn't exist or it has another version than expected
+func (r *UserRepository) notFoundOrConflict(ctx context.Context, id string) error {
+	opts := options.FindOne().SetProjection(bson.D{{Key: "version", Value: 1}})
+
+	var current user.User
+	err := r.coll.FindOne(ctx, liveFilter(id), opts).Decode(&current)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		r.logger.Error("user not found", "id", id)
+		return user.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	r.logger.Info("user version conflict", "id", id, "current_version", current.Version)
+	return &user.VersionConflictError{Current: current.Version}
+}
+
+// notFoundOrNotDeleted tells why a write on a soft deleted user matched no document:
+// either the user doesn't exist or it isn't deleted
+func (r *UserRepository) notFoundOrNotDeleted(ctx context.Context, id string) error {
+	err := r.coll.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		r.logger.Error("user not found", "id", id)
+		return user.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return user.ErrNotDeleted
+}
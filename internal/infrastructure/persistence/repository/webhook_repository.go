@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	subscriptionCollectionName = "webhook_subscriptions"
+	deliveryCollectionName     = "webhook_deliveries"
+	// deliveryLogRetention is how long the finished deliveries are kept in the log
+	deliveryLogRetention = 30 * 24 * time.Hour
+)
+
+// SubscriptionRepository concrete implementation of user.SubscriptionRepository
+type SubscriptionRepository struct {
+	coll   *mongo.Collection
+	logger *slog.Logger
+}
+
+// NewSubscriptionRepository create an instance of SubscriptionRepository
+func NewSubscriptionRepository(conn *mongo.Client, dbName string) (*SubscriptionRepository, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	coll := conn.Database(dbName).Collection(subscriptionCollectionName)
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// serves the subscribers lookup of each event
+		{Keys: bson.D{{Key: "enabled", Value: 1}, {Key: "event_types", Value: 1}}},
+	}
+	if _, err := coll.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		logger.Error("error creating index ", "error", err.Error())
+		return nil, err
+	}
+	logger.Info("indexes on webhook_subscriptions created")
+
+	return &SubscriptionRepository{
+		coll:   coll,
+		logger: logger,
+	}, nil
+}
+
+// Create a subscription in DB
+func (r *SubscriptionRepository) Create(ctx context.Context, s *user.Subscription) error {
+	_, err := r.coll.InsertOne(ctx, s)
+	return err
+}
+
+// Get a subscription by its id
+func (r *SubscriptionRepository) Get(ctx context.Context, id string) (user.Subscription, error) {
+	var s user.Subscription
+	err := r.coll.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.Subscription{}, user.ErrSubscriptionNotFound
+	}
+	return s, err
+}
+
+// List every subscription, oldest first
+func (r *SubscriptionRepository) List(ctx context.Context) ([]user.Subscription, error) {
+	return r.find(ctx, bson.D{})
+}
+
+// ListEnabled returns the enabled subscriptions of the event type or of every event
+func (r *SubscriptionRepository) ListEnabled(ctx context.Context, eventType string) ([]user.Subscription, error) {
+	filter := bson.D{
+		{Key: "enabled", Value: true},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "event_types", Value: eventType}},
+			bson.D{{Key: "event_types", Value: bson.D{{Key: "$size", Value: 0}}}},
+			bson.D{{Key: "event_types", Value: nil}},
+		}},
+	}
+	return r.find(ctx, filter)
+}
+
+func (r *SubscriptionRepository) find(ctx context.Context, filter bson.D) ([]user.Subscription, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var subs []user.Subscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// Delete a subscription, its delivery log expires on its own
+func (r *SubscriptionRepository) Delete(ctx context.Context, id string) error {
+	res, err := r.coll.DeleteOne(ctx, bson.D{{Key: "id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return user.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// SetEnabled enables or disables the subscription and resets its failures
+func (r *SubscriptionRepository) SetEnabled(ctx context.Context, id string, enabled bool, reason string) (user.Subscription, error) {
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "enabled", Value: enabled},
+		{Key: "consecutive_failures", Value: 0},
+		{Key: "disabled_reason", Value: reason},
+		{Key: "updated_at", Value: time.Now().UTC().Truncate(time.Millisecond)},
+	}}}
+	return r.findOneAndUpdate(ctx, id, update)
+}
+
+// RecordFailure counts one more failure in a row
+func (r *SubscriptionRepository) RecordFailure(ctx context.Context, id string) (user.Subscription, error) {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "consecutive_failures", Value: 1}}}}
+	return r.findOneAndUpdate(ctx, id, update)
+}
+
+// RecordSuccess resets the failures in a row
+func (r *SubscriptionRepository) RecordSuccess(ctx context.Context, id string) error {
+	filter := bson.D{{Key: "id", Value: id}, {Key: "consecutive_failures", Value: bson.D{{Key: "$gt", Value: 0}}}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "consecutive_failures", Value: 0}}}}
+	_, err := r.coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (r *SubscriptionRepository) findOneAndUpdate(ctx context.Context, id string, update bson.D) (user.Subscription, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var s user.Subscription
+	err := r.coll.FindOneAndUpdate(ctx, bson.D{{Key: "id", Value: id}}, update, opts).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.Subscription{}, user.ErrSubscriptionNotFound
+	}
+	return s, err
+}
+
+// DeliveryRepository concrete implementation of user.DeliveryRepository
+type DeliveryRepository struct {
+	coll   *mongo.Collection
+	logger *slog.Logger
+}
+
+// NewDeliveryRepository create an instance of DeliveryRepository
+func NewDeliveryRepository(conn *mongo.Client, dbName string) (*DeliveryRepository, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	coll := conn.Database(dbName).Collection(deliveryCollectionName)
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// an event relayed twice is delivered once per subscriber
+		{
+			Keys:    bson.D{{Key: "subscription_id", Value: 1}, {Key: "event_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// serves the claim of the dispatcher
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		// serves the delivery log
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "updated_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(deliveryLogRetention.Seconds())),
+		},
+	}
+	if _, err := coll.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		logger.Error("error creating index ", "error", err.Error())
+		return nil, err
+	}
+	logger.Info("indexes on webhook_deliveries created")
+
+	return &DeliveryRepository{
+		coll:   coll,
+		logger: logger,
+	}, nil
+}
+
+// Add stores the deliveries, the ones already stored for the same event are skipped
+func (r *DeliveryRepository) Add(ctx context.Context, deliveries []user.WebhookDelivery) error {
+	docs := make([]any, 0, len(deliveries))
+	for _, d := range deliveries {
+		docs = append(docs, d)
+	}
+	_, err := r.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+	return nil
+}
+
+// onlyDuplicateKeys tells if every write of a bulk insert failed on a unique index
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(we) {
+			return false
+		}
+	}
+	return true
+}
+
+// Claim takes the oldest pending delivery due at now and pushes its next attempt after the lease
+func (r *DeliveryRepository) Claim(ctx context.Context, now time.Time, lease time.Duration) (user.WebhookDelivery, error) {
+	filter := bson.D{
+		{Key: "status", Value: user.DeliveryPending},
+		{Key: "next_attempt_at", Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "next_attempt_at", Value: now.Add(lease)}}}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}})
+
+	var d user.WebhookDelivery
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user.WebhookDelivery{}, user.ErrNotFound
+	}
+	return d, err
+}
+
+// Update saves the outcome of an attempt
+func (r *DeliveryRepository) Update(ctx context.Context, d *user.WebhookDelivery) error {
+	_, err := r.coll.ReplaceOne(ctx, bson.D{{Key: "id", Value: d.ID}}, d)
+	return err
+}
+
+// List returns the last deliveries of a subscription, newest first
+func (r *DeliveryRepository) List(ctx context.Context, subscriptionID string, limit int) ([]user.WebhookDelivery, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.D{{Key: "payload", Value: 0}})
+	cursor, err := r.coll.Find(ctx, bson.D{{Key: "subscription_id", Value: subscriptionID}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []user.WebhookDelivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
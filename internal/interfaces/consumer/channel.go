@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// channel is the part of an AMQP channel the consumer uses
+type channel interface {
+	qos(prefetch int) error
+	declareQueue(name string, args amqp.Table) error
+	consume(queue, tag string) (<-chan amqp.Delivery, error)
+	// publish waits for the broker confirmation
+	publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+	cancel(tag string) error
+	close() error
+}
+
+// amqpChannel is a channel in confirm mode so a message is acked only once its retry is stored
+type amqpChannel struct {
+	ch *amqp.Channel
+}
+
+func newAMQPChannel(conn *amqp.Connection) (*amqpChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("channel could not be put into confirm mode: %w", err)
+	}
+	return &amqpChannel{ch: ch}, nil
+}
+
+func (c *amqpChannel) qos(prefetch int) error {
+	return c.ch.Qos(prefetch, 0, false)
+}
+
+func (c *amqpChannel) declareQueue(name string, args amqp.Table) error {
+	_, err := c.ch.QueueDeclare(name, true, false, false, false, args)
+	return err
+}
+
+func (c *amqpChannel) consume(queue, tag string) (<-chan amqp.Delivery, error) {
+	return c.ch.Consume(queue, tag, false, false, false, false, nil)
+}
+
+func (c *amqpChannel) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	confirm, err := c.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, msg)
+	if err != nil {
+		return err
+	}
+	ack, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		return fmt.Errorf("message %s NACK", msg.MessageId)
+	}
+	return nil
+}
+
+func (c *amqpChannel) cancel(tag string) error {
+	return c.ch.Cancel(tag, false)
+}
+
+func (c *amqpChannel) close() error {
+	return c.ch.Close()
+}
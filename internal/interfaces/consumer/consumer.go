@@ -0,0 +1,327 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPrefetch    = 10
+	DefaultConcurrency = 1
+	DefaultMaxAttempts = 5
+
+	// attemptsHeader counts the deliveries of a message across its retries
+	attemptsHeader = "x-attempts"
+	// errorHeader is the error of the last attempt
+	errorHeader = "x-last-error"
+)
+
+// DefaultRetryDelays are the waits before the 2nd, 3rd and next attempts
+var DefaultRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// ErrClosed is returned by Run when the deliveries stop without the context being done,
+// the channel or the connection was closed
+var ErrClosed = errors.New("consumer channel closed")
+
+// Handler handles one event, an error retries it
+type Handler func(ctx context.Context, e *user.Event) error
+
+// Options tunes the consumer, zero values use the defaults
+type Options struct {
+	// Queue is consumed, it is declared by the topology of the publisher
+	Queue string
+	// Tag identifies the consumer on the broker
+	Tag string
+	// Prefetch is the QoS, the messages sent to the consumer not acked yet at most
+	Prefetch int
+	// Concurrency is the number of events handled in parallel
+	Concurrency int
+	// MaxAttempts is the number of times a failing event is handled before being dead lettered
+	MaxAttempts int
+	// RetryDelays is the wait before each retry, the last one is used for the next retries
+	// A failed event is published in a delay queue per delay and comes back to Queue when it expires
+	RetryDelays []time.Duration
+	// DeadLetterQueue receives the events failing MaxAttempts times and the messages that can't be decoded
+	// When empty they are rejected to the dead letter exchange of Queue
+	DeadLetterQueue string
+	// Deduplicator skips the events already handled, a MemoryDeduplicator by default
+	Deduplicator Deduplicator
+}
+
+// Consumer subscribes to a queue of the user.events exchange and calls the handler of each event type
+// Messages are acked manually once handled, retried with a delay or dead lettered
+// Events without handler are acked and ignored
+type Consumer struct {
+	logger   *slog.Logger
+	ch       channel
+	opts     Options
+	handlers map[string]Handler
+}
+
+// New creates a consumer on a new channel of conn
+func New(conn *amqp.Connection, opts Options) (*Consumer, error) {
+	if opts.Queue == "" {
+		return nil, errors.New("consumer queue is required")
+	}
+	ch, err := newAMQPChannel(conn)
+	if err != nil {
+		return nil, err
+	}
+	return newConsumer(ch, opts), nil
+}
+
+func newConsumer(ch channel, opts Options) *Consumer {
+	if opts.Tag == "" {
+		opts.Tag = fmt.Sprintf("%s.consumer.%d", opts.Queue, time.Now().UnixNano())
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = DefaultPrefetch
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if len(opts.RetryDelays) == 0 {
+		opts.RetryDelays = DefaultRetryDelays
+	}
+	if opts.Deduplicator == nil {
+		opts.Deduplicator = NewMemoryDeduplicator(DefaultDedupeSize)
+	}
+	return &Consumer{
+		logger:   slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		ch:       ch,
+		opts:     opts,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// On registers the handler of an event type like user.created
+// Handlers must be registered before Run
+func (c *Consumer) On(eventType string, h Handler) {
+	c.handlers[eventType] = h
+}
+
+// OnUserCreated registers the handler of the user created events
+func (c *Consumer) OnUserCreated(h Handler) {
+	c.On(user.UserCreatedRoutingKey, h)
+}
+
+// OnUserUpdated registers the handler of the user updated events
+func (c *Consumer) OnUserUpdated(h Handler) {
+	c.On(user.UserUpdatedRoutingKey, h)
+}
+
+// OnUserDeleted registers the handler of the user deleted events
+func (c *Consumer) OnUserDeleted(h Handler) {
+	c.On(user.UserDeletedRoutingKey, h)
+}
+
+// Run declares the delay queues and consumes until ctx is done
+// On cancellation it stops receiving, waits for the events being handled and closes the channel,
+// the messages prefetched but not handled are requeued by the broker
+// Handlers get a context which is not canceled with ctx so they can finish
+func (c *Consumer) Run(ctx context.Context) error {
+	if err := c.setup(); err != nil {
+		return err
+	}
+	deliveries, err := c.ch.consume(c.opts.Queue, c.opts.Tag)
+	if err != nil {
+		return fmt.Errorf("consuming %s: %w", c.opts.Queue, err)
+	}
+	c.logger.Info("consumer started", "queue", c.opts.Queue, "prefetch", c.opts.Prefetch,
+		"concurrency", c.opts.Concurrency)
+
+	handlerCtx := context.WithoutCancel(ctx)
+	var wg sync.WaitGroup
+	for range c.opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				c.handle(handlerCtx, d)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return ErrClosed
+	case <-ctx.Done():
+	}
+
+	c.logger.Info("stopping consumer", "queue", c.opts.Queue)
+	// the deliveries are closed once the broker stopped sending
+	if err := c.ch.cancel(c.opts.Tag); err != nil {
+		c.logger.Error("error canceling consumer", "error", err)
+	}
+	<-done
+	return c.ch.close()
+}
+
+// setup sets the QoS and declares a delay queue per retry delay and the dead letter queue
+// A delay queue has no consumer, its messages expire back to the consumed queue
+func (c *Consumer) setup() error {
+	if err := c.ch.qos(c.opts.Prefetch); err != nil {
+		return err
+	}
+	for _, delay := range c.opts.RetryDelays {
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.opts.Queue,
+		}
+		if err := c.ch.declareQueue(retryQueueName(c.opts.Queue, delay), args); err != nil {
+			return fmt.Errorf("declaring retry queue: %w", err)
+		}
+	}
+	if c.opts.DeadLetterQueue != "" {
+		if err := c.ch.declareQueue(c.opts.DeadLetterQueue, nil); err != nil {
+			return fmt.Errorf("declaring dead letter queue: %w", err)
+		}
+	}
+	return nil
+}
+
+// handle decodes the delivery and calls its handler
+// A message that can't be decoded will never succeed and is dead lettered right away
+func (c *Consumer) handle(ctx context.Context, d amqp.Delivery) {
+	e, err := user.DecodeCloudEvent(d)
+	if err != nil {
+		c.deadLetter(ctx, d, err)
+		return
+	}
+
+	h, ok := c.handlers[e.Type]
+	if !ok {
+		c.ack(d)
+		return
+	}
+
+	seen, err := c.opts.Deduplicator.Seen(ctx, e.ID)
+	if err != nil {
+		c.logger.Error("error checking duplicate event", "event_id", e.ID, "error", err)
+	}
+	if seen {
+		c.logger.Info("skipping duplicate event", "event_id", e.ID, "type", e.Type)
+		c.ack(d)
+		return
+	}
+
+	if err := h(ctx, e); err != nil {
+		c.retry(ctx, d, err)
+		return
+	}
+	if err := c.opts.Deduplicator.Mark(ctx, e.ID); err != nil {
+		c.logger.Error("error marking event handled", "event_id", e.ID, "error", err)
+	}
+	c.ack(d)
+}
+
+// retry publishes the message in the delay queue of its attempt, then acks it
+// Past MaxAttempts it is dead lettered
+func (c *Consumer) retry(ctx context.Context, d amqp.Delivery, cause error) {
+	attempt := attempts(d)
+	if attempt >= c.opts.MaxAttempts {
+		c.deadLetter(ctx, d, cause)
+		return
+	}
+
+	delay := c.opts.RetryDelays[min(attempt, len(c.opts.RetryDelays))-1]
+	c.logger.Error("event failed, retrying", "event_id", d.MessageId, "attempt", attempt,
+		"delay", delay, "error", cause)
+	if err := c.ch.publish(ctx, "", retryQueueName(c.opts.Queue, delay), republish(d, attempt+1, cause)); err != nil {
+		// the broker redelivers it right away
+		c.logger.Error("error scheduling retry", "event_id", d.MessageId, "error", err)
+		c.nack(d, true)
+		return
+	}
+	c.ack(d)
+}
+
+// deadLetter publishes the message in the dead letter queue, or rejects it to the
+// dead letter exchange of the queue when none is configured
+func (c *Consumer) deadLetter(ctx context.Context, d amqp.Delivery, cause error) {
+	c.logger.Error("dead lettering event", "event_id", d.MessageId, "attempt", attempts(d), "error", cause)
+	if c.opts.DeadLetterQueue == "" {
+		c.nack(d, false)
+		return
+	}
+	if err := c.ch.publish(ctx, "", c.opts.DeadLetterQueue, republish(d, attempts(d), cause)); err != nil {
+		c.logger.Error("error dead lettering event", "event_id", d.MessageId, "error", err)
+		c.nack(d, true)
+		return
+	}
+	c.ack(d)
+}
+
+func (c *Consumer) ack(d amqp.Delivery) {
+	if err := d.Ack(false); err != nil {
+		c.logger.Error("error acking message", "event_id", d.MessageId, "error", err)
+	}
+}
+
+func (c *Consumer) nack(d amqp.Delivery, requeue bool) {
+	if err := d.Nack(false, requeue); err != nil {
+		c.logger.Error("error rejecting message", "event_id", d.MessageId, "error", err)
+	}
+}
+
+// retryQueueName is like user.retry.10s
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+// attempts is the attempt number of the delivery, 1 the first time
+func attempts(d amqp.Delivery) int {
+	switch n := d.Headers[attemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	default:
+		return 1
+	}
+}
+
+// republish copies the delivery with its next attempt number and the last error
+// The x- headers set by the broker, like x-death, are left out
+func republish(d amqp.Delivery, attempt int, cause error) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		if !strings.HasPrefix(k, "x-") {
+			headers[k] = v
+		}
+	}
+	headers[attemptsHeader] = int32(attempt)
+	headers[errorHeader] = cause.Error()
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
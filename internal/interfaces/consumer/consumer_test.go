@@ -0,0 +1,242 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type published struct {
+	routingKey string
+	msg        amqp.Publishing
+}
+
+// fakeChannel records the declarations and publications and delivers from a Go channel
+type fakeChannel struct {
+	mu         sync.Mutex
+	deliveries chan amqp.Delivery
+	declared   map[string]amqp.Table
+	published  []published
+	canceled   bool
+	closed     bool
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{deliveries: make(chan amqp.Delivery, 10), declared: make(map[string]amqp.Table)}
+}
+
+func (f *fakeChannel) qos(int) error { return nil }
+
+func (f *fakeChannel) declareQueue(name string, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.declared[name] = args
+	return nil
+}
+
+func (f *fakeChannel) consume(string, string) (<-chan amqp.Delivery, error) {
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) publish(_ context.Context, _, routingKey string, msg amqp.Publishing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, published{routingKey: routingKey, msg: msg})
+	return nil
+}
+
+func (f *fakeChannel) cancel(string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.canceled = true
+	close(f.deliveries)
+	return nil
+}
+
+func (f *fakeChannel) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// fakeAcknowledger records how a delivery was settled
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(uint64, bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nacked, a.requeue = true, requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(_ uint64, requeue bool) error {
+	return a.Nack(0, false, requeue)
+}
+
+func newDelivery(t *testing.T, eventType, userID string, attempt int) (amqp.Delivery, *fakeAcknowledger, *user.Event) {
+	t.Helper()
+	e := user.NewOutboxEvent(eventType, &user.User{ID: userID}).Event()
+	msg, err := user.CloudEventsEncoder{Source: "/test", Mode: user.BinaryMode}.Encode(e)
+	require.NoError(t, err)
+	if attempt > 1 {
+		msg.Headers[attemptsHeader] = int32(attempt)
+	}
+	ack := &fakeAcknowledger{}
+	return amqp.Delivery{
+		Acknowledger: ack,
+		Headers:      msg.Headers,
+		ContentType:  msg.ContentType,
+		MessageId:    msg.MessageId,
+		Body:         msg.Body,
+	}, ack, e
+}
+
+func TestConsumerHandlesEvents(t *testing.T) {
+	ch := newFakeChannel()
+	c := newConsumer(ch, Options{Queue: "billing"})
+
+	var got []*user.Event
+	c.OnUserCreated(func(_ context.Context, e *user.Event) error {
+		got = append(got, e)
+		return nil
+	})
+
+	d, ack, e := newDelivery(t, user.UserCreatedRoutingKey, "u1", 1)
+	c.handle(context.Background(), d)
+	require.Len(t, got, 1)
+	assert.Equal(t, e.ID, got[0].ID)
+	assert.True(t, ack.acked)
+
+	// a redelivery of the same event is acked without calling the handler
+	ack = &fakeAcknowledger{}
+	d.Acknowledger, d.Redelivered = ack, true
+	c.handle(context.Background(), d)
+	assert.Len(t, got, 1, "duplicate should be skipped")
+	assert.True(t, ack.acked)
+
+	// events without handler are ignored
+	d, ack, _ = newDelivery(t, user.UserPurgedRoutingKey, "u1", 1)
+	c.handle(context.Background(), d)
+	assert.Len(t, got, 1)
+	assert.True(t, ack.acked)
+}
+
+func TestConsumerRetriesWithDelay(t *testing.T) {
+	ch := newFakeChannel()
+	c := newConsumer(ch, Options{
+		Queue:           "billing",
+		MaxAttempts:     3,
+		RetryDelays:     []time.Duration{time.Second, 10 * time.Second},
+		DeadLetterQueue: "billing.dlq",
+	})
+	require.NoError(t, c.setup())
+	assert.Equal(t, amqp.Table{
+		"x-message-ttl":             int64(10000),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "billing",
+	}, ch.declared["billing.retry.10s"])
+	assert.Contains(t, ch.declared, "billing.retry.1s")
+	assert.Contains(t, ch.declared, "billing.dlq")
+
+	calls := 0
+	c.OnUserUpdated(func(context.Context, *user.Event) error {
+		calls++
+		return errors.New("billing is down")
+	})
+
+	for attempt, queue := range map[int]string{1: "billing.retry.1s", 2: "billing.retry.10s", 3: "billing.dlq"} {
+		ch.published = nil
+		d, ack, e := newDelivery(t, user.UserUpdatedRoutingKey, "u1", attempt)
+		c.handle(context.Background(), d)
+
+		require.Len(t, ch.published, 1)
+		assert.Equal(t, queue, ch.published[0].routingKey)
+		assert.Equal(t, e.ID, ch.published[0].msg.MessageId)
+		assert.Equal(t, "billing is down", ch.published[0].msg.Headers[errorHeader])
+		assert.True(t, ack.acked, "the message is acked once republished")
+		if attempt < 3 {
+			assert.Equal(t, int32(attempt+1), ch.published[0].msg.Headers[attemptsHeader])
+		}
+	}
+	assert.Equal(t, 3, calls)
+}
+
+func TestConsumerDeadLettersPoisonMessages(t *testing.T) {
+	ch := newFakeChannel()
+	c := newConsumer(ch, Options{Queue: "billing"})
+
+	ack := &fakeAcknowledger{}
+	c.handle(context.Background(), amqp.Delivery{Acknowledger: ack, Body: []byte("not an event")})
+	assert.Empty(t, ch.published)
+	assert.True(t, ack.nacked, "without dead letter queue it is rejected to the queue dead letter exchange")
+	assert.False(t, ack.requeue)
+}
+
+func TestConsumerGracefulShutdown(t *testing.T) {
+	ch := newFakeChannel()
+	c := newConsumer(ch, Options{Queue: "billing", Concurrency: 2})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var handled sync.WaitGroup
+	handled.Add(1)
+	c.OnUserCreated(func(ctx context.Context, _ *user.Event) error {
+		close(started)
+		<-release
+		handled.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(ctx) }()
+
+	d, ack, _ := newDelivery(t, user.UserCreatedRoutingKey, "u1", 1)
+	ch.deliveries <- d
+	<-started
+	cancel()
+
+	select {
+	case <-errs:
+		t.Fatal("Run should wait for the event being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-errs)
+	handled.Wait()
+	assert.True(t, ack.acked, "the handler context is not canceled by the shutdown")
+	assert.True(t, ch.canceled)
+	assert.True(t, ch.closed)
+}
+
+func TestMemoryDeduplicator(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDeduplicator(2)
+	require.NoError(t, d.Mark(ctx, "a"))
+	require.NoError(t, d.Mark(ctx, "b"))
+	require.NoError(t, d.Mark(ctx, "c"))
+
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		seen, err := d.Seen(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, want, seen, id)
+	}
+}
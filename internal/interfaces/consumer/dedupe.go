@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultDedupeSize is the number of event ids remembered by the default deduplicator
+const DefaultDedupeSize = 10000
+
+// Deduplicator remembers the events already handled
+// Delivery is at least once, a redelivered event with a known id is acked without calling the handler
+type Deduplicator interface {
+	Seen(ctx context.Context, eventID string) (bool, error)
+	Mark(ctx context.Context, eventID string) error
+}
+
+// MemoryDeduplicator remembers the last event ids handled by this process
+// The oldest id is forgotten past the size, a shared store is needed across replicas
+type MemoryDeduplicator struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// NewMemoryDeduplicator remembers size ids at most
+func NewMemoryDeduplicator(size int) *MemoryDeduplicator {
+	if size <= 0 {
+		size = DefaultDedupeSize
+	}
+	return &MemoryDeduplicator{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+func (d *MemoryDeduplicator) Seen(_ context.Context, eventID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.ids[eventID]
+	return ok, nil
+}
+
+func (d *MemoryDeduplicator) Mark(_ context.Context, eventID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.ids[eventID]; ok {
+		return nil
+	}
+	// the ring replaces the oldest id
+	if oldest := d.order[d.next]; oldest != "" {
+		delete(d.ids, oldest)
+	}
+	d.order[d.next] = eventID
+	d.ids[eventID] = struct{}{}
+	d.next = (d.next + 1) % len(d.order)
+	return nil
+}
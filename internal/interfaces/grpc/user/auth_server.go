@@ -0,0 +1,57 @@
+package user
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const tokenType = "Bearer"
+
+// AuthServer implements AuthServiceServer and we inject the auth service
+type AuthServer struct {
+	UnimplementedAuthServiceServer
+	service user.AuthService
+}
+
+// NewAuthServer creates a new AuthServer with the given service.
+func NewAuthServer(svc user.AuthService) *AuthServer {
+	return &AuthServer{service: svc}
+}
+
+// Login is the RPC method to exchange credentials for tokens
+func (s *AuthServer) Login(ctx context.Context, req *LoginRequest) (*TokenResponse, error) {
+	tokens, err := s.service.Login(ctx, req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toTokenResponse(tokens), nil
+}
+
+// RefreshToken is the RPC method to exchange a refresh token for new tokens
+func (s *AuthServer) RefreshToken(ctx context.Context, req *RefreshTokenRequest) (*TokenResponse, error) {
+	tokens, err := s.service.Refresh(ctx, req.GetRefreshToken())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toTokenResponse(tokens), nil
+}
+
+// Logout is the RPC method to revoke a refresh token
+func (s *AuthServer) Logout(ctx context.Context, req *LogoutRequest) (*LogoutResponse, error) {
+	if err := s.service.Logout(ctx, req.GetRefreshToken()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &LogoutResponse{}, nil
+}
+
+func toTokenResponse(tokens *user.Tokens) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:           tokens.AccessToken,
+		AccessTokenExpiresAt:  timestamppb.New(tokens.AccessTokenExpiresAt),
+		RefreshToken:          tokens.RefreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(tokens.RefreshTokenExpiresAt),
+		TokenType:             tokenType,
+	}
+}
@@ -0,0 +1,115 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fieldViolations lists the request fields at fault for each validation error
+// so clients can point at the right input instead of parsing the message
+var fieldViolations = map[error][]string{
+	user.ErrMissingEmailPassword: {"email", "password"},
+	user.ErrMissingName:          {"first_name", "last_name"},
+	user.ErrUnknownField:         {"update_mask"},
+	user.ErrUnknownRole:          {"role"},
+	user.ErrInvalidPageToken:     {"page_token"},
+	user.ErrInvalidOrderBy:       {"order_by"},
+	user.ErrInvalidWebhookURL:    {"url"},
+	user.ErrUnknownEventType:     {"event_types"},
+}
+
+// errLogger logs the unexpected errors hidden from the clients
+var errLogger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// toStatus translates an error coming from the domain into a gRPC status
+// This is the only place deciding which code a client receives
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, user.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, user.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, user.ErrInvalidArgument):
+		return invalidArgument(err)
+	case errors.Is(err, user.ErrFailedPrecondition):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, user.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, user.ErrConflict):
+		return aborted(err)
+	case errors.Is(err, user.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		// driver and broker errors can leak hosts and internals, they are only logged
+		errLogger.Error("internal error", "error", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// invalidArgument builds an InvalidArgument status with a BadRequest detail
+// when the faulty fields are known
+func invalidArgument(err error) error {
+	st := status.New(codes.InvalidArgument, err.Error())
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	for target, fields := range fieldViolations {
+		if !errors.Is(err, target) {
+			continue
+		}
+		for _, field := range fields {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       field,
+				Description: target.Error(),
+			})
+		}
+	}
+	if len(violations) == 0 {
+		return st.Err()
+	}
+
+	detailed, detailErr := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// errorDomain identifies the errors of this service in ErrorInfo details
+const errorDomain = "user.esl"
+
+// aborted builds an Aborted status carrying the current version of the user
+// in an ErrorInfo detail, so clients can retry without parsing the message
+func aborted(err error) error {
+	st := status.New(codes.Aborted, err.Error())
+
+	var conflict *user.VersionConflictError
+	if !errors.As(err, &conflict) {
+		return st.Err()
+	}
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "VERSION_MISMATCH",
+		Domain:   errorDomain,
+		Metadata: map[string]string{"current_version": strconv.FormatInt(conflict.Current, 10)},
+	})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestToStatus test that every domain error reaches the client with the expected code
+func TestToStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		wantCode codes.Code
+		wantBad  []string
+	}{
+		{"not found", user.ErrNotFound, codes.NotFound, nil},
+		{"wrapped not found", fmt.Errorf("get user: %w", user.ErrNotFound), codes.NotFound, nil},
+		{"email exists", user.ErrEmailExists, codes.AlreadyExists, nil},
+		{"missing email password", user.ErrMissingEmailPassword, codes.InvalidArgument, []string{"email", "password"}},
+		{"missing name", user.ErrMissingName, codes.InvalidArgument, []string{"first_name", "last_name"}},
+		{"failed precondition", user.ErrFailedPrecondition, codes.FailedPrecondition, nil},
+		{"not deleted", user.ErrNotDeleted, codes.FailedPrecondition, nil},
+		{"invalid credentials", user.ErrInvalidCredentials, codes.Unauthenticated, nil},
+		{"version conflict", &user.VersionConflictError{Current: 3}, codes.Aborted, nil},
+		{"shutting down", user.ErrShuttingDown, codes.Unavailable, nil},
+		{"deadline", context.DeadlineExceeded, codes.DeadlineExceeded, nil},
+		{"unknown", errors.New("boom"), codes.Internal, nil},
+		{"already a status", status.Error(codes.Unavailable, "down"), codes.Unavailable, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, ok := status.FromError(toStatus(tc.err))
+			require.True(t, ok)
+			assert.Equal(t, tc.wantCode, st.Code())
+
+			var fields []string
+			for _, detail := range st.Details() {
+				if br, ok := detail.(*errdetails.BadRequest); ok {
+					for _, v := range br.GetFieldViolations() {
+						fields = append(fields, v.GetField())
+					}
+				}
+			}
+			assert.ElementsMatch(t, tc.wantBad, fields)
+		})
+	}
+
+	assert.NoError(t, toStatus(nil))
+}
+
+// TestToStatusHidesInternalErrors test that unexpected errors don't reach the client
+func TestToStatusHidesInternalErrors(t *testing.T) {
+	st, ok := status.FromError(toStatus(errors.New("server selection error: mongo-0.internal:27017")))
+	require.True(t, ok)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Equal(t, "internal error", st.Message())
+}
+
+// TestToStatusVersionConflict test that clients get the current version with the Aborted status
+func TestToStatusVersionConflict(t *testing.T) {
+	st := status.Convert(toStatus(fmt.Errorf("update: %w", &user.VersionConflictError{Current: 3})))
+	require.Equal(t, codes.Aborted, st.Code())
+	require.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	assert.Equal(t, "VERSION_MISMATCH", info.GetReason())
+	assert.Equal(t, "3", info.GetMetadata()["current_version"])
+}
@@ -0,0 +1,183 @@
+package user
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Rule is the access policy of one RPC
+type Rule struct {
+	// Public RPCs don't need a token
+	Public bool
+	// Roles allowed to call the RPC
+	Roles []string
+	// Permission allows the callers whose roles grant it
+	Permission user.Permission
+	// Self allows a caller to act on its own user, named by the id of the request,
+	// even without one of the roles or the permission
+	// A rule without roles, permission or self lets any authenticated caller in
+	Self bool
+	// Peers allows without token the clients whose verified certificate has one of these SANs,
+	// for services calling on mutual TLS
+	Peers []string
+}
+
+// DefaultPolicy is the access policy of the services of this package
+// RPCs missing from the policy are reserved to admins
+var DefaultPolicy = map[string]Rule{
+	AuthService_Login_FullMethodName:        {Public: true},
+	AuthService_RefreshToken_FullMethodName: {Public: true},
+	AuthService_Logout_FullMethodName:       {Public: true},
+
+	UserService_CreateUser_FullMethodName:  {Public: true},
+	UserService_GetUserById_FullMethodName: {Permission: user.PermissionReadUsers, Self: true},
+	UserService_UpdateUser_FullMethodName:  {Permission: user.PermissionWriteUsers, Self: true},
+	UserService_DeleteUser_FullMethodName:  {Permission: user.PermissionDeleteUsers, Self: true},
+	UserService_RestoreUser_FullMethodName: {Permission: user.PermissionDeleteUsers},
+	UserService_PurgeUser_FullMethodName:   {Permission: user.PermissionDeleteUsers},
+	UserService_ListUsers_FullMethodName:   {Permission: user.PermissionReadUsers},
+	UserService_GrantRole_FullMethodName:   {Permission: user.PermissionManageRoles},
+	UserService_RevokeRole_FullMethodName:  {Permission: user.PermissionManageRoles},
+
+	WebhookService_CreateSubscription_FullMethodName:     {Permission: user.PermissionManageWebhooks},
+	WebhookService_GetSubscription_FullMethodName:        {Permission: user.PermissionManageWebhooks},
+	WebhookService_ListSubscriptions_FullMethodName:      {Permission: user.PermissionManageWebhooks},
+	WebhookService_DeleteSubscription_FullMethodName:     {Permission: user.PermissionManageWebhooks},
+	WebhookService_SetSubscriptionEnabled_FullMethodName: {Permission: user.PermissionManageWebhooks},
+	WebhookService_ListDeliveries_FullMethodName:         {Permission: user.PermissionManageWebhooks},
+}
+
+// publicServices are infrastructure services reachable without token
+var publicServices = []string{
+	"/" + grpc_health_v1.Health_ServiceDesc.ServiceName + "/",
+	"/grpc.reflection.",
+}
+
+var defaultRule = Rule{Roles: []string{user.RoleAdmin}}
+
+// Authorizer validates the bearer token of each call, puts the caller
+// identity in the context and enforces the policy of the called RPC
+type Authorizer struct {
+	tokens *user.TokenManager
+	policy map[string]Rule
+}
+
+// NewAuthorizer creates an Authorizer enforcing the given policy
+func NewAuthorizer(tokens *user.TokenManager, policy map[string]Rule) *Authorizer {
+	return &Authorizer{tokens: tokens, policy: policy}
+}
+
+// UnaryInterceptor authorizes unary calls
+func (a *Authorizer) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authorizes streaming calls
+// The request isn't known when the stream opens so Self rules don't apply
+func (a *Authorizer) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(ss.Context(), info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authorize returns the context carrying the caller identity
+// or an Unauthenticated or PermissionDenied status
+func (a *Authorizer) authorize(ctx context.Context, method string, req any) (context.Context, error) {
+	rule, ok := a.policy[method]
+	if !ok {
+		rule = defaultRule
+		for _, prefix := range publicServices {
+			if strings.HasPrefix(method, prefix) {
+				rule = Rule{Public: true}
+			}
+		}
+	}
+	if rule.Public || peerAllowed(ctx, rule) {
+		return ctx, nil
+	}
+
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := a.tokens.Verify(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	id := claims.Identity()
+
+	if !allowed(rule, id, req) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s", id.UserID, method)
+	}
+	return user.ContextWithIdentity(ctx, id), nil
+}
+
+// allowed tells if the caller matches the rule
+func allowed(rule Rule, id *user.Identity, req any) bool {
+	if len(rule.Roles) == 0 && rule.Permission == "" && !rule.Self {
+		return true
+	}
+	for _, role := range rule.Roles {
+		if id.HasRole(role) {
+			return true
+		}
+	}
+	if rule.Permission != "" && id.Can(rule.Permission) {
+		return true
+	}
+	if target, ok := req.(interface{ GetId() string }); ok && rule.Self {
+		return target.GetId() == id.UserID
+	}
+	return false
+}
+
+// peerAllowed tells if the client certificate of the call names one of the peers of the rule
+func peerAllowed(ctx context.Context, rule Rule) bool {
+	if len(rule.Peers) == 0 {
+		return false
+	}
+	client, ok := ClientIdentityFromContext(ctx)
+	return ok && slices.ContainsFunc(rule.Peers, client.Has)
+}
+
+// bearerToken reads the token of the authorization metadata
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "missing authorization metadata")
+	}
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, tokenType) || token == "" {
+		return "", status.Error(codes.Unauthenticated, "authorization metadata must be \"Bearer <token>\"")
+	}
+	return token, nil
+}
+
+// identityStream overrides the context of a stream with the authorized one
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,88 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestAuthorizer test the policy enforced on each RPC
+func TestAuthorizer(t *testing.T) {
+	manager := user.NewHS256TokenManager([]byte("secret"), time.Minute)
+	issue := func(u *user.User) string {
+		token, _, err := manager.Issue(u)
+		require.NoError(t, err)
+		return "Bearer " + token
+	}
+	caller := issue(&user.User{ID: "me"})
+	admin := issue(&user.User{ID: "admin", Roles: []string{user.RoleAdmin}})
+	support := issue(&user.User{ID: "support", Roles: []string{user.RoleSupport}})
+
+	cases := []struct {
+		name     string
+		method   string
+		auth     string
+		req      any
+		wantCode codes.Code
+	}{
+		{"public without token", UserService_CreateUser_FullMethodName, "", &CreateUserRequest{}, codes.OK},
+		{"health without token", "/grpc.health.v1.Health/Check", "", nil, codes.OK},
+		{"missing token", UserService_DeleteUser_FullMethodName, "", &DeleteUserRequest{Id: "me"}, codes.Unauthenticated},
+		{"malformed token", UserService_DeleteUser_FullMethodName, "Bearer nope", &DeleteUserRequest{Id: "me"}, codes.Unauthenticated},
+		{"wrong scheme", UserService_DeleteUser_FullMethodName, "Basic abc", &DeleteUserRequest{Id: "me"}, codes.Unauthenticated},
+		{"delete self", UserService_DeleteUser_FullMethodName, caller, &DeleteUserRequest{Id: "me"}, codes.OK},
+		{"delete someone else", UserService_DeleteUser_FullMethodName, caller, &DeleteUserRequest{Id: "other"}, codes.PermissionDenied},
+		{"update someone else", UserService_UpdateUser_FullMethodName, caller, &UpdateUserRequest{Id: "other"}, codes.PermissionDenied},
+		{"list as user", UserService_ListUsers_FullMethodName, caller, &ListUsersRequest{}, codes.PermissionDenied},
+		{"unknown method", "/user.UserService/Unknown", caller, nil, codes.PermissionDenied},
+		{"admin deletes anyone", UserService_DeleteUser_FullMethodName, admin, &DeleteUserRequest{Id: "other"}, codes.OK},
+		{"admin grants roles", UserService_GrantRole_FullMethodName, admin, &GrantRoleRequest{UserId: "other"}, codes.OK},
+		{"admin unknown method", "/user.UserService/Unknown", admin, nil, codes.OK},
+		{"user grants roles", UserService_GrantRole_FullMethodName, caller, &GrantRoleRequest{UserId: "me"}, codes.PermissionDenied},
+		{"support lists", UserService_ListUsers_FullMethodName, support, &ListUsersRequest{}, codes.OK},
+		{"support deletes someone else", UserService_DeleteUser_FullMethodName, support, &DeleteUserRequest{Id: "other"}, codes.PermissionDenied},
+	}
+
+	authorizer := NewAuthorizer(manager, DefaultPolicy)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.auth != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tc.auth))
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return "ok", nil
+			}
+
+			_, err := authorizer.UnaryInterceptor()(ctx, tc.req, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			assert.Equal(t, tc.wantCode, status.Code(err))
+		})
+	}
+}
+
+// TestAuthorizerIdentity test that the handler receives the caller identity
+func TestAuthorizerIdentity(t *testing.T) {
+	manager := user.NewHS256TokenManager([]byte("secret"), time.Minute)
+	token, _, err := manager.Issue(&user.User{ID: "me", Email: "me@example.com"})
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		id, ok := user.IdentityFromContext(ctx)
+		require.True(t, ok)
+		assert.Equal(t, "me", id.UserID)
+		assert.Equal(t, "me@example.com", id.Email)
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: UserService_GetUserById_FullMethodName}
+	_, err = NewAuthorizer(manager, DefaultPolicy).UnaryInterceptor()(ctx, &GetUserRequest{Id: "me"}, info, handler)
+	assert.NoError(t, err)
+}
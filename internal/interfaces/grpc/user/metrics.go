@@ -0,0 +1,80 @@
+package user
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_started_total",
+		Help: "RPCs started on the server",
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+	rpcHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "RPCs completed on the server, by status code",
+	}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"})
+	rpcSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Time the server took to handle RPCs",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_type", "grpc_service", "grpc_method"})
+)
+
+// Collectors are the metrics of the interceptors, registered by the metrics server
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{rpcStarted, rpcHandled, rpcSeconds}
+}
+
+// MetricsUnaryInterceptor counts and times unary calls
+// It goes first in the chain so the calls refused by the Authorizer are counted with their code
+func MetricsUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done := observeRPC("unary", info.FullMethod)
+		resp, err := handler(ctx, req)
+		done(err)
+		return resp, err
+	}
+}
+
+// MetricsStreamInterceptor counts and times streaming calls, until the stream ends
+func MetricsStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		rpcType := "bidi_stream"
+		switch {
+		case !info.IsClientStream:
+			rpcType = "server_stream"
+		case !info.IsServerStream:
+			rpcType = "client_stream"
+		}
+		done := observeRPC(rpcType, info.FullMethod)
+		err := handler(srv, ss)
+		done(err)
+		return err
+	}
+}
+
+// observeRPC counts the started call and returns the function recording its end
+func observeRPC(rpcType, fullMethod string) func(error) {
+	service, method := splitMethod(fullMethod)
+	rpcStarted.WithLabelValues(rpcType, service, method).Inc()
+	start := time.Now()
+	return func(err error) {
+		rpcHandled.WithLabelValues(rpcType, service, method, status.Code(err).String()).Inc()
+		rpcSeconds.WithLabelValues(rpcType, service, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// splitMethod splits /package.Service/Method in its service and method
+func splitMethod(fullMethod string) (string, string) {
+	service, method, found := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !found {
+		return "unknown", "unknown"
+	}
+	return service, method
+}
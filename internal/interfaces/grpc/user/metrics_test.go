@@ -0,0 +1,35 @@
+package user
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMetricsInterceptor test the calls are counted by method and status code
+func TestMetricsInterceptor(t *testing.T) {
+	handled := func(code codes.Code) float64 {
+		return testutil.ToFloat64(rpcHandled.WithLabelValues("unary", "user.UserService", "GetUserById", code.String()))
+	}
+	okBefore, notFoundBefore := handled(codes.OK), handled(codes.NotFound)
+	started := testutil.ToFloat64(rpcStarted.WithLabelValues("unary", "user.UserService", "GetUserById"))
+
+	info := &grpc.UnaryServerInfo{FullMethod: UserService_GetUserById_FullMethodName}
+	interceptor := MetricsUnaryInterceptor()
+	for _, err := range []error{nil, nil, status.Error(codes.NotFound, "user not found")} {
+		_, got := interceptor(context.Background(), &GetUserRequest{}, info, func(context.Context, any) (any, error) {
+			return nil, err
+		})
+		assert.Equal(t, err, got)
+	}
+
+	assert.Equal(t, started+3, testutil.ToFloat64(rpcStarted.WithLabelValues("unary", "user.UserService", "GetUserById")))
+	assert.Equal(t, okBefore+2, handled(codes.OK))
+	assert.Equal(t, notFoundBefore+1, handled(codes.NotFound))
+	assert.Positive(t, testutil.CollectAndCount(rpcSeconds))
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// ServerTLSOptions are the files served by a CertReloader
+type ServerTLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies the client certificates, mutual TLS is off without it
+	ClientCAFile string
+	// OptionalClientCert lets clients without certificate in, the ones presenting one are still verified
+	OptionalClientCert bool
+	// ReloadInterval is the minimum time between two checks of the files
+	ReloadInterval time.Duration
+}
+
+// CertReloader serves the server certificate and the client CA, reloaded
+// when their files change on disk so they rotate without restart
+// The files are checked on handshakes, at most once per ReloadInterval,
+// and a broken rotation is logged while the previous files keep being served
+type CertReloader struct {
+	opts   ServerTLSOptions
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	config    *tls.Config
+	stamps    []fileStamp
+	checkedAt time.Time
+}
+
+// fileStamp tells a file changed without reading it
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader loads the files, failing when they can't be served
+func NewCertReloader(opts ServerTLSOptions) (*CertReloader, error) {
+	handler := slog.NewTextHandler(os.Stdout, nil)
+	r := &CertReloader{opts: opts, logger: slog.New(handler)}
+
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.config, r.stamps, r.checkedAt = config, stamps, time.Now()
+	return r, nil
+}
+
+// TLSConfig returns the configuration to give to credentials.NewTLS
+// Each handshake gets the files loaded last
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// current reloads the files when they changed since the last check
+func (r *CertReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < r.opts.ReloadInterval {
+		return r.config
+	}
+	r.checkedAt = time.Now()
+
+	stamps, err := r.stat()
+	if err != nil {
+		r.logger.Error("checking the TLS files", "error", err)
+		return r.config
+	}
+	if slices.Equal(stamps, r.stamps) {
+		return r.config
+	}
+	config, err := r.load()
+	if err != nil {
+		// the key may be written after the certificate, the next check retries
+		r.logger.Error("reloading the TLS files, the previous ones are kept", "error", err)
+		return r.config
+	}
+	r.config, r.stamps = config, stamps
+	r.logger.Info("TLS files reloaded", "cert", r.opts.CertFile)
+	return r.config
+}
+
+// files are the paths watched for changes
+func (r *CertReloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+func (r *CertReloader) stat() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+// load builds the configuration of the files
+func (r *CertReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.opts.ClientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(r.opts.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", r.opts.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if r.opts.OptionalClientCert {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientIdentity is the client of a mutual TLS connection, read from its verified certificate
+type ClientIdentity struct {
+	CommonName string
+	// SANs are the subject alternative names: URIs, DNS names and email addresses
+	SANs []string
+}
+
+// Has tells if the certificate names the client with the SAN
+func (c *ClientIdentity) Has(san string) bool {
+	return slices.Contains(c.SANs, san)
+}
+
+// ClientIdentityFromContext returns the identity of the verified client certificate of a call
+// Calls without TLS or without client certificate have none
+func ClientIdentityFromContext(ctx context.Context) (*ClientIdentity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	leaf := info.State.VerifiedChains[0][0]
+	id := &ClientIdentity{CommonName: leaf.Subject.CommonName}
+	for _, uri := range leaf.URIs {
+		id.SANs = append(id.SANs, uri.String())
+	}
+	id.SANs = append(id.SANs, leaf.DNSNames...)
+	id.SANs = append(id.SANs, leaf.EmailAddresses...)
+	return id, true
+}
@@ -0,0 +1,226 @@
+package user
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const billingSAN = "spiffe://esl/billing"
+
+// testCA signs the certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, "ca.pem")}
+	require.NoError(t, os.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return ca
+}
+
+// issue writes a certificate signed by the CA and its key to name.pem and name-key.pem
+func (ca *testCA) issue(t *testing.T, dir, name string, template *x509.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func (ca *testCA) issueServer(t *testing.T, dir, name string) (certFile, keyFile string) {
+	return ca.issue(t, dir, name, &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+}
+
+func (ca *testCA) issueClient(t *testing.T, dir, name string, uri string) tls.Certificate {
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	certFile, keyFile := ca.issue(t, dir, name, &x509.Certificate{
+		URIs:        []*url.URL{u},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return cert
+}
+
+// serveTLS starts a health server on TLS, recording the client identity seen by the interceptors
+func serveTLS(t *testing.T, reloader *CertReloader, policy map[string]Rule) (string, chan *ClientIdentity) {
+	t.Helper()
+	seen := make(chan *ClientIdentity, 10)
+	record := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id, _ := ClientIdentityFromContext(ctx)
+		seen <- id
+		return handler(ctx, req)
+	}
+	authorizer := NewAuthorizer(user.NewHS256TokenManager([]byte("secret"), time.Minute), policy)
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(reloader.TLSConfig())),
+		grpc.ChainUnaryInterceptor(record, authorizer.UnaryInterceptor()),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String(), seen
+}
+
+// check calls the health service with a new connection and returns the certificate of the server
+func check(t *testing.T, addr string, ca *testCA, client *tls.Certificate) (*x509.Certificate, error) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var p peer.Peer
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p))
+	if err != nil {
+		return nil, err
+	}
+	return p.AuthInfo.(credentials.TLSInfo).State.PeerCertificates[0], nil
+}
+
+// TestMutualTLS test the client certificates are verified and their SANs reach the interceptors
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issueServer(t, dir, "server")
+	billing := ca.issueClient(t, dir, "billing", billingSAN)
+	other := ca.issueClient(t, dir, "other", "spiffe://esl/other")
+	stranger := newTestCA(t, t.TempDir()).issueClient(t, t.TempDir(), "stranger", billingSAN)
+
+	t.Run("required", func(t *testing.T) {
+		reloader, err := NewCertReloader(ServerTLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file})
+		require.NoError(t, err)
+		addr, seen := serveTLS(t, reloader, DefaultPolicy)
+
+		_, err = check(t, addr, ca, &billing)
+		require.NoError(t, err)
+		id := <-seen
+		require.NotNil(t, id)
+		assert.Equal(t, "billing", id.CommonName)
+		assert.True(t, id.Has(billingSAN))
+
+		_, err = check(t, addr, ca, nil)
+		assert.Equal(t, codes.Unavailable, status.Code(err), "the handshake fails without client certificate")
+		_, err = check(t, addr, ca, &stranger)
+		assert.Equal(t, codes.Unavailable, status.Code(err), "the handshake fails with a certificate of another CA")
+	})
+
+	t.Run("optional with peers policy", func(t *testing.T) {
+		reloader, err := NewCertReloader(ServerTLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file, OptionalClientCert: true})
+		require.NoError(t, err)
+		policy := map[string]Rule{healthpb.Health_Check_FullMethodName: {Peers: []string{billingSAN}}}
+		addr, seen := serveTLS(t, reloader, policy)
+
+		_, err = check(t, addr, ca, &billing)
+		assert.NoError(t, err, "the billing service is allowed without token")
+		_, err = check(t, addr, ca, &other)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), "other services need a token")
+		_, err = check(t, addr, ca, nil)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.True(t, (<-seen).Has(billingSAN))
+		assert.False(t, (<-seen).Has(billingSAN))
+		assert.Nil(t, <-seen, "the call without certificate has no client identity")
+	})
+}
+
+// TestCertReloader test a rotated certificate is served to new connections
+// and a broken rotation keeps the previous one
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issueServer(t, dir, "server")
+	reloader, err := NewCertReloader(ServerTLSOptions{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	addr, _ := serveTLS(t, reloader, map[string]Rule{healthpb.Health_Check_FullMethodName: {Public: true}})
+
+	served, err := check(t, addr, ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "server", served.Subject.CommonName)
+
+	// rotate through temporary files then rename them over the served ones
+	rotated := t.TempDir()
+	newCert, newKey := ca.issueServer(t, rotated, "rotated")
+	require.NoError(t, os.Rename(newCert, certFile))
+	require.NoError(t, os.Rename(newKey, keyFile))
+	served, err = check(t, addr, ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", served.Subject.CommonName)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("half written"), 0600))
+	served, err = check(t, addr, ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", served.Subject.CommonName, "the broken key keeps the previous certificate")
+}
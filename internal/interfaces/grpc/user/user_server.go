@@ -5,8 +5,6 @@ import (
 	"github.com/dylan-dinh/esl-test/internal/domain/user"
 	"time"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -35,7 +33,7 @@ func (s *UserServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*C
 	}
 
 	if err := s.service.CreateUser(ctx, newUser); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
+		return nil, toStatus(err)
 	}
 
 	return &CreateUserResponse{
@@ -45,6 +43,8 @@ func (s *UserServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*C
 }
 
 // UpdateUser is the RPC method to update a user information
+// Only the fields named in the update mask are changed
+// A stale expected version is answered with Aborted and the current version
 func (s *UserServer) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*UpdateUserResponse, error) {
 	updatedUser := &user.User{
 		ID:        req.Id,
@@ -54,24 +54,50 @@ func (s *UserServer) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*U
 		Email:     req.Email,
 		Country:   req.Country,
 		Password:  req.Password,
+		Version:   req.ExpectedVersion,
 	}
 
-	if err := s.service.UpdateUser(ctx, updatedUser); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
+	if err := s.service.UpdateUser(ctx, updatedUser, req.GetUpdateMask().GetPaths()); err != nil {
+		return nil, toStatus(err)
 	}
 
 	return &UpdateUserResponse{
 		Id:        req.Id,
 		UpdatedAt: timestamppb.New(updatedUser.UpdatedAt),
+		Version:   updatedUser.Version,
 	}, nil
 }
 
-// DeleteUser is the RPC method to delete a user
+// DeleteUser is the RPC method to soft delete a user
 func (s *UserServer) DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error) {
-	if err := s.service.DeleteUser(ctx, req.Id); err != nil {
-		return nil, err
+	u, err := s.service.DeleteUser(ctx, req.Id, req.ExpectedVersion)
+	if err != nil {
+		return nil, toStatus(err)
 	}
 	return &DeleteUserResponse{
+		Id:        u.ID,
+		DeletedAt: timestamppb.New(*u.DeletedAt),
+	}, nil
+}
+
+// RestoreUser is the RPC method to restore a soft deleted user
+func (s *UserServer) RestoreUser(ctx context.Context, req *RestoreUserRequest) (*RestoreUserResponse, error) {
+	u, err := s.service.RestoreUser(ctx, req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &RestoreUserResponse{
+		Id:      u.ID,
+		Version: u.Version,
+	}, nil
+}
+
+// PurgeUser is the RPC method to permanently remove a soft deleted user
+func (s *UserServer) PurgeUser(ctx context.Context, req *PurgeUserRequest) (*PurgeUserResponse, error) {
+	if err := s.service.PurgeUser(ctx, req.GetId()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &PurgeUserResponse{
 		Id: req.GetId(),
 	}, nil
 }
@@ -82,7 +108,7 @@ func (s *UserServer) GetUserById(ctx context.Context, req *GetUserRequest) (*Get
 	var err error
 
 	if u, err = s.service.GetUser(ctx, req.Id); err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
 	return &GetUserResponse{
@@ -91,26 +117,41 @@ func (s *UserServer) GetUserById(ctx context.Context, req *GetUserRequest) (*Get
 		Nickname:  u.Nickname,
 		Email:     u.Email,
 		Country:   u.Country,
+		Roles:     u.Roles,
+		Version:   u.Version,
 	}, nil
 }
 
 // ListUsers implements the ListUsers RPC.
+// Clients page with next_page_token, page numbers are kept for older clients
 func (s *UserServer) ListUsers(ctx context.Context, req *ListUsersRequest) (*ListUsersResponse, error) {
 	filter := &user.UserFilter{
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		Country:   req.Country,
-		Page:      req.Page,
-		PageSize:  req.PageSize,
+		FirstName:       req.FirstName,
+		LastName:        req.LastName,
+		Country:         req.Country,
+		Role:            req.Role,
+		FirstNamePrefix: req.FirstNamePrefix,
+		LastNamePrefix:  req.LastNamePrefix,
+		NicknamePrefix:  req.NicknamePrefix,
+		EmailDomain:     req.EmailDomain,
+		Countries:       req.Countries,
+		CreatedAfter:    timeOrZero(req.CreatedAfter),
+		CreatedBefore:   timeOrZero(req.CreatedBefore),
+		UpdatedAfter:    timeOrZero(req.UpdatedAfter),
+		UpdatedBefore:   timeOrZero(req.UpdatedBefore),
+		OrderBy:         req.OrderBy,
+		PageToken:       req.PageToken,
+		Page:            req.Page,
+		PageSize:        req.PageSize,
 	}
 
-	users, total, err := s.service.ListUsers(ctx, filter)
+	page, err := s.service.ListUsers(ctx, filter)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to list users: %v", err)
+		return nil, toStatus(err)
 	}
 
 	var pbUsers []*User
-	for _, u := range users {
+	for _, u := range page.Users {
 		pbUsers = append(pbUsers, &User{
 			Id:        u.ID,
 			FirstName: u.FirstName,
@@ -118,13 +159,42 @@ func (s *UserServer) ListUsers(ctx context.Context, req *ListUsersRequest) (*Lis
 			Nickname:  u.Nickname,
 			Email:     u.Email,
 			Country:   u.Country,
+			Roles:     u.Roles,
+			Version:   u.Version,
 			CreatedAt: timestamppb.New(u.CreatedAt),
 			UpdatedAt: timestamppb.New(u.UpdatedAt),
 		})
 	}
 
 	return &ListUsersResponse{
-		Users:      pbUsers,
-		TotalCount: total,
+		Users:         pbUsers,
+		TotalCount:    page.Total,
+		NextPageToken: page.NextPageToken,
 	}, nil
 }
+
+// timeOrZero converts an optional timestamp, unset is the zero time
+func timeOrZero(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// GrantRole is the RPC method to grant a role to a user
+func (s *UserServer) GrantRole(ctx context.Context, req *GrantRoleRequest) (*RoleResponse, error) {
+	u, err := s.service.GrantRole(ctx, req.GetUserId(), req.GetRole())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &RoleResponse{UserId: u.ID, Roles: u.Roles}, nil
+}
+
+// RevokeRole is the RPC method to revoke a role from a user
+func (s *UserServer) RevokeRole(ctx context.Context, req *RevokeRoleRequest) (*RoleResponse, error) {
+	u, err := s.service.RevokeRole(ctx, req.GetUserId(), req.GetRole())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &RoleResponse{UserId: u.ID, Roles: u.Roles}, nil
+}
@@ -5,10 +5,15 @@ package user
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"github.com/dylan-dinh/esl-test/internal/domain/user"
 	"github.com/dylan-dinh/esl-test/internal/interfaces/notifier"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -29,16 +34,17 @@ func declareAndBindQueue(t *testing.T, mq *user.RabbitMQ, routingKey string) str
 	return q.Name
 }
 
-// assertPublished helper func to be allowed to compare any type of data
-// Below we only compare ID but in the future we might compare more complex and different object
-// thus the generic parameter
-func assertPublished[T any](t *testing.T, mq *user.RabbitMQ, queueName string, assertFn func(t *testing.T, actual T)) {
+// assertPublished waits for the next event of the queue and decodes it
+// the way consumers do
+func assertPublished(t *testing.T, mq *user.RabbitMQ, queueName string, assertFn func(t *testing.T, actual *user.Event)) {
 	msgs, err := mq.Ch.Consume(queueName, "", true, true, false, false, nil)
 	assert.NoError(t, err)
 	select {
 	case msg := <-msgs:
-		var actual T
-		require.NoError(t, json.Unmarshal(msg.Body, &actual))
+		actual, err := user.DecodeCloudEvent(msg)
+		require.NoError(t, err)
+		assert.Equal(t, actual.ID, msg.MessageId)
+		assert.NotContains(t, string(msg.Body), "password")
 		if assertFn != nil {
 			assertFn(t, actual)
 		} else {
@@ -63,17 +69,26 @@ func setupIntegrationTest(t *testing.T) (user.Service, func(), *user.RabbitMQ) {
 	rabbitConn, err := notifier.NewRabbitMQConn(conf)
 	require.NoError(t, err)
 
-	mq, err := user.NewRabbitMQ(rabbitConn)
+	mq, err := user.NewRabbitMQ(rabbitConn, notifier.RabbitMQOptions(conf))
 	require.NoError(t, err)
 
 	userRepo, err := repository.NewUserRepository(newDb.DB, conf.DbName)
 	require.NoError(t, err)
-	userSvc := user.NewUserService(userRepo, mq)
+	outboxRepo, err := repository.NewOutboxRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	tokenRepo, err := repository.NewRefreshTokenRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	userSvc := user.NewUserService(userRepo, outboxRepo, tokenRepo, repository.NewTransactor(newDb.DB))
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	go user.NewRelay(outboxRepo, mq).Run(relayCtx)
 
 	cleanup := func() {
+		stopRelay()
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		_ = newDb.DB.Database(conf.DbName).Collection("users").Drop(ctx)
+		_ = newDb.DB.Database(conf.DbName).Collection("outbox").Drop(ctx)
 		_ = newDb.DB.Disconnect(ctx)
 		_ = rabbitConn.Close()
 	}
@@ -101,8 +116,8 @@ func TestCreateUserIntegration(t *testing.T) {
 	}
 
 	err := userSvc.CreateUser(ctx, testUser)
-	assertPublished[user.User](t, mq, queueName, func(t *testing.T, actual user.User) {
-		assert.Equal(t, testUser.ID, actual.ID)
+	assertPublished(t, mq, queueName, func(t *testing.T, actual *user.Event) {
+		assert.Equal(t, testUser.ID, actual.User.ID)
 	})
 	assert.NoError(t, err, "CreateUser should not return an error")
 	assert.NotEmpty(t, testUser.ID, "User ID should be generated")
@@ -140,11 +155,15 @@ func TestUpdateUserIntegration(t *testing.T) {
 	testUser.Password = "newplainpassword"
 	testUser.UpdatedAt = time.Now()
 
-	err = userSvc.UpdateUser(ctx, testUser)
+	err = userSvc.UpdateUser(ctx, testUser, nil)
 	assert.NoError(t, err, "UpdateUser should not return an error")
+	assert.Equal(t, int64(2), testUser.Version, "the updated user is loaded back")
 
-	assertPublished[user.User](t, mq, queueName, func(t *testing.T, actual user.User) {
-		assert.Equal(t, testUser.ID, actual.ID)
+	assertPublished(t, mq, queueName, func(t *testing.T, actual *user.Event) {
+		assert.Equal(t, testUser.ID, actual.User.ID)
+		assert.Contains(t, actual.Changes, user.FieldChange{Field: user.FieldEmail, Old: "testuser@faceit.com", New: "updated@faceit.com"})
+		assert.Contains(t, actual.Changes, user.FieldChange{Field: user.FieldCountry, Old: "FR", New: "UK"})
+		assert.Contains(t, actual.Changes, user.FieldChange{Field: user.FieldPassword, Old: user.Redacted, New: user.Redacted})
 	})
 
 	// Retrieve the user via the GetUser method to verify the update
@@ -157,6 +176,36 @@ func TestUpdateUserIntegration(t *testing.T) {
 	assert.Equal(t, "UK", updatedUser.Country, "Country should be updated")
 }
 
+// TestPartialUpdateUserIntegration test that an update mask only changes the fields it names
+func TestPartialUpdateUserIntegration(t *testing.T) {
+	userSvc, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	testUser := &user.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Nickname:  "test_user",
+		Email:     "testuser@faceit.com",
+		Country:   "FR",
+		Password:  "password",
+	}
+	err := userSvc.CreateUser(ctx, testUser)
+	require.NoError(t, err, "CreateUser should succeed")
+
+	err = userSvc.UpdateUser(ctx, &user.User{ID: testUser.ID, Nickname: "new_nickname", Version: testUser.Version}, []string{user.FieldNickname})
+	require.NoError(t, err, "UpdateUser should succeed")
+
+	updatedUser, err := userSvc.GetUser(ctx, testUser.ID)
+	require.NoError(t, err, "GetUser should succeed")
+	assert.Equal(t, "new_nickname", updatedUser.Nickname, "Nickname should be updated")
+	assert.Equal(t, testUser.Email, updatedUser.Email, "Email should be kept")
+	assert.Equal(t, testUser.Country, updatedUser.Country, "Country should be kept")
+	assert.Equal(t, testUser.FirstName, updatedUser.FirstName, "FirstName should be kept")
+}
+
 // TestCreateUserIntegration test user delete and assert that message
 // is received in the rabbit
 func TestDeleteUserIntegration(t *testing.T) {
@@ -181,17 +230,224 @@ func TestDeleteUserIntegration(t *testing.T) {
 	require.NoError(t, err, "CreateUser should succeed")
 	require.NotEmpty(t, testUser.ID, "User ID should be generated")
 
-	err = userSvc.DeleteUser(ctx, testUser.ID)
+	deleted, err := userSvc.DeleteUser(ctx, testUser.ID, testUser.Version)
 	require.NoError(t, err, "DeleteUser should succeed")
+	require.NotNil(t, deleted.DeletedAt)
 
-	assertPublished[string](t, mq, queueName, func(t *testing.T, actual string) {
-		assert.Equal(t, testUser.ID, actual)
+	assertPublished(t, mq, queueName, func(t *testing.T, actual *user.Event) {
+		assert.Equal(t, user.UserDeletedRoutingKey, actual.Type)
+		assert.Equal(t, testUser.ID, actual.User.ID)
+		require.NotNil(t, actual.User.DeletedAt)
+		assert.True(t, deleted.DeletedAt.Equal(*actual.User.DeletedAt), "the response and the event report the same deletion time")
 	})
 
 	_, err = userSvc.GetUser(ctx, testUser.ID)
 	assert.Error(t, err, "Expected error when retrieving a deleted user")
 }
 
+// TestRestorePurgeUserIntegration test that a soft deleted user is hidden, can be restored and purged
+func TestRestorePurgeUserIntegration(t *testing.T) {
+	userSvc, cleanup, mq := setupIntegrationTest(t)
+	defer cleanup()
+
+	queueName := declareAndBindQueue(t, mq, user.UserRestoredRoutingKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	testUser := &user.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     "testuser@faceit.com",
+		Country:   "FR",
+		Password:  "password",
+	}
+	require.NoError(t, userSvc.CreateUser(ctx, testUser), "CreateUser should succeed")
+	_, err := userSvc.DeleteUser(ctx, testUser.ID, testUser.Version)
+	require.NoError(t, err, "DeleteUser should succeed")
+
+	_, err = userSvc.GetUser(ctx, testUser.ID)
+	assert.ErrorIs(t, err, user.ErrNotFound, "deleted user should be hidden")
+	page, err := userSvc.ListUsers(ctx, &user.UserFilter{Country: "FR", Page: 1, PageSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), page.Total, "deleted user should not be listed")
+
+	restored, err := userSvc.RestoreUser(ctx, testUser.ID)
+	require.NoError(t, err, "RestoreUser should succeed")
+	assert.Equal(t, testUser.Email, restored.Email)
+	assertPublished(t, mq, queueName, func(t *testing.T, actual *user.Event) {
+		assert.Equal(t, testUser.ID, actual.User.ID)
+	})
+
+	_, err = userSvc.GetUser(ctx, testUser.ID)
+	assert.NoError(t, err, "restored user should be visible")
+
+	assert.ErrorIs(t, userSvc.PurgeUser(ctx, testUser.ID), user.ErrNotDeleted, "a live user can't be purged")
+	_, err = userSvc.DeleteUser(ctx, testUser.ID, restored.Version)
+	require.NoError(t, err)
+
+	purged, err := userSvc.PurgeDeleted(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = userSvc.RestoreUser(ctx, testUser.ID)
+	assert.ErrorIs(t, err, user.ErrNotFound, "a purged user is gone")
+}
+
+// TestLoginIntegration test the login flow against the stored password hash
+func TestLoginIntegration(t *testing.T) {
+	userSvc, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+	newDb, err := db.NewDb(conf)
+	require.NoError(t, err)
+	defer func() {
+		_ = newDb.DB.Database(conf.DbName).Collection("refresh_tokens").Drop(ctx)
+		_ = newDb.DB.Disconnect(ctx)
+	}()
+	userRepo, err := repository.NewUserRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	tokenRepo, err := repository.NewRefreshTokenRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	manager := user.NewHS256TokenManager([]byte(conf.JwtSecret), conf.AccessTokenTTL)
+	authSvc := user.NewAuthService(userRepo, tokenRepo, manager, conf.RefreshTokenTTL)
+
+	testUser := &user.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     "testuser@faceit.com",
+		Password:  "password",
+	}
+	require.NoError(t, userSvc.CreateUser(ctx, testUser), "CreateUser should succeed")
+
+	_, err = authSvc.Login(ctx, testUser.Email, "wrong")
+	assert.ErrorIs(t, err, user.ErrInvalidCredentials)
+
+	tokens, err := authSvc.Login(ctx, testUser.Email, "password")
+	require.NoError(t, err, "Login should succeed")
+	claims, err := manager.Verify(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, testUser.ID, claims.Subject)
+
+	require.NoError(t, authSvc.Logout(ctx, tokens.RefreshToken), "Logout should succeed")
+	_, err = authSvc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, user.ErrInvalidToken, "refresh token should be revoked")
+}
+
+// TestGrantRoleIntegration test role changes, listing by role and the roles changed event
+func TestGrantRoleIntegration(t *testing.T) {
+	userSvc, cleanup, mq := setupIntegrationTest(t)
+	defer cleanup()
+
+	queueName := declareAndBindQueue(t, mq, user.UserRolesChangedRoutingKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	testUser := &user.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     "testuser@faceit.com",
+		Password:  "password",
+	}
+	require.NoError(t, userSvc.CreateUser(ctx, testUser), "CreateUser should succeed")
+
+	// leave a gap with the creation as mongo keeps milliseconds
+	time.Sleep(5 * time.Millisecond)
+	granted, err := userSvc.GrantRole(ctx, testUser.ID, user.RoleAdmin)
+	require.NoError(t, err, "GrantRole should succeed")
+	assert.Equal(t, []string{user.RoleAdmin}, granted.Roles)
+	assert.True(t, granted.UpdatedAt.After(testUser.UpdatedAt), "a role change should update updated_at")
+
+	assertPublished(t, mq, queueName, func(t *testing.T, actual *user.Event) {
+		assert.Equal(t, testUser.ID, actual.User.ID)
+		assert.Equal(t, []string{user.RoleAdmin}, actual.User.Roles)
+	})
+
+	admins, err := userSvc.ListUsers(ctx, &user.UserFilter{Role: user.RoleAdmin, Page: 1, PageSize: 10})
+	require.NoError(t, err, "ListUsers should succeed")
+	assert.Equal(t, int64(1), admins.Total)
+	assert.Equal(t, testUser.ID, admins.Users[0].ID)
+
+	revoked, err := userSvc.RevokeRole(ctx, testUser.ID, user.RoleAdmin)
+	require.NoError(t, err, "RevokeRole should succeed")
+	assert.Empty(t, revoked.Roles)
+	assert.False(t, revoked.UpdatedAt.Before(granted.UpdatedAt))
+}
+
+// TestConcurrentUpdateUserIntegration test that a write with a stale version is refused
+func TestConcurrentUpdateUserIntegration(t *testing.T) {
+	userSvc, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	testUser := &user.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     "testuser@faceit.com",
+		Password:  "password",
+	}
+	require.NoError(t, userSvc.CreateUser(ctx, testUser), "CreateUser should succeed")
+	require.Equal(t, int64(1), testUser.Version)
+
+	first := &user.User{ID: testUser.ID, Nickname: "first", Version: 1}
+	require.NoError(t, userSvc.UpdateUser(ctx, first, []string{user.FieldNickname}), "first update should succeed")
+	assert.Equal(t, int64(2), first.Version)
+
+	second := &user.User{ID: testUser.ID, Nickname: "second", Version: 1}
+	err := userSvc.UpdateUser(ctx, second, []string{user.FieldNickname})
+	var conflict *user.VersionConflictError
+	require.ErrorAs(t, err, &conflict, "stale update should be refused")
+	assert.Equal(t, int64(2), conflict.Current)
+
+	_, err = userSvc.DeleteUser(ctx, testUser.ID, 1)
+	assert.ErrorIs(t, err, user.ErrConflict, "stale delete should be refused")
+
+	err = userSvc.UpdateUser(ctx, &user.User{ID: testUser.ID, Nickname: "unchecked"}, []string{user.FieldNickname})
+	require.ErrorAs(t, err, &conflict, "an update without version should be refused")
+	assert.Equal(t, int64(2), conflict.Current)
+
+	got, err := userSvc.GetUser(ctx, testUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "first", got.Nickname)
+	assert.Equal(t, int64(2), got.Version)
+
+	_, err = userSvc.DeleteUser(ctx, testUser.ID, 2)
+	assert.NoError(t, err, "delete with the current version should succeed")
+}
+
+// TestBackfillVersionIntegration test that the users stored without version get the first one
+func TestBackfillVersionIntegration(t *testing.T) {
+	_, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+	newDb, err := db.NewDb(conf)
+	require.NoError(t, err)
+	defer newDb.DB.Disconnect(ctx)
+
+	_, err = newDb.DB.Database(conf.DbName).Collection("users").InsertOne(ctx, bson.D{
+		{Key: "id", Value: "legacy"}, {Key: "email", Value: "legacy@faceit.com"},
+	})
+	require.NoError(t, err)
+
+	userRepo, err := repository.NewUserRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	legacy, err := userRepo.GetByID(ctx, "legacy")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), legacy.Version)
+}
+
 func TestGetUserIntegration(t *testing.T) {
 	userSvc, cleanup, _ := setupIntegrationTest(t)
 	defer cleanup()
@@ -323,10 +579,270 @@ func TestListUsersByFirstNameIntegration(t *testing.T) {
 				Page:      tc.page,
 				PageSize:  tc.pageSize,
 			}
-			listedUsers, total, err := userSvc.ListUsers(ctx, filter)
+			page, err := userSvc.ListUsers(ctx, filter)
 			require.NoError(t, err, "ListUsers should succeed")
-			assert.Equal(t, tc.expectedTotal, total, "expected total count")
-			assert.Equal(t, tc.expectedSlice, len(listedUsers), "expected slice length")
+			assert.Equal(t, tc.expectedTotal, page.Total, "expected total count")
+			assert.Equal(t, tc.expectedSlice, len(page.Users), "expected slice length")
 		})
 	}
 }
+
+// TestListUsersWithPageTokenIntegration test that paging with tokens returns every user once
+// even when users are created while paging
+func TestListUsersWithPageTokenIntegration(t *testing.T) {
+	userSvc, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	create := func(i int) string {
+		u := &user.User{
+			FirstName: "Page",
+			LastName:  "User",
+			Email:     fmt.Sprintf("page%d@faceit.com", i),
+			Password:  "password",
+		}
+		require.NoError(t, userSvc.CreateUser(ctx, u), "CreateUser should succeed")
+		return u.ID
+	}
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		created = append(created, create(i))
+	}
+
+	var seen []string
+	filter := &user.UserFilter{PageSize: 2}
+	for {
+		page, err := userSvc.ListUsers(ctx, filter)
+		require.NoError(t, err, "ListUsers should succeed")
+		for _, u := range page.Users {
+			seen = append(seen, u.ID)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		// users created while paging come after the cursor
+		if len(seen) == 2 {
+			created = append(created, create(5))
+		}
+		filter = &user.UserFilter{PageSize: 2, PageToken: page.NextPageToken}
+	}
+
+	assert.Equal(t, created, seen, "every user should be listed once, in creation order")
+}
+
+// TestListUsersSortAndFiltersIntegration test the back office listing of the newest
+// French users whose nickname starts with "ace", paged with tokens
+func TestListUsersSortAndFiltersIntegration(t *testing.T) {
+	userSvc, cleanup, _ := setupIntegrationTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users := []struct{ nickname, country, email string }{
+		{"Ace1", "FR", "ace1@faceit.com"},
+		{"aceOfSpades", "FR", "ace2@esl.com"},
+		{"ace3", "DE", "ace3@faceit.com"},
+		{"bace", "FR", "bace@faceit.com"},
+		{"ACE4", "FR", "ace4@FACEIT.com"},
+	}
+	ids := map[string]string{}
+	for _, u := range users {
+		created := &user.User{
+			FirstName: "Sort",
+			LastName:  "User",
+			Nickname:  u.nickname,
+			Email:     u.email,
+			Country:   u.country,
+			Password:  "password",
+		}
+		require.NoError(t, userSvc.CreateUser(ctx, created), "CreateUser should succeed")
+		ids[u.nickname] = created.ID
+		// created_at has a millisecond precision in mongo
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var seen []string
+	filter := &user.UserFilter{Countries: []string{"FR"}, NicknamePrefix: "ace", OrderBy: "created_at desc", PageSize: 2}
+	for {
+		page, err := userSvc.ListUsers(ctx, filter)
+		require.NoError(t, err, "ListUsers should succeed")
+		if filter.PageToken == "" {
+			assert.Equal(t, int64(3), page.Total)
+		} else {
+			assert.Zero(t, page.Total, "only the first page is counted")
+		}
+		for _, u := range page.Users {
+			seen = append(seen, u.Nickname)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		filter.PageToken = page.NextPageToken
+	}
+	assert.Equal(t, []string{"ACE4", "aceOfSpades", "Ace1"}, seen, "newest first")
+
+	page, err := userSvc.ListUsers(ctx, &user.UserFilter{EmailDomain: "faceit.com", OrderBy: "nickname"})
+	require.NoError(t, err, "ListUsers should succeed")
+	var nicknames []string
+	for _, u := range page.Users {
+		nicknames = append(nicknames, u.Nickname)
+	}
+	assert.Equal(t, []string{"ACE4", "Ace1", "ace3", "bace"}, nicknames, "case insensitive domain, sorted by nickname")
+
+	page, err = userSvc.ListUsers(ctx, &user.UserFilter{Countries: []string{"DE", "FR"}, NicknamePrefix: "ACE3"})
+	require.NoError(t, err, "ListUsers should succeed")
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, ids["ace3"], page.Users[0].ID)
+
+	_, err = userSvc.ListUsers(ctx, &user.UserFilter{OrderBy: "nickname", PageToken: filter.PageToken})
+	assert.ErrorIs(t, err, user.ErrInvalidPageToken, "a token can't resume another order")
+}
+
+// TestConcurrentPublishIntegration test that events published at once are all confirmed
+// and delivered once
+func TestConcurrentPublishIntegration(t *testing.T) {
+	_, cleanup, mq := setupIntegrationTest(t)
+	defer cleanup()
+
+	queueName := declareAndBindQueue(t, mq, "user.stress")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const events = 100
+	errs := make(chan error, events)
+	for i := range events {
+		go func() {
+			e := user.NewOutboxEvent("user.stress", &user.User{ID: fmt.Sprintf("user-%d", i)}).Event()
+			errs <- mq.UserCreatedEvent(ctx, e)
+		}()
+	}
+	for range events {
+		require.NoError(t, <-errs, "every event should be confirmed")
+	}
+
+	msgs, err := mq.Ch.Consume(queueName, "", true, true, false, false, nil)
+	require.NoError(t, err)
+	seen := map[string]bool{}
+	for len(seen) < events {
+		select {
+		case msg := <-msgs:
+			assert.False(t, seen[msg.MessageId], "event delivered twice")
+			seen[msg.MessageId] = true
+		case <-ctx.Done():
+			t.Fatalf("only %d events of %d arrived", len(seen), events)
+		}
+	}
+}
+
+// TestDeadLetterIntegration test that a message rejected by a team queue of the topology
+// is routed to the dead letter queue
+func TestDeadLetterIntegration(t *testing.T) {
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+	conn, err := notifier.NewRabbitMQConn(conf)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	opts := notifier.RabbitMQOptions(conf)
+	opts.Topology = user.Topology{
+		Queues:             []user.QueueSpec{{Name: "it.billing", BindingKeys: []string{"user.dead_letter_test"}}},
+		Persistent:         true,
+		DeadLetterExchange: "it.billing.dlx",
+		DeadLetterQueue:    "it.billing.dlq",
+		MessageTTL:         time.Minute,
+	}
+	mq, err := user.NewRabbitMQ(conn, opts)
+	require.NoError(t, err)
+	defer func() {
+		_, _ = mq.Ch.QueueDelete("it.billing", false, false, false)
+		_, _ = mq.Ch.QueueDelete("it.billing.dlq", false, false, false)
+		_ = mq.Ch.ExchangeDelete("it.billing.dlx", false, false)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e := user.NewOutboxEvent("user.dead_letter_test", &user.User{ID: "poison"}).Event()
+	require.NoError(t, mq.UserCreatedEvent(ctx, e))
+
+	msg, ok, err := mq.Ch.Get("it.billing", false)
+	require.NoError(t, err)
+	require.True(t, ok, "the event should reach the team queue")
+	assert.Equal(t, uint8(amqp.Persistent), msg.DeliveryMode)
+	require.NoError(t, msg.Nack(false, false))
+
+	for {
+		dead, ok, err := mq.Ch.Get("it.billing.dlq", true)
+		require.NoError(t, err)
+		if ok {
+			assert.Equal(t, e.ID, dead.MessageId)
+			assert.Contains(t, dead.Headers, "x-death")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("the rejected event never reached the dead letter queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// TestWebhookDeliveryIntegration test that an event is posted once to a subscriber
+// and logged as delivered
+func TestWebhookDeliveryIntegration(t *testing.T) {
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+	newDb, err := db.NewDb(conf)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer func() {
+		_ = newDb.DB.Database(conf.DbName).Collection("webhook_subscriptions").Drop(ctx)
+		_ = newDb.DB.Database(conf.DbName).Collection("webhook_deliveries").Drop(ctx)
+		_ = newDb.DB.Disconnect(ctx)
+	}()
+
+	subscriptionRepo, err := repository.NewSubscriptionRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	deliveryRepo, err := repository.NewDeliveryRepository(newDb.DB, conf.DbName)
+	require.NoError(t, err)
+	svc := user.NewWebhookService(subscriptionRepo, deliveryRepo)
+
+	received := make(chan string, 10)
+	var secret string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := user.VerifyWebhook(secret, r.Header, body, user.DefaultWebhookTolerance, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received <- r.Header.Get(user.WebhookEventHeader)
+	}))
+	defer server.Close()
+
+	sub, err := svc.CreateSubscription(ctx, server.URL, []string{user.UserCreatedRoutingKey})
+	require.NoError(t, err)
+	secret = sub.Secret
+
+	notifier := user.NewWebhookNotifier(subscriptionRepo, deliveryRepo, conf.CloudEventsSource)
+	created := user.NewOutboxEvent(user.UserCreatedRoutingKey, &user.User{ID: "u1"}).Event()
+	require.NoError(t, notifier.UserCreatedEvent(ctx, created))
+	require.NoError(t, notifier.UserCreatedEvent(ctx, created), "a relayed twice event is queued once")
+	require.NoError(t, notifier.UserDeletedEvent(ctx, user.NewOutboxEvent(user.UserDeletedRoutingKey, &user.User{ID: "u1"}).Event()))
+
+	sent, err := user.NewWebhookDispatcher(subscriptionRepo, deliveryRepo, user.WebhookDispatcherOptions{}).DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, user.UserCreatedRoutingKey, <-received)
+
+	deliveries, err := svc.ListDeliveries(ctx, sub.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, user.DeliverySucceeded, deliveries[0].Status)
+	assert.Equal(t, created.ID, deliveries[0].EventID)
+	assert.Equal(t, http.StatusOK, deliveries[0].LastStatusCode)
+}
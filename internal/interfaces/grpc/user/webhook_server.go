@@ -0,0 +1,109 @@
+package user
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// WebhookServer implements WebhookServiceServer and we inject the webhook service
+type WebhookServer struct {
+	UnimplementedWebhookServiceServer
+	service user.WebhookService
+}
+
+// NewWebhookServer creates a new WebhookServer with the given service.
+func NewWebhookServer(svc user.WebhookService) *WebhookServer {
+	return &WebhookServer{service: svc}
+}
+
+// CreateSubscription is the RPC method to register a webhook endpoint
+// The secret signing the requests is only returned here
+func (s *WebhookServer) CreateSubscription(ctx context.Context, req *CreateSubscriptionRequest) (*CreateSubscriptionResponse, error) {
+	sub, err := s.service.CreateSubscription(ctx, req.GetUrl(), req.GetEventTypes())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &CreateSubscriptionResponse{Subscription: toSubscription(sub), Secret: sub.Secret}, nil
+}
+
+// GetSubscription is the RPC method to get a subscription
+func (s *WebhookServer) GetSubscription(ctx context.Context, req *GetSubscriptionRequest) (*Subscription, error) {
+	sub, err := s.service.GetSubscription(ctx, req.GetId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toSubscription(sub), nil
+}
+
+// ListSubscriptions is the RPC method to list the subscriptions
+func (s *WebhookServer) ListSubscriptions(ctx context.Context, _ *ListSubscriptionsRequest) (*ListSubscriptionsResponse, error) {
+	subs, err := s.service.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ListSubscriptionsResponse{}
+	for i := range subs {
+		resp.Subscriptions = append(resp.Subscriptions, toSubscription(&subs[i]))
+	}
+	return resp, nil
+}
+
+// DeleteSubscription is the RPC method to remove a subscription
+func (s *WebhookServer) DeleteSubscription(ctx context.Context, req *DeleteSubscriptionRequest) (*DeleteSubscriptionResponse, error) {
+	if err := s.service.DeleteSubscription(ctx, req.GetId()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteSubscriptionResponse{}, nil
+}
+
+// SetSubscriptionEnabled is the RPC method to enable or disable a subscription
+func (s *WebhookServer) SetSubscriptionEnabled(ctx context.Context, req *SetSubscriptionEnabledRequest) (*Subscription, error) {
+	sub, err := s.service.SetSubscriptionEnabled(ctx, req.GetId(), req.GetEnabled())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toSubscription(sub), nil
+}
+
+// ListDeliveries is the RPC method to read the delivery log of a subscription
+func (s *WebhookServer) ListDeliveries(ctx context.Context, req *ListDeliveriesRequest) (*ListDeliveriesResponse, error) {
+	deliveries, err := s.service.ListDeliveries(ctx, req.GetSubscriptionId(), int(req.GetPageSize()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ListDeliveriesResponse{}
+	for _, d := range deliveries {
+		delivery := &Delivery{
+			Id:             d.ID,
+			EventId:        d.EventID,
+			EventType:      d.EventType,
+			Status:         string(d.Status),
+			Attempts:       int32(d.Attempts),
+			NextAttemptAt:  timestamppb.New(d.NextAttemptAt),
+			LastStatusCode: int32(d.LastStatusCode),
+			LastError:      d.LastError,
+			CreatedAt:      timestamppb.New(d.CreatedAt),
+		}
+		if d.DeliveredAt != nil {
+			delivery.DeliveredAt = timestamppb.New(*d.DeliveredAt)
+		}
+		resp.Deliveries = append(resp.Deliveries, delivery)
+	}
+	return resp, nil
+}
+
+// toSubscription maps a subscription without its secret
+func toSubscription(sub *user.Subscription) *Subscription {
+	return &Subscription{
+		Id:                  sub.ID,
+		Url:                 sub.URL,
+		EventTypes:          sub.EventTypes,
+		Enabled:             sub.Enabled,
+		ConsecutiveFailures: int32(sub.ConsecutiveFailures),
+		DisabledReason:      sub.DisabledReason,
+		CreatedAt:           timestamppb.New(sub.CreatedAt),
+		UpdatedAt:           timestamppb.New(sub.UpdatedAt),
+	}
+}
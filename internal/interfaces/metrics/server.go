@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// countTimeout bounds the query of a count gauge, a scrape never hangs on the database
+const countTimeout = 5 * time.Second
+
+// NewRegistry registers the collectors of the packages along the Go runtime and process metrics
+func NewRegistry(packages ...[]prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	for _, cs := range packages {
+		registry.MustRegister(cs...)
+	}
+	return registry
+}
+
+// NewServer serves the metrics of the registry on /metrics
+// It is meant for an admin port, apart from the API
+func NewServer(port string, registry *prometheus.Registry) *http.Server {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ErrorHandling: promhttp.ContinueOnError,
+		Registry:      registry,
+	}))
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%s", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// countGauge is a gauge read from the database on each scrape
+type countGauge struct {
+	desc  *prometheus.Desc
+	count func(context.Context) (int64, error)
+}
+
+// NewCountGauge returns a gauge set by count on each scrape, like the number of users
+// A failed count is reported as a scrape error, the other metrics are still served
+func NewCountGauge(name, help string, count func(context.Context) (int64, error)) prometheus.Collector {
+	return &countGauge{desc: prometheus.NewDesc(name, help, nil, nil), count: count}
+}
+
+func (g *countGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *countGauge) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+	n, err := g.count(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(g.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, float64(n))
+}
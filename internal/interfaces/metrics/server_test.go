@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServer test the metrics of the packages and the count gauges are served on /metrics
+func TestServer(t *testing.T) {
+	requests := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_requests_total", Help: "Requests"})
+	requests.Add(2)
+	countErr := errors.New("database down")
+	registry := NewRegistry([]prometheus.Collector{
+		requests,
+		NewCountGauge("test_users_total", "Users", func(context.Context) (int64, error) { return 42, nil }),
+		NewCountGauge("test_broken_total", "Broken", func(context.Context) (int64, error) { return 0, countErr }),
+	})
+	server := httptest.NewServer(NewServer("0", registry).Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "a failed count doesn't fail the scrape")
+	assert.Contains(t, string(body), "test_requests_total 2")
+	assert.Contains(t, string(body), "test_users_total 42")
+	assert.NotContains(t, string(body), "test_broken_total")
+	assert.Contains(t, string(body), "go_goroutines", "the runtime metrics are registered")
+
+	resp, err = http.Get(server.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "only /metrics is served")
+}
@@ -0,0 +1,180 @@
+package notifier
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// ConnectionManager keeps a RabbitMQ connection open
+// It watches the connection and reconnects with an exponential backoff and jitter when it is lost,
+// then calls the OnConnect hooks so channels and topology are declared again
+type ConnectionManager struct {
+	dial   func() (*amqp.Connection, error)
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	closed    bool
+	onConnect []func(*amqp.Connection) error
+	onStatus  []func(connected bool)
+}
+
+// NewConnectionManager create a manager dialing the configured broker
+func NewConnectionManager(conf config.Config) *ConnectionManager {
+	return &ConnectionManager{
+		dial:   func() (*amqp.Connection, error) { return NewRabbitMQConn(conf) },
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+}
+
+// OnConnect registers a hook called with the new connection after each reconnection
+// When a hook fails the connection is dropped and retried
+func (m *ConnectionManager) OnConnect(fn func(*amqp.Connection) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onConnect = append(m.onConnect, fn)
+}
+
+// OnStatusChange registers a hook called when the connection is lost and when it is back
+func (m *ConnectionManager) OnStatusChange(fn func(connected bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onStatus = append(m.onStatus, fn)
+}
+
+// Connect opens the first connection
+// It doesn't retry so a misconfigured broker stops the startup
+func (m *ConnectionManager) Connect() (*amqp.Connection, error) {
+	conn, err := m.dial()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conn = conn
+	return conn, nil
+}
+
+// Run watches the connection and reconnects when it is lost until ctx is done or Close is called
+// A channel closed by the broker should close the connection to be recovered as well
+func (m *ConnectionManager) Run(ctx context.Context) {
+	for {
+		m.mu.Lock()
+		conn := m.conn
+		m.mu.Unlock()
+
+		// NotifyClose on an already closed connection returns a closed channel
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-conn.NotifyClose(make(chan *amqp.Error, 1)):
+			if m.isClosed() {
+				return
+			}
+			m.logger.Error("RabbitMQ connection lost, reconnecting", "error", err)
+		}
+
+		m.setStatus(false)
+		if !m.reconnect(ctx) {
+			return
+		}
+		m.setStatus(true)
+		m.logger.Info("RabbitMQ connection recovered")
+	}
+}
+
+// reconnect dials until it succeeds and the hooks pass, it returns false when ctx is done first
+func (m *ConnectionManager) reconnect(ctx context.Context) bool {
+	for attempt := 0; ; attempt++ {
+		wait := backoff(attempt)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		if m.isClosed() {
+			return false
+		}
+
+		conn, err := m.dial()
+		if err != nil {
+			m.logger.Error("RabbitMQ reconnection failed", "attempt", attempt+1, "error", err)
+			continue
+		}
+		if err := m.runHooks(conn); err != nil {
+			m.logger.Error("RabbitMQ topology recovery failed", "attempt", attempt+1, "error", err)
+			_ = conn.Close()
+			continue
+		}
+
+		// Close may have run during the dial, the connection would never be closed
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			_ = conn.Close()
+			return false
+		}
+		m.conn = conn
+		m.mu.Unlock()
+		return true
+	}
+}
+
+func (m *ConnectionManager) runHooks(conn *amqp.Connection) error {
+	m.mu.Lock()
+	hooks := m.onConnect
+	m.mu.Unlock()
+	for _, hook := range hooks {
+		if err := hook(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ConnectionManager) setStatus(connected bool) {
+	m.mu.Lock()
+	hooks := m.onStatus
+	m.mu.Unlock()
+	for _, hook := range hooks {
+		hook(connected)
+	}
+}
+
+func (m *ConnectionManager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// Close stops the reconnections and closes the connection
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.conn == nil || m.conn.IsClosed() {
+		return nil
+	}
+	return m.conn.Close()
+}
+
+// backoff doubles the wait at each attempt up to the max, half of it being random
+// so instances don't reconnect all at once after a broker restart
+func backoff(attempt int) time.Duration {
+	d := reconnectMaxBackoff
+	if attempt < 16 {
+		d = min(reconnectMinBackoff<<attempt, reconnectMaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
@@ -0,0 +1,116 @@
+//go:build integration
+// +build integration
+
+package notifier
+
+import (
+	"context"
+	"github.com/dylan-dinh/esl-test/internal/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReconnectRecoversTopology test that a lost connection is dialed again
+// and the OnConnect hooks declare the topology on the new one
+func TestReconnectRecoversTopology(t *testing.T) {
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+
+	m := NewConnectionManager(conf)
+	first, err := m.Connect()
+	require.NoError(t, err)
+	defer m.Close()
+
+	var hooked []*amqp.Connection
+	m.OnConnect(func(conn *amqp.Connection) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+		if _, err := ch.QueueDeclare("", false, true, true, false, nil); err != nil {
+			return err
+		}
+		hooked = append(hooked, conn)
+		return nil
+	})
+	status := make(chan bool, 2)
+	m.OnStatusChange(func(connected bool) { status <- connected })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	require.NoError(t, first.Close())
+	for _, want := range []bool{false, true} {
+		select {
+		case got := <-status:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected connected=%v", want)
+		}
+	}
+
+	m.mu.Lock()
+	current := m.conn
+	m.mu.Unlock()
+	require.Len(t, hooked, 1)
+	assert.Same(t, current, hooked[0])
+	assert.NotSame(t, first, current)
+	assert.False(t, current.IsClosed())
+
+	require.NoError(t, m.Close())
+	assert.True(t, current.IsClosed())
+}
+
+// TestCloseDuringReconnect test that a connection dialed while Close runs
+// is closed instead of being kept by the manager
+func TestCloseDuringReconnect(t *testing.T) {
+	conf, err := config.GetConfig()
+	require.NoError(t, err)
+
+	m := NewConnectionManager(conf)
+	first, err := m.Connect()
+	require.NoError(t, err)
+
+	dial := m.dial
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	var dialed *amqp.Connection
+	m.dial = func() (*amqp.Connection, error) {
+		once.Do(func() { close(dialing) })
+		<-release
+		conn, err := dial()
+		dialed = conn
+		return conn, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(context.Background())
+	}()
+
+	require.NoError(t, first.Close())
+	select {
+	case <-dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reconnection")
+	}
+	require.NoError(t, m.Close())
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return after Close")
+	}
+	require.NotNil(t, dialed)
+	assert.True(t, dialed.IsClosed())
+	assert.Same(t, first, m.conn)
+}
@@ -0,0 +1,23 @@
+package notifier
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := range 40 {
+		ceiling := reconnectMaxBackoff
+		if attempt < 16 {
+			ceiling = min(reconnectMinBackoff<<attempt, reconnectMaxBackoff)
+		}
+		for range 50 {
+			d := backoff(attempt)
+			assert.GreaterOrEqual(t, d, ceiling/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, d, ceiling, "attempt %d", attempt)
+		}
+	}
+	assert.LessOrEqual(t, backoff(0), time.Second/2)
+	assert.GreaterOrEqual(t, backoff(100), reconnectMaxBackoff/2)
+}
@@ -3,14 +3,73 @@ package notifier
 import (
 	"fmt"
 	"github.com/dylan-dinh/esl-test/internal/config"
+	"github.com/dylan-dinh/esl-test/internal/domain/user"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"net"
+	"net/url"
+	"strings"
 )
 
-// NewRabbitMQConn create the RabbitMQ connection
+// NewRabbitMQConn create the RabbitMQ connection, over TLS for an amqps URL
 func NewRabbitMQConn(conf config.Config) (*amqp.Connection, error) {
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://guest:guest@%s:%s/", conf.RabbitHost, conf.RabbitPort))
+	url := AmqpURL(conf)
+	if !strings.HasPrefix(url, "amqps:") {
+		return amqp.Dial(url)
+	}
+	tlsConfig, err := conf.RabbitTLS.ClientConfig()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("rabbit tls: %w", err)
+	}
+	return amqp.DialTLS(url, tlsConfig)
+}
+
+// AmqpURL is the configured URL or the one built from the host, the credentials and the vhost
+// guest:guest connects to the default vhost when nothing is configured
+func AmqpURL(conf config.Config) string {
+	if conf.AmqpURL != "" {
+		return conf.AmqpURL
+	}
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword("guest", "guest"),
+		Host:   net.JoinHostPort(conf.RabbitHost, conf.RabbitPort),
+		Path:   "/",
+	}
+	if conf.RabbitTLS.Enabled {
+		u.Scheme = "amqps"
+	}
+	if conf.RabbitUsername != "" {
+		u.User = url.UserPassword(conf.RabbitUsername, conf.RabbitPassword)
+	}
+	if conf.RabbitVhost != "" && conf.RabbitVhost != "/" {
+		u.Path, u.RawPath = "/"+conf.RabbitVhost, "/"+url.PathEscape(conf.RabbitVhost)
+	}
+	return u.String()
+}
+
+// RabbitMQOptions maps the configuration to the options of the user events notifier
+func RabbitMQOptions(conf config.Config) user.RabbitMQOptions {
+	queues := make([]user.QueueSpec, 0, len(conf.RabbitQueues))
+	for _, q := range conf.RabbitQueues {
+		queues = append(queues, user.QueueSpec{Name: q.Name, BindingKeys: q.BindingKeys})
+	}
+	return user.RabbitMQOptions{
+		Encoder: user.CloudEventsEncoder{
+			Source:      conf.CloudEventsSource,
+			Mode:        user.ContentMode(conf.CloudEventsMode),
+			ContentType: conf.EventsContentType,
+		},
+		Channels:    conf.RabbitPublishChannels,
+		MaxInFlight: conf.RabbitMaxInFlight,
+		Topology: user.Topology{
+			Queues:             queues,
+			Type:               user.QueueType(conf.RabbitQueueType),
+			Durable:            conf.RabbitQueueDurable,
+			Persistent:         conf.RabbitPersistent,
+			DeadLetterExchange: conf.RabbitDeadLetterExchange,
+			DeadLetterQueue:    conf.RabbitDeadLetterQueue,
+			MessageTTL:         conf.RabbitMessageTTL,
+			MaxLength:          conf.RabbitQueueMaxLength,
+		},
 	}
-	return conn, nil
 }